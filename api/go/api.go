@@ -1,15 +1,15 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
-	"fmt"
-	"io/ioutil"
+	"errors"
 	"net/http"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/gorilla/mux"
+
+	rpc "linechain/json-rpc"
 )
 
 // API是一个单独的服务，可以称为API服务，以Restful接口服务的方式提供
@@ -26,67 +26,38 @@ const (
 	PORT = ":8000"
 )
 
-func getBlockchain(w http.ResponseWriter, r *http.Request) {
-	var jsonStr = []byte(`{
-		"id": 1,
-		"method": "API.GetBlockchain", 
-		"params": []
-	}`)
-	req, err := http.NewRequest("POST", URL, bytes.NewBuffer(jsonStr))
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		panic(err)
-	}
-	defer resp.Body.Close()
+var client = rpc.NewClient(URL)
 
-	log.Info("response Status:", resp.Status)
-	log.Info("response Headers:", resp.Header)
-	body, _ := ioutil.ReadAll(resp.Body)
-	log.Info("response Body:", string(body))
+// forward 调用节点的JSON-RPC方法，将结果（或错误对象）写入响应
+func forward(w http.ResponseWriter, method string, params interface{}) {
+	var result json.RawMessage
+	err := client.Call(method, params, &result)
 
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.WriteHeader(http.StatusOK)
-	_, err = w.Write(body)
-	if err != nil {
-		log.Errorf("写入 response body 失败: %v", err)
+	var rpcErr *rpc.Error
+	switch {
+	case errors.As(err, &rpcErr):
+		w.WriteHeader(http.StatusBadRequest)
+		result, _ = json.Marshal(rpcErr)
+	case err != nil:
+		log.Errorf("调用 %s 失败: %v", method, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
 		return
+	default:
+		w.WriteHeader(http.StatusOK)
+	}
+	if _, err := w.Write(result); err != nil {
+		log.Errorf("写入 response body 失败: %v", err)
 	}
 }
 
+func getBlockchain(w http.ResponseWriter, r *http.Request) {
+	forward(w, "API.GetBlockchain", nil)
+}
+
 func getBalance(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	byt := fmt.Sprintf(`{
-		"id": 1,
-		"method": "API.GetBalance", 
-		"params": [{"Address": "%s"}]
-	}`, vars["address"])
-
-	var jsonStr = []byte(byt)
-	req, err := http.NewRequest("POST", URL, bytes.NewBuffer(jsonStr))
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		panic(err)
-	}
-	defer resp.Body.Close()
-
-	log.Info("response Status:", resp.Status)
-	log.Info("response Headers:", resp.Header)
-	body, _ := ioutil.ReadAll(resp.Body)
-	log.Info("response Body:", string(body))
-
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.WriteHeader(http.StatusOK)
-	_, err = w.Write(body)
-	if err != nil {
-		log.Errorf("写入 response body 失败: %v", err)
-		return
-	}
+	forward(w, "API.GetBalance", rpc.Args{Address: vars["address"]})
 }
 
 func send(w http.ResponseWriter, r *http.Request) {
@@ -97,32 +68,13 @@ func send(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fmt.Println(respBody)
-	byt := fmt.Sprintf(`{"id": 1 , "method": "API.Send", "params": [{"sendFrom":"%s","sendTo": "%s", "amount": %f}]}`, respBody.SendFrom, respBody.SendTo, respBody.Amount)
-	var jsonStr = []byte(byt)
-	req, err := http.NewRequest("POST", URL, bytes.NewBuffer(jsonStr))
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		panic(err)
-	}
-	defer resp.Body.Close()
-
-	log.Info("response Status:", resp.Status)
-	log.Info("response Headers:", resp.Header)
-	body, _ := ioutil.ReadAll(resp.Body)
-	log.Info("response Body:", string(body))
-
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.WriteHeader(http.StatusOK)
-	_, err = w.Write(body)
-	if err != nil {
-		log.Errorf("写入 response body 失败: %v", err)
-		return
-	}
+	forward(w, "API.Send", rpc.SendArgs{
+		SendFrom: respBody.SendFrom,
+		SendTo:   respBody.SendTo,
+		Amount:   respBody.Amount,
+	})
 }
+
 func main() {
 	router := mux.NewRouter()
 	router.HandleFunc("/getblockchain", getBlockchain).Methods("GET")
@@ -1,14 +1,18 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"time"
 
 	"linechain/console/utils"
 	blockchain "linechain/core"
 	jsonrpc "linechain/json-rpc"
 	"linechain/p2p"
 	"linechain/util/env"
+	"linechain/util/lifecycle"
+	appUtils "linechain/util/utils"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -22,6 +26,7 @@ func main() {
 
 	var rpcPort string
 	var rpcAddr string
+	var rpcOrigins []string
 	var rpc bool
 
 	cli := utils.CommandLine{
@@ -124,6 +129,24 @@ func main() {
 	var miner bool
 	var fullNode bool
 	var listenPort string
+	var banDuration time.Duration
+	var nodeKey string
+	var keyType string
+	var bootNodes []string
+	var rendezvous string
+	var privateDHT bool
+	var useDHT bool
+	var useMDNS bool
+	var swarmKey string
+	var allowlist string
+	var networkId uint32
+	var lowPeers int
+	var highPeers int
+	var maxInbound int
+	var maxStreams int
+	var maxMemory int64
+	var metricsAddr string
+	var headless bool
 	var nodeCmd = &cobra.Command{
 		Use:   "startnode",
 		Short: "开始一个节点",
@@ -135,14 +158,46 @@ func main() {
 			}
 
 			cli := cli.UpdateInstance(instanceId, false)
-			cli.StartNode(listenPort, minerAddress, miner, fullNode, func(net *p2p.Network) { //最后一个参数是回调函数，获得net实例
+			if headless {
+				appUtils.SetJSONLog()
+			}
+			cfg := p2p.NodeConfig{
+				ListenPort:   listenPort,
+				MinerAddress: minerAddress,
+				Miner:        miner,
+				FullNode:     fullNode,
+				BanDuration:  banDuration,
+				NodeKey:      nodeKey,
+				KeyType:      keyType,
+				BootNodes:    bootNodes,
+				Rendezvous:   rendezvous,
+				PrivateDHT:   privateDHT,
+				NoDHT:        !useDHT,
+				MDNS:         useMDNS,
+				SwarmKey:     swarmKey,
+				Allowlist:    allowlist,
+				NetworkID:    networkId,
+				LowPeers:     lowPeers,
+				HighPeers:    highPeers,
+				MaxInbound:   maxInbound,
+				MaxStreams:   maxStreams,
+				MaxMemory:    maxMemory,
+				MetricsAddr:  metricsAddr,
+				Headless:     headless,
+			}
+			err := cli.StartNode(cfg, func(net *p2p.Network) { //最后一个参数是回调函数，获得net实例
 				if rpc {
 					//如果启用rpc，则启动节点后设置cli的P2P实例，net为启动节点函数的回调函数参数被回调后返回的Network实例
 					//如果不启用rpc，则cli.P2p为nil
+					//RPC服务由节点的生命周期管理器启动，并在p2p网络之前停止
 					cli.Network = net
-					go jsonrpc.StartServer(cli, rpc, rpcPort, rpcAddr)
+					net.Lifecycle.Register(jsonrpc.LifecycleHook(cli, rpcPort, rpcAddr, rpcOrigins, "p2p"))
 				}
 			})
+			if err != nil {
+				//节点未能有序退出，以非0退出码结束进程
+				os.Exit(1)
+			}
 		},
 	}
 	//从命令行参数中读取命令所需的各参数，从config中读取默认参数
@@ -150,6 +205,24 @@ func main() {
 	nodeCmd.Flags().StringVar(&minerAddress, "address", conf.MinerAddress, "设置矿工钱包地址")
 	nodeCmd.Flags().BoolVar(&miner, "miner", conf.Miner, "如果以矿工的身份加入网络，设置为true")
 	nodeCmd.Flags().BoolVar(&fullNode, "fullnode", conf.FullNode, "如果以全节点身份加入网络，设置为true")
+	nodeCmd.Flags().StringVar(&nodeKey, "nodekey", "", "节点密钥文件（缺省为tmp/nodekey_INSTANCE_ID.json），文件不存在时自动生成")
+	nodeCmd.Flags().StringVar(&keyType, "keytype", "rsa", "生成节点密钥的类型：rsa或ed25519")
+	nodeCmd.Flags().StringSliceVar(&bootNodes, "bootnodes", nil, "引导节点的multiaddr（如 /ip4/10.0.0.1/tcp/4000/p2p/PEER_ID），多个地址用逗号分隔或重复指定")
+	nodeCmd.Flags().StringVar(&rendezvous, "rendezvous", p2p.DefaultRendezvous, "节点发现的会合点，只有会合点相同的节点才能相互发现")
+	nodeCmd.Flags().BoolVar(&privateDHT, "privatedht", false, "使用私有DHT，不连接IPFS的公共引导节点和公共DHT")
+	nodeCmd.Flags().BoolVar(&useDHT, "dht", true, "通过Kademlia DHT发现节点，只使用mDNS时设置为false")
+	nodeCmd.Flags().BoolVar(&useMDNS, "mdns", false, "通过mDNS发现同一局域网或同一台主机上的节点")
+	nodeCmd.Flags().StringVar(&swarmKey, "swarmkey", "", "私有网络的预共享密钥文件（swarm.key），指定后只有持有相同密钥的节点可以连接")
+	nodeCmd.Flags().StringVar(&allowlist, "allowlist", "", "允许连接的节点白名单文件（节点ID的JSON数组），可通过SIGHUP或RPC重新加载")
+	nodeCmd.Flags().Uint32Var(&networkId, "networkid", p2p.DefaultNetworkID, "网络ID，只有网络ID相同的节点才能互通")
+	nodeCmd.Flags().DurationVar(&banDuration, "banduration", p2p.DefaultBanDuration, "不当行为分数达到上限的节点被禁止的时长")
+	nodeCmd.Flags().IntVar(&lowPeers, "lowpeers", p2p.DefaultLowPeers, "连接数的低水位，超过高水位时断开连接直到低水位")
+	nodeCmd.Flags().IntVar(&highPeers, "highpeers", p2p.DefaultHighPeers, "连接数的高水位")
+	nodeCmd.Flags().IntVar(&maxInbound, "maxinbound", p2p.DefaultMaxInbound, "入站连接数的上限")
+	nodeCmd.Flags().IntVar(&maxStreams, "maxstreams", 0, "流数量的上限，0表示按系统资源自动计算")
+	nodeCmd.Flags().BoolVar(&headless, "headless", false, "以后台服务方式运行：不使用文字界面，日志以JSON格式输出，收到SIGTERM时有序退出")
+	nodeCmd.Flags().StringVar(&metricsAddr, "metrics", "", "Prometheus指标的HTTP监听地址（如 127.0.0.1:9100），为空时不导出指标")
+	nodeCmd.Flags().Int64Var(&maxMemory, "maxmemory", 0, "libp2p可以使用的内存（MB），0表示使用系统内存的1/8")
 
 	/*
 	* SEND 命令 执行本地和网络操作，与P2P网络相关
@@ -188,7 +261,22 @@ func main() {
 
 			if rpc {
 				//启动后，第三方客户端可以通过jsonrpc访问本节点服务器的接口
-				jsonrpc.StartServer(cli, rpc, rpcPort, rpcAddr)
+				//收到退出信号时先关闭RPC服务，再关闭数据库；有序退出时退出码为0
+				lc := lifecycle.New(lifecycle.DefaultTimeout)
+				lc.Register(lifecycle.Hook{
+					Name: "db",
+					Stop: func(context.Context) error {
+						if cli.Blockchain.Database == nil {
+							return nil
+						}
+						return cli.Blockchain.Database.Close()
+					},
+				})
+				lc.Register(jsonrpc.LifecycleHook(cli, rpcPort, rpcAddr, rpcOrigins, "db"))
+				if err := lc.Run(context.Background()); err != nil {
+					log.Error(err)
+					os.Exit(1)
+				}
 			}
 		},
 	}
@@ -204,6 +292,7 @@ func main() {
 	rootCmd.PersistentFlags().StringVar(&rpcPort, "rpcport", "", "HTTP-RPC服务器正在监听的端口 (默认: 5000)")
 	rootCmd.PersistentFlags().StringVar(&rpcAddr, "rpcaddr", "", "HTTP-RPC服务器监听地址 (默认: localhost)")
 	rootCmd.PersistentFlags().BoolVar(&rpc, "rpc", false, "启用HTTP-RPC服务器")
+	rootCmd.PersistentFlags().StringSliceVar(&rpcOrigins, "rpcorigins", nil, "允许访问HTTP-RPC和WebSocket的浏览器来源，逗号分隔（默认只允许同源）")
 
 	//instanceid参数为必须参数，设置instanceId，这是唯一获取instanceid的地方
 	rootCmd.PersistentFlags().StringVar(&instanceId, "instanceid", "", "Blockchain实例")
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"encoding/hex"
 	"fmt"
 	"strconv"
 	"time"
@@ -10,6 +11,7 @@ import (
 	"linechain/util/utils"
 	"linechain/wallet"
 
+	"github.com/libp2p/go-libp2p/core/peer"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -40,9 +42,61 @@ type SendResponse struct {
 	Error     *Error
 }
 
+// TxProofResponse 交易的Merkle包含证明，哈希均为十六进制字符串
+type TxProofResponse struct {
+	TxID       string
+	BlockHash  string
+	Height     int
+	MerkleRoot string
+	Index      int
+	Siblings   []string
+	Timestamp  int64
+	Error      *Error
+}
+
+type SyncStatusResponse struct {
+	p2p.SyncProgress
+	Timestamp int64
+	Error     *Error
+}
+
+type BanListResponse struct {
+	Banned    []p2p.BanEntry
+	Timestamp int64
+	Error     *Error
+}
+
+type BanResponse struct {
+	PeerID    string
+	Banned    bool
+	Timestamp int64
+	Error     *Error
+}
+
+type PeersResponse struct {
+	Peers     []p2p.PeerInfo
+	Timestamp int64
+	Error     *Error
+}
+
+type AllowlistResponse struct {
+	Peers     []string
+	Timestamp int64
+	Error     *Error
+}
+
+type VerifyTxProofResponse struct {
+	TxID       string
+	MerkleRoot string
+	Valid      bool
+	Timestamp  int64
+	Error      *Error
+}
+
 // StartNode 启动节点，其中fn为回调函数，p2p.StartNode调用过程中调用fn，设置p2p.Network实例
-func (cli *CommandLine) StartNode(listenPort, minerAddress string, miner, fullNode bool, fn func(*p2p.Network)) {
-	if miner {
+func (cli *CommandLine) StartNode(cfg p2p.NodeConfig, fn func(*p2p.Network)) error {
+	listenPort, minerAddress := cfg.ListenPort, cfg.MinerAddress
+	if cfg.Miner {
 		log.Infof("作为矿工正在启动节点： %s\n", listenPort)
 		if len(minerAddress) > 0 {
 			if wallet.ValidateAddress(minerAddress) {
@@ -56,7 +110,7 @@ func (cli *CommandLine) StartNode(listenPort, minerAddress string, miner, fullNo
 	}
 
 	chain := cli.Blockchain.ContinueBlockchain()
-	p2p.StartNode(chain, listenPort, minerAddress, miner, fullNode, fn)
+	return p2p.StartNode(chain, cfg, fn)
 }
 
 // UpdateInstance 设置区块链的instanceid（从命令行参数中读取instanceid参数，设定为cli.Blockchain的InstanceId）
@@ -310,3 +364,289 @@ func (cli *CommandLine) GetBlockByHeight(height int) blockchain.Block {
 
 	return block
 }
+
+// GetTxProof 得到交易的Merkle包含证明
+// 轻客户端只需要区块头中的MerkleRoot，即可用证明验证交易确实包含在区块中
+func (cli *CommandLine) GetTxProof(txID string) TxProofResponse {
+	ID, err := hex.DecodeString(txID)
+	if err != nil {
+		log.Error("交易ID非法")
+		return TxProofResponse{
+			Error: &Error{
+				Code:    5028,
+				Message: "交易ID非法",
+			},
+		}
+	}
+	chain := cli.Blockchain.ContinueBlockchain()
+	if cli.CloseDbAlways {
+		defer chain.Database.Close()
+	}
+
+	block, err := chain.FindTransactionBlock(ID)
+	if err != nil {
+		log.Error(err)
+		return TxProofResponse{
+			Error: &Error{
+				Code:    5028,
+				Message: "区块链中不存在该交易",
+			},
+		}
+	}
+	proof, err := block.TxProof(ID)
+	if err != nil {
+		log.Error(err)
+		return TxProofResponse{
+			Error: &Error{
+				Code:    5028,
+				Message: "生成交易证明失败",
+			},
+		}
+	}
+
+	var siblings []string
+	for _, sibling := range proof.Siblings {
+		siblings = append(siblings, hex.EncodeToString(sibling))
+	}
+
+	return TxProofResponse{
+		TxID:       txID,
+		BlockHash:  hex.EncodeToString(block.Hash),
+		Height:     block.Height,
+		MerkleRoot: hex.EncodeToString(block.MerkleRoot),
+		Index:      proof.Index,
+		Siblings:   siblings,
+		Timestamp:  time.Now().Unix(),
+		Error:      &Error{},
+	}
+}
+
+// VerifyTxProof 使用MerkleRoot验证交易的Merkle包含证明
+// merkleRoot为空时，使用本地区块链中blockHash对应区块头的MerkleRoot
+func (cli *CommandLine) VerifyTxProof(txID, blockHash, merkleRoot string, index int, siblings []string) VerifyTxProofResponse {
+	invalid := func(message string) VerifyTxProofResponse {
+		log.Error(message)
+		return VerifyTxProofResponse{
+			Error: &Error{
+				Code:    5028,
+				Message: message,
+			},
+		}
+	}
+
+	proof := &blockchain.MerkleProof{Index: index}
+	ID, err := hex.DecodeString(txID)
+	if err != nil {
+		return invalid("交易ID非法")
+	}
+	proof.TxID = ID
+	for _, sibling := range siblings {
+		hash, err := hex.DecodeString(sibling)
+		if err != nil {
+			return invalid("证明中的哈希非法")
+		}
+		proof.Siblings = append(proof.Siblings, hash)
+	}
+
+	root, err := hex.DecodeString(merkleRoot)
+	if err != nil {
+		return invalid("MerkleRoot非法")
+	}
+	if len(root) == 0 {
+		hash, err := hex.DecodeString(blockHash)
+		if err != nil || len(hash) == 0 {
+			return invalid("需要提供MerkleRoot或区块哈希")
+		}
+		chain := cli.Blockchain.ContinueBlockchain()
+		if cli.CloseDbAlways {
+			defer chain.Database.Close()
+		}
+		header, err := chain.GetHeader(hash)
+		if err != nil {
+			return invalid("区块链中不存在该区块")
+		}
+		root = header.MerkleRoot
+	}
+
+	valid := blockchain.VerifyMerkleProof(root, proof)
+	log.Infof("交易%s的包含证明验证结果:%t", txID, valid)
+
+	return VerifyTxProofResponse{
+		TxID:       txID,
+		MerkleRoot: hex.EncodeToString(root),
+		Valid:      valid,
+		Timestamp:  time.Now().Unix(),
+		Error:      &Error{},
+	}
+}
+
+// GetSyncStatus 得到节点区块同步的进度
+func (cli *CommandLine) GetSyncStatus() SyncStatusResponse {
+	if cli.Network == nil {
+		return SyncStatusResponse{
+			Error: &Error{
+				Code:    5028,
+				Message: "节点未启动",
+			},
+		}
+	}
+
+	return SyncStatusResponse{
+		SyncProgress: cli.Network.Sync.Progress(),
+		Timestamp:    time.Now().Unix(),
+		Error:        &Error{},
+	}
+}
+
+// ListBanned 列出被禁止的节点
+func (cli *CommandLine) ListBanned() BanListResponse {
+	if cli.Network == nil {
+		return BanListResponse{
+			Error: &Error{
+				Code:    5028,
+				Message: "节点未启动",
+			},
+		}
+	}
+
+	return BanListResponse{
+		Banned:    cli.Network.Bans.List(),
+		Timestamp: time.Now().Unix(),
+		Error:     &Error{},
+	}
+}
+
+// BanPeer 禁止节点，duration为空时使用启动节点时设置的禁止时长
+func (cli *CommandLine) BanPeer(peerId, duration string) BanResponse {
+	if cli.Network == nil {
+		return BanResponse{
+			PeerID: peerId,
+			Error: &Error{
+				Code:    5028,
+				Message: "节点未启动",
+			},
+		}
+	}
+
+	id, err := peer.Decode(peerId)
+	if err != nil {
+		return BanResponse{
+			PeerID: peerId,
+			Error: &Error{
+				Code:    5028,
+				Message: fmt.Sprintf("非法的节点ID: %s", err),
+			},
+		}
+	}
+	var d time.Duration
+	if duration != "" {
+		if d, err = time.ParseDuration(duration); err != nil || d <= 0 {
+			return BanResponse{
+				PeerID: peerId,
+				Error: &Error{
+					Code:    5028,
+					Message: fmt.Sprintf("非法的禁止时长: %s", duration),
+				},
+			}
+		}
+	}
+
+	if err := cli.Network.Bans.Ban(id, d, "RPC"); err != nil {
+		return BanResponse{
+			PeerID: peerId,
+			Error: &Error{
+				Code:    5028,
+				Message: err.Error(),
+			},
+		}
+	}
+	return BanResponse{
+		PeerID:    peerId,
+		Banned:    true,
+		Timestamp: time.Now().Unix(),
+		Error:     &Error{},
+	}
+}
+
+// UnbanPeer 解除对节点的禁止
+func (cli *CommandLine) UnbanPeer(peerId string) BanResponse {
+	if cli.Network == nil {
+		return BanResponse{
+			PeerID: peerId,
+			Error: &Error{
+				Code:    5028,
+				Message: "节点未启动",
+			},
+		}
+	}
+
+	id, err := peer.Decode(peerId)
+	if err == nil {
+		err = cli.Network.Bans.Unban(id)
+	}
+	if err != nil {
+		return BanResponse{
+			PeerID: peerId,
+			Banned: err == p2p.ErrNotBanned,
+			Error: &Error{
+				Code:    5028,
+				Message: err.Error(),
+			},
+		}
+	}
+	return BanResponse{
+		PeerID:    peerId,
+		Banned:    false,
+		Timestamp: time.Now().Unix(),
+		Error:     &Error{},
+	}
+}
+
+// ReloadAllowlist 重新加载节点白名单，并断开不在白名单中的节点
+func (cli *CommandLine) ReloadAllowlist() AllowlistResponse {
+	if cli.Network == nil {
+		return AllowlistResponse{
+			Error: &Error{
+				Code:    5028,
+				Message: "节点未启动",
+			},
+		}
+	}
+
+	ids, err := cli.Network.ReloadAllowlist()
+	if err != nil {
+		return AllowlistResponse{
+			Error: &Error{
+				Code:    5028,
+				Message: err.Error(),
+			},
+		}
+	}
+	peers := []string{}
+	for _, id := range ids {
+		peers = append(peers, id.Pretty())
+	}
+	return AllowlistResponse{
+		Peers:     peers,
+		Timestamp: time.Now().Unix(),
+		Error:     &Error{},
+	}
+}
+
+// GetPeers 列出握手成功的节点（协议版本、客户端标识、服务和高度）
+func (cli *CommandLine) GetPeers() PeersResponse {
+	if cli.Network == nil {
+		return PeersResponse{
+			Error: &Error{
+				Code:    5028,
+				Message: "节点未启动",
+			},
+		}
+	}
+
+	return PeersResponse{
+		Peers:     cli.Network.Peers.List(),
+		Timestamp: time.Now().Unix(),
+		Error:     &Error{},
+	}
+}
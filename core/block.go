@@ -2,58 +2,64 @@ package blockchain
 
 import (
 	"bytes"
-	"encoding/gob"
 	"fmt"
 	"time"
+
+	log "github.com/sirupsen/logrus"
 )
 
-//Block 区块结构新版，增加了计数器nonce，主要目的是为了校验区块是否合法
-//即挖出的区块是否满足工作量证明要求的条件
+//Block 区块结构，由区块头和区块体（交易）组成
+//区块头中的计数器nonce，主要目的是为了校验区块是否合法，即挖出的区块是否满足工作量证明要求的条件
+//Hash为区块头的哈希，不参与编码，解码时由区块头重新计算
 type Block struct {
-	Timestamp    int64          `json:"Timestamp"`
+	BlockHeader
 	Hash         []byte         `json:"Hash"`
-	PrevHash     []byte         `json:"PrevHash"`
 	Transactions []*Transaction `json:"Transactions"`
-	Nonce        int            `json:"Nonce"`
-	Height       int            `json:"Height"`
-	MerkleRoot   []byte         `json:"MerkleRoot"`
-	Difficulty   int            `json:"Difficulty"`
 	TxCount      int            `json:"TxCount"`
 }
 
 // HashTransactions 计算交易组合的哈希值，最后得到的是Merkle tree的根节点
-//获得每笔交易的哈希，将它们关联起来，然后获得一个连接后的组合哈希
+//Merkle树的叶子为每笔交易的ID，将它们两两关联起来哈希，最后获得一个组合哈希
 func (block *Block) HashTransactions() []byte {
-	var txHashes [][]byte
+	return block.merkleTree().RootNode.Data
+}
+
+func (block *Block) merkleTree() *MerkleTree {
+	var txIDs [][]byte
 
 	for _, tx := range block.Transactions {
-		txHashes = append(txHashes, tx.Serializer())
+		txIDs = append(txIDs, tx.ID)
 	}
 
-	tree := NewMerkleTree(txHashes)
-	return tree.RootNode.Data
+	return NewMerkleTree(txIDs)
+}
+
+// TxProof 生成区块中某笔交易的Merkle包含证明
+func (block *Block) TxProof(txID []byte) (*MerkleProof, error) {
+	return block.merkleTree().Proof(txID)
 }
 
 // CreateBlock挖出区块
 func CreateBlock(txs []*Transaction, prevHash []byte, height int) *Block {
 	block := &Block{
-		time.Now().Unix(),
-		[]byte{},
-		prevHash,
-		txs,
-		0,
-		height,
-		[]byte{},
-		Difficulty,
-		len(txs),
+		BlockHeader: BlockHeader{
+			Version:   BlockVersion,
+			PrevHash:  prevHash,
+			Timestamp: time.Now().Unix(),
+			Bits:      Difficulty,
+			Height:    height,
+		},
+		Transactions: txs,
+		TxCount:      len(txs),
 	}
+	//先设置MerkleRoot，POW作用于包含MerkleRoot的区块头
+	block.MerkleRoot = block.HashTransactions()
+
 	pow := NewProof(block)
 	nonce, hash := pow.Run()
 
 	block.Hash = hash[:]
 	block.Nonce = nonce
-	//设置MerkleRoot
-	block.MerkleRoot = block.HashTransactions()
 
 	return block
 }
@@ -63,40 +69,33 @@ func Genesis(MinerTx *Transaction) *Block {
 	return CreateBlock([]*Transaction{MinerTx}, []byte{}, 1)
 }
 
-// 工具函数，序列化区块链数据
+// 工具函数，序列化区块链数据（线格式见encoding.go）
 func (b *Block) Serialize() []byte {
-	var res bytes.Buffer
-	encoder := gob.NewEncoder(&res)
-
-	err := encoder.Encode(b)
-	Handle(err)
-	return res.Bytes()
+	return EncodeBlock(b)
 }
 
-// 工具函数，反序列化区块链数据
+// 工具函数，反序列化区块链数据，数据格式错误时panic
+// 来自网络等不可信来源的数据请使用DecodeBlock
 func DeSerialize(data []byte) *Block {
-	var block Block
-	encoder := gob.NewDecoder(bytes.NewReader(data))
-
-	err := encoder.Decode(&block)
+	block, err := DecodeBlock(data)
 	Handle(err)
-	return &block
+	return block
 }
 func (b *Block) IsGenesis() bool {
 	return b.PrevHash == nil
 }
 
 // 通过确认区块中的各种信息来检查该区块是否有效
+// 区块头必须连接在oldBlock之后且POW合法，MerkleRoot必须与区块中的交易一致
 func (b *Block) IsBlockValid(oldBlock Block) bool {
-	if oldBlock.Height+1 != b.Height {
+	if err := b.BlockHeader.CheckConnects(&oldBlock.BlockHeader); err != nil {
+		log.Warnf("区块 %x 不合法: %s", b.Hash, err)
 		return false
 	}
-	res := bytes.Compare(oldBlock.Hash, b.PrevHash)
-	if res != 0 {
+	if !bytes.Equal(b.MerkleRoot, b.HashTransactions()) {
+		log.Warnf("区块 %x 不合法: %s", b.Hash, ErrBadMerkleRoot)
 		return false
 	}
-	// pow := NewProof(b)
-	// validate := pow.Validate()
 
 	return true
 }
@@ -108,7 +107,7 @@ func ConstructJSON(buffer *bytes.Buffer, block *Block) {
 
 	buffer.WriteString(fmt.Sprintf("\"%s\":\"%x\",", "Hash", block.Hash))
 
-	buffer.WriteString(fmt.Sprintf("\"%s\":%d,", "Difficulty", block.Difficulty))
+	buffer.WriteString(fmt.Sprintf("\"%s\":%d,", "Difficulty", block.Bits))
 
 	buffer.WriteString(fmt.Sprintf("\"%s\":%d,", "Nonce", block.Nonce))
 
@@ -123,3 +122,13 @@ func (bs *Block) MarshalJSON() ([]byte, error) {
 	buffer.WriteString("]")
 	return buffer.Bytes(), nil
 }
+
+// NewBlock 由区块头和交易组装区块，区块哈希由区块头计算得到
+func NewBlock(header *BlockHeader, txs []*Transaction) *Block {
+	return &Block{
+		BlockHeader:  *header,
+		Hash:         header.Hash(),
+		Transactions: txs,
+		TxCount:      len(txs),
+	}
+}
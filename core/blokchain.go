@@ -3,7 +3,7 @@ package blockchain
 import (
 	"bytes"
 	"crypto/ecdsa"
-	"encoding/gob"
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -33,8 +33,104 @@ var (
 	// 项目的根目录
 	Root        = filepath.Join(filepath.Dir(b), "../")
 	genesisData = "genesis"
+
+	// 区块头和区块体分开存储，键值分别为前缀+区块哈希
+	headerPrefix = []byte("hdr-")
+	bodyPrefix   = []byte("blk-")
+	// 主链的高度索引，键值为前缀+高度（8字节大端），值为该高度的主链区块哈希
+	heightPrefix = []byte("hgt-")
 )
 
+func headerKey(hash []byte) []byte {
+	return append(append([]byte{}, headerPrefix...), hash...)
+}
+
+func bodyKey(hash []byte) []byte {
+	return append(append([]byte{}, bodyPrefix...), hash...)
+}
+
+func heightKey(height int) []byte {
+	key := make([]byte, len(heightPrefix)+8)
+	copy(key, heightPrefix)
+	binary.BigEndian.PutUint64(key[len(heightPrefix):], uint64(height))
+	return key
+}
+
+// setHead 将block设置为主链的最新区块，并更新主链的高度索引
+// 从block向前改写索引，直到遇到索引中已经记录的祖先区块，因此切换分叉时只改写分叉部分
+// 没有高度索引的旧数据库在最新区块第一次变化时补全全部索引
+func setHead(txn *badger.Txn, block *Block) error {
+	if err := txn.Set([]byte("lh"), block.Hash); err != nil {
+		return err
+	}
+	hash, height := block.Hash, block.Height
+	for len(hash) > 0 {
+		item, err := txn.Get(heightKey(height))
+		if err == nil {
+			indexed, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			if bytes.Equal(indexed, hash) {
+				return nil
+			}
+		} else if err != badger.ErrKeyNotFound {
+			return err
+		}
+		if err := txn.Set(heightKey(height), hash); err != nil {
+			return err
+		}
+		header, err := readHeader(txn, hash)
+		if err != nil {
+			return err
+		}
+		hash, height = header.PrevHash, height-1
+	}
+	return nil
+}
+
+// writeBlock 将区块头和区块体分别写入数据库
+func writeBlock(txn *badger.Txn, block *Block) error {
+	if err := txn.Set(headerKey(block.Hash), block.BlockHeader.Serialize()); err != nil {
+		return err
+	}
+	return txn.Set(bodyKey(block.Hash), EncodeBody(block.Transactions))
+}
+
+// readHeader 从数据库读取区块头
+func readHeader(txn *badger.Txn, hash []byte) (*BlockHeader, error) {
+	item, err := txn.Get(headerKey(hash))
+	if err != nil {
+		return nil, err
+	}
+	data, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeHeader(data)
+}
+
+// readBlock 从数据库读取区块头和区块体，组装成完整的区块
+func readBlock(txn *badger.Txn, hash []byte) (*Block, error) {
+	header, err := readHeader(txn, hash)
+	if err != nil {
+		return nil, err
+	}
+	item, err := txn.Get(bodyKey(hash))
+	if err != nil {
+		return nil, err
+	}
+	data, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil, err
+	}
+	txs, err := DecodeBody(data)
+	if err != nil {
+		return nil, err
+	}
+	return NewBlock(header, txs), nil
+}
+
 // DBExists 检查区块链数据库是否存在
 func DBExists(path string) bool {
 	if _, err := os.Stat(path); os.IsNotExist(err) {
@@ -131,10 +227,10 @@ func InitBlockchain(address string, instanceId string) *Blockchain {
 		log.Info("没有找到已经存在的区块链")//创建创始区块交易
 		genesis := Genesis(cbtx)//挖出创始区块
 		//将创始区块存入到本地数据库
-		err = txn.Set(genesis.Hash, genesis.Serialize())
+		err = writeBlock(txn, genesis)
 		Handle(err)
 		//链最后一个节点key为"1h"，value是lastHash，存入数据库
-		err = txn.Set([]byte("lh"), genesis.Hash)
+		err = setHead(txn, genesis)
 		
 		lastHash = genesis.Hash
 
@@ -148,35 +244,36 @@ func InitBlockchain(address string, instanceId string) *Blockchain {
 // AddBlock 将一个区块加入到区块链
 func (chain *Blockchain) AddBlock(block *Block) *Block {
 	mutex.Lock()//数据库锁
+	var oldHead []byte //区块成为主链的最新区块时，之前的最新区块哈希
+	newHead := false
 
 	//读-写操作
 	err := chain.Database.Update(func(txn *badger.Txn) error {
-		if _, err := txn.Get(block.Hash); err == nil {
+		if _, err := txn.Get(bodyKey(block.Hash)); err == nil {
 			return nil//如果区块已经存在于数据库，直接返回（所以如果是来自本地的区块，不会再次加入）
 		}
 
-		blockData := block.Serialize()
-		err := txn.Set(block.Hash, blockData)
+		err := writeBlock(txn, block)
 		Handle(err)
 
 		// 得到最后一个区块
 		item, err := txn.Get([]byte("lh"))//最后一个区块的键值为“1h”
 		if err == nil {
 			lastHash, _ := item.ValueCopy(nil)
-			item, err = txn.Get(lastHash)
+			lastBlock, err := readHeader(txn, lastHash)
 			Handle(err)
-			lastBlockData, _ := item.ValueCopy(nil)
-			lastBlock := DeSerialize(lastBlockData)
 
 			// 检查当前区块的height是否比lastBlock的大
 			if block.Height > lastBlock.Height {
-				err := txn.Set([]byte("lh"), block.Hash)//修改最后一个区块的hash
+				err := setHead(txn, block)//修改最后一个区块的hash
 				Handle(err)
 				chain.LastHash = block.Hash
+				oldHead, newHead = lastHash, true
 			}
 		} else {//如果数据库找不到最后一个区块，将当前区块设置为最后的区块（这种情况是存在的：某个本地数据库没有键值为1h的区块）
-			err = txn.Set([]byte("lh"), block.Hash)
+			err = setHead(txn, block)
 			chain.LastHash = block.Hash
+			newHead = true
 		}
 
 		return err
@@ -184,6 +281,10 @@ func (chain *Blockchain) AddBlock(block *Block) *Block {
 
 	Handle(err)
 	mutex.Unlock()
+
+	if newHead {
+		chain.publishHead(oldHead, block)
+	}
 	return block
 }
 
@@ -192,12 +293,10 @@ func (chain *Blockchain) GetBlock(blockHash []byte) (Block, error) {
 	var block Block
 	//Read Operations
 	err := chain.Database.View(func(txn *badger.Txn) error {
-		if item, err := txn.Get(blockHash); err != nil {
+		if b, err := readBlock(txn, blockHash); err != nil {
 			return errors.New("Block does not exist")
 		} else {
-			blockData, _ := item.ValueCopy(nil)
-			// 反序列化区块数据
-			block = *DeSerialize(blockData)
+			block = *b
 		}
 		return nil
 	})
@@ -209,43 +308,195 @@ func (chain *Blockchain) GetBlock(blockHash []byte) (Block, error) {
 	return block, nil
 }
 
-// GetBlockHashes 总计得到区块链中的所有区块哈希数组
+// GetHeader 根据哈希值得到区块头（无需读取区块体）
+func (chain *Blockchain) GetHeader(blockHash []byte) (*BlockHeader, error) {
+	var header *BlockHeader
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		var err error
+		header, err = readHeader(txn, blockHash)
+		return err
+	})
+	if err != nil {
+		return nil, errors.New("Block header does not exist")
+	}
+	return header, nil
+}
+
+// GetBlockHashes 总计得到区块链中高于height的所有区块哈希数组，只读取区块头
 func (chain *Blockchain) GetBlockHashes(height int) [][]byte {
 	var blocks [][]byte//[]byte为单个block的哈希值
 
-	iter := chain.Iterator()
-	if iter == nil {
-		return blocks
-	}
-	for {
-		block := iter.Next()
-		prevHash := block.PrevHash
-		if block.Height == height {
-			break
+	hash := chain.LastHash
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		for len(hash) > 0 {
+			header, err := readHeader(txn, hash)
+			if err != nil {
+				return err
+			}
+			if header.Height == height {
+				break
+			}
+			blocks = append([][]byte{hash}, blocks...)//[][]byte{hash}为只有一个元素的切片，append要求两个连接的切片类型必须相同
+			hash = header.PrevHash
 		}
-		blocks = append([][]byte{block.Hash}, blocks...)//[][]byte{block.Hash}为只有一个元素的切片，append要求两个连接的切片类型必须相同
+		return nil
+	})
+	Handle(err)
 
-		if prevHash == nil {
-			break
+	return blocks
+}
+
+// GetBlockHashesAfter 按主链的高度索引得到高于height的区块哈希（按高度从低到高），最多max个
+// 与GetBlockHashes不同，它不从链尾遍历区块头，读取的数量只与max有关
+func (chain *Blockchain) GetBlockHashesAfter(height int, max int) [][]byte {
+	var hashes [][]byte
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		for h := height + 1; len(hashes) < max; h++ {
+			item, err := txn.Get(heightKey(h))
+			if err == badger.ErrKeyNotFound {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			hash, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			hashes = append(hashes, hash)
+		}
+		return nil
+	})
+	Handle(err)
+
+	return hashes
+}
+
+// mainChainHashes 从创始区块到LastHash的主链区块哈希（按高度从低到高排列），只读取区块头
+func (chain *Blockchain) mainChainHashes(txn *badger.Txn) ([][]byte, error) {
+	var hashes [][]byte
+
+	hash := chain.LastHash
+	for len(hash) > 0 {
+		header, err := readHeader(txn, hash)
+		if err != nil {
+			return nil, err
 		}
+		hashes = append(hashes, hash)
+		hash = header.PrevHash
+	}
+	for i, j := 0, len(hashes)-1; i < j; i, j = i+1, j-1 {
+		hashes[i], hashes[j] = hashes[j], hashes[i]
 	}
 
-	return blocks
+	return hashes, nil
+}
+
+// BlockLocator 构建区块定位器：从链尾开始向前的区块哈希，最近的10个区块逐个加入，之后步长加倍，最后总是包含创始区块
+// 对方根据定位器找到双方主链上最近的共同区块，从它之后开始发送区块头
+func (chain *Blockchain) BlockLocator() [][]byte {
+	var locator [][]byte
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		hashes, err := chain.mainChainHashes(txn)
+		if err != nil {
+			return err
+		}
+		step := 1
+		for i := len(hashes) - 1; i > 0; i -= step {
+			locator = append(locator, hashes[i])
+			if len(locator) >= 10 {
+				step *= 2
+			}
+		}
+		if len(hashes) > 0 {
+			locator = append(locator, hashes[0])
+		}
+		return nil
+	})
+	Handle(err)
+
+	return locator
+}
+
+// GetHeadersAfter 根据区块定位器找到主链上最近的共同区块，返回它之后最多max个区块头
+// 定位器中没有主链上的区块时，从创始区块开始返回
+func (chain *Blockchain) GetHeadersAfter(locator [][]byte, max int) []*BlockHeader {
+	var headers []*BlockHeader
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		hashes, err := chain.mainChainHashes(txn)
+		if err != nil {
+			return err
+		}
+		index := make(map[string]int, len(hashes))
+		for i, hash := range hashes {
+			index[hex.EncodeToString(hash)] = i
+		}
+
+		start := 0
+		for _, hash := range locator {
+			if i, ok := index[hex.EncodeToString(hash)]; ok {
+				start = i + 1
+				break
+			}
+		}
+		for i := start; i < len(hashes) && len(headers) < max; i++ {
+			header, err := readHeader(txn, hashes[i])
+			if err != nil {
+				return err
+			}
+			headers = append(headers, header)
+		}
+		return nil
+	})
+	Handle(err)
+
+	return headers
+}
+
+// GenesisHash 得到创始区块的哈希，用于节点握手时确认双方是同一条链
+func (chain *Blockchain) GenesisHash() []byte {
+	var genesis []byte
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		hash := chain.LastHash
+		for len(hash) > 0 {
+			header, err := readHeader(txn, hash)
+			if err != nil {
+				return err
+			}
+			genesis = hash
+			hash = header.PrevHash
+		}
+		return nil
+	})
+	Handle(err)
+
+	return genesis
+}
+
+// HasBlock 本地数据库中是否已经存在该区块（区块头和区块体）
+func (chain *Blockchain) HasBlock(blockHash []byte) bool {
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(bodyKey(blockHash))
+		return err
+	})
+	return err == nil
 }
 
 // GetBestHeight 得到最佳height基本上是获取最后区块的height（index）
 func (chain *Blockchain) GetBestHeight() int {
-	var lastBlock Block
+	var lastBlock *BlockHeader
 
 	err := chain.Database.View(func(txn *badger.Txn) error {
 		item, err := txn.Get([]byte("lh"))
 		if err == nil {
 			lastHash, _ := item.ValueCopy(nil)
 
-			item, err = txn.Get(lastHash)
+			lastBlock, err = readHeader(txn, lastHash)
 			Handle(err)
-			lastBlockData, _ := item.ValueCopy(nil)
-			lastBlock = *DeSerialize(lastBlockData)
 		}
 
 		return err
@@ -263,6 +514,9 @@ func (chain *Blockchain) MineBlock(transactions []*Transaction) *Block {
 	var lastHash []byte
 	var lastHeight int
 
+	if err := CheckBlockSize(transactions); err != nil {
+		log.Panic(err)
+	}
 	for _, tx := range transactions {
 		if chain.VerifyTransaction(tx) != true {
 			log.Panic("Invalid Transaction")
@@ -274,12 +528,10 @@ func (chain *Blockchain) MineBlock(transactions []*Transaction) *Block {
 		item, err := txn.Get([]byte("lh"))
 		Handle(err)
 		lastHash, err = item.ValueCopy(nil)
-
-		item, err = txn.Get(lastHash)
 		Handle(err)
-		lastBlockData, _ := item.ValueCopy(nil)
 
-		lastBlock := DeSerialize(lastBlockData)
+		lastBlock, err := readHeader(txn, lastHash)
+		Handle(err)
 
 		lastHeight = lastBlock.Height
 		return err
@@ -290,27 +542,26 @@ func (chain *Blockchain) MineBlock(transactions []*Transaction) *Block {
 	block := CreateBlock(transactions, lastHash, lastHeight+1)//区块高度+1
 	// 读-写操作
 	err = chain.Database.Update(func(txn *badger.Txn) error {
-		err := txn.Set(block.Hash, block.Serialize())
+		err := writeBlock(txn, block)
 		Handle(err)
-		err = txn.Set([]byte("lh"), block.Hash)
+		err = setHead(txn, block)
 
-		chain.LastHash = lastHash
+		chain.LastHash = block.Hash
 
 		return err
 	})
 
 	Handle(err)
+	chain.publishHead(lastHash, block)
 	return block
 }
 
-// DeserializeTransaction 反序列化交易对象
+// DeserializeTransaction 反序列化交易对象，数据格式错误时panic
+// 来自网络等不可信来源的数据请使用DecodeTransaction
 func DeserializeTransaction(data []byte) Transaction {
-	var transaction Transaction
-
-	dec := gob.NewDecoder(bytes.NewReader(data))
-	err := dec.Decode(&transaction)
+	transaction, err := DecodeTransaction(data)
 	Handle(err)
-	return transaction
+	return *transaction
 }
 
 // 来自区块链的总计所有未花费交易输出
@@ -376,6 +627,29 @@ func (chain *Blockchain) FindTransaction(ID []byte) (Transaction, error) {
 
 	return Transaction{}, errors.New("不存在ID的交易")
 }
+// FindTransactionBlock 根据交易ID查找包含该交易的区块
+func (chain *Blockchain) FindTransactionBlock(ID []byte) (*Block, error) {
+	iter := chain.Iterator()
+	if iter == nil {
+		return nil, errors.New("不存在ID的交易")
+	}
+
+	for {
+		block := iter.Next()
+
+		for _, tx := range block.Transactions {
+			if bytes.Equal(tx.ID, ID) {
+				return block, nil
+			}
+		}
+		if len(block.PrevHash) == 0 {
+			break
+		}
+	}
+
+	return nil, errors.New("不存在ID的交易")
+}
+
 // GetTransaction 得到交易的map格式
 func (chain *Blockchain) GetTransaction(transaction *Transaction) map[string]Transaction {
 	txs := make(map[string]Transaction)
@@ -400,13 +674,91 @@ func (chain *Blockchain) SignTransaction(privKey ecdsa.PrivateKey, tx *Transacti
 
 // VerifyTransaction 验证交易
 func (chain *Blockchain) VerifyTransaction(tx *Transaction) bool {
+	if err := tx.CheckSanity(); err != nil {
+		log.Warnf("交易 %x 不满足共识规则: %s", tx.ID, err)
+		return false
+	}
 	if tx.IsMinerTx() {
 		return true
 	}
-	prevTxs := chain.GetTransaction(tx)
+	//交易可能来自其它节点，引用的交易不存在时交易不合法，不能像GetTransaction那样终止程序
+	prevTxs := make(map[string]Transaction)
+	for _, in := range tx.Inputs {
+		prevTx, err := chain.FindTransaction(in.ID)
+		if err != nil {
+			log.Warnf("交易 %x 引用的交易 %x 不存在", tx.ID, in.ID)
+			return false
+		}
+		prevTxs[hex.EncodeToString(prevTx.ID)] = prevTx
+	}
 
 	return tx.Verify(prevTxs)
 }
+
+// VerifyBlockTransactions 检查区块中每一笔交易引用的输出，引用的交易可以在区块的祖先区块中，也可以在同一个区块中排在它之前
+// 祖先区块沿区块自己的PrevHash回溯，而不是从主链的最新区块开始，因此侧链上的区块同样可以验证：
+// 区块在写入区块链（以及可能的重组）之前都必须通过这一检查
+func (chain *Blockchain) VerifyBlockTransactions(block *Block) error {
+	//先收集引用区块之外的交易，沿祖先区块回溯一次全部找到
+	wanted := make(map[string]bool)
+	seen := make(map[string]bool)
+	for _, tx := range block.Transactions {
+		if !tx.IsMinerTx() {
+			for _, in := range tx.Inputs {
+				if key := hex.EncodeToString(in.ID); !seen[key] {
+					wanted[key] = true
+				}
+			}
+		}
+		seen[hex.EncodeToString(tx.ID)] = true
+	}
+	ancestors := chain.findAncestorTransactions(block.PrevHash, wanted)
+
+	inBlock := make(map[string]Transaction)
+	for _, tx := range block.Transactions {
+		if !tx.IsMinerTx() {
+			prevTxs := make(map[string]Transaction)
+			for _, in := range tx.Inputs {
+				key := hex.EncodeToString(in.ID)
+				prevTx, ok := inBlock[key]
+				if !ok {
+					prevTx, ok = ancestors[key]
+				}
+				if !ok {
+					return fmt.Errorf("交易 %x 引用的交易 %x: %w", tx.ID, in.ID, ErrInvalidTxInputs)
+				}
+				prevTxs[key] = prevTx
+			}
+			if !tx.Verify(prevTxs) {
+				return fmt.Errorf("交易 %x: %w", tx.ID, ErrInvalidTxInputs)
+			}
+		}
+		inBlock[hex.EncodeToString(tx.ID)] = *tx
+	}
+	return nil
+}
+
+// findAncestorTransactions 从hash对应的区块开始向前回溯，找到wanted中的交易（交易ID的hex -> 交易）
+func (chain *Blockchain) findAncestorTransactions(hash []byte, wanted map[string]bool) map[string]Transaction {
+	found := make(map[string]Transaction)
+	if len(wanted) == 0 || len(hash) == 0 {
+		return found
+	}
+
+	iter := &BlockchainIterator{hash, chain.Database}
+	for {
+		block := iter.Next()
+		for _, tx := range block.Transactions {
+			if key := hex.EncodeToString(tx.ID); wanted[key] {
+				found[key] = *tx
+			}
+		}
+		if len(found) == len(wanted) || len(block.PrevHash) == 0 {
+			return found
+		}
+	}
+}
+
 // retry 删除lock为尾缀的数据库文件，并再次打开数据库
 func retry(dir string, originalOpts badger.Options) (*badger.DB, error) {
 	lockPath := filepath.Join(dir, "LOCK")
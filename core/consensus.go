@@ -0,0 +1,139 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// 共识规则中的大小限制
+// 所有节点在验证区块、交易以及矿工组装区块时都必须遵守，防止恶意节点用超大的区块或交易耗尽内存
+const (
+	MaxBlockSize = 1 << 20    //区块序列化后的最大字节数（1MB）
+	MaxBlockTxs  = 10000      //区块中交易数量的上限（包含挖矿交易）
+	MaxTxSize    = 100 * 1024 //交易序列化后的最大字节数（100KB）
+	MaxTxInputs  = 1000       //交易输入数量的上限
+	MaxTxOutputs = 1000       //交易输出数量的上限
+
+	MinerReward = 20.0 //挖矿交易的固定奖励，每个区块的第一笔交易（且只有这一笔）是挖矿交易
+)
+
+var (
+	ErrBlockTooLarge   = errors.New("区块大小超出上限")
+	ErrTooManyTxs      = errors.New("区块中的交易数量超出上限")
+	ErrNoTransactions  = errors.New("区块中没有交易")
+	ErrTxTooLarge      = errors.New("交易大小超出上限")
+	ErrTooManyInputs   = errors.New("交易输入数量超出上限")
+	ErrTooManyOutputs  = errors.New("交易输出数量超出上限")
+	ErrNoInputs        = errors.New("交易没有输入")
+	ErrNoOutputs       = errors.New("交易没有输出")
+	ErrNegativeOutput  = errors.New("交易输出的币数不能为负数")
+	ErrInvalidOutput   = errors.New("交易输出的币数必须是有限的数值")
+	ErrInvalidTxInputs = errors.New("交易引用的输出不存在或者不属于签名者")
+	ErrTxIDMismatch    = errors.New("交易ID与交易内容的哈希不一致")
+	ErrBadMinerTx      = errors.New("区块的第一笔交易必须是唯一的挖矿交易")
+	ErrBadMinerReward  = errors.New("挖矿交易的奖励不正确")
+	ErrDuplicateTx     = errors.New("区块中有重复的交易")
+)
+
+// CheckSanity 检查交易是否满足共识规则中的大小和数量限制
+// 这里只做与链上状态无关的检查，签名和输入引用的验证由VerifyTransaction完成
+func (tx *Transaction) CheckSanity() error {
+	if len(tx.Inputs) == 0 {
+		return ErrNoInputs
+	}
+	if len(tx.Outputs) == 0 {
+		return ErrNoOutputs
+	}
+	if len(tx.Inputs) > MaxTxInputs {
+		return ErrTooManyInputs
+	}
+	if len(tx.Outputs) > MaxTxOutputs {
+		return ErrTooManyOutputs
+	}
+	for _, out := range tx.Outputs {
+		//NaN和±Inf会破坏余额的求和以及UTXO的计算
+		if math.IsNaN(out.Value) || math.IsInf(out.Value, 0) {
+			return ErrInvalidOutput
+		}
+		if out.Value < 0 {
+			return ErrNegativeOutput
+		}
+	}
+	if len(tx.Serializer()) > MaxTxSize {
+		return ErrTxTooLarge
+	}
+	//区块的MerkleRoot只承诺交易ID，交易ID必须由交易内容得到，否则转发者可以修改交易（如挖矿交易的输出）而不改变区块哈希
+	if !bytes.Equal(tx.ID, tx.Hash()) {
+		return ErrTxIDMismatch
+	}
+
+	return nil
+}
+
+// CheckSanity 检查区块是否满足共识规则中的大小和数量限制，以及区块中每一笔交易的限制
+func (b *Block) CheckSanity() error {
+	if len(b.Transactions) == 0 {
+		return ErrNoTransactions
+	}
+	if len(b.Transactions) > MaxBlockTxs {
+		return ErrTooManyTxs
+	}
+	//重复的交易会让不同的交易列表得到相同的MerkleRoot（奇数层复制最后一个节点）
+	seen := make(map[string]bool, len(b.Transactions))
+	for _, tx := range b.Transactions {
+		if err := tx.CheckSanity(); err != nil {
+			return fmt.Errorf("交易 %x: %w", tx.ID, err)
+		}
+		if seen[string(tx.ID)] {
+			return fmt.Errorf("交易 %x: %w", tx.ID, ErrDuplicateTx)
+		}
+		seen[string(tx.ID)] = true
+	}
+	if err := checkMinerTx(b.Transactions); err != nil {
+		return err
+	}
+	if len(b.Serialize()) > MaxBlockSize {
+		return ErrBlockTooLarge
+	}
+
+	return nil
+}
+
+// CheckBlockSize 组装区块前检查交易集合是否超出区块的数量和大小限制
+func CheckBlockSize(txs []*Transaction) error {
+	if len(txs) > MaxBlockTxs {
+		return ErrTooManyTxs
+	}
+	size := 0
+	for _, tx := range txs {
+		size += len(tx.Serializer())
+	}
+	if size > MaxBlockSize {
+		return ErrBlockTooLarge
+	}
+
+	return nil
+}
+
+// checkMinerTx 检查区块中只有第一笔交易是挖矿交易，并且奖励为固定的MinerReward
+func checkMinerTx(txs []*Transaction) error {
+	if !txs[0].IsMinerTx() {
+		return ErrBadMinerTx
+	}
+	for _, tx := range txs[1:] {
+		if tx.IsMinerTx() {
+			return fmt.Errorf("交易 %x: %w", tx.ID, ErrBadMinerTx)
+		}
+	}
+
+	reward := 0.0
+	for _, out := range txs[0].Outputs {
+		reward += out.Value
+	}
+	if reward != MinerReward {
+		return fmt.Errorf("%w: %v", ErrBadMinerReward, reward)
+	}
+	return nil
+}
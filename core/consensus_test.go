@@ -0,0 +1,106 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+)
+
+var testTxCount int
+
+// testTx 构建ID正确、互不相同的交易，miner为真时构建挖矿交易
+func testTx(miner bool, values ...float64) *Transaction {
+	testTxCount++
+	in := TxInput{[]byte(fmt.Sprintf("prev-%d", testTxCount)), 0, []byte("sig"), []byte("pub")}
+	if miner {
+		in = TxInput{[]byte{}, -1, nil, []byte(fmt.Sprintf("data-%d", testTxCount))}
+	}
+	tx := &Transaction{Inputs: []TxInput{in}}
+	for _, v := range values {
+		tx.Outputs = append(tx.Outputs, TxOutput{v, []byte("pubkeyhash")})
+	}
+	tx.ID = tx.Hash()
+	return tx
+}
+
+func TestTransactionID(t *testing.T) {
+	tx := testTx(false, 5)
+	//签名不参与交易ID的计算
+	tx.Inputs[0].Signature = []byte("other")
+	if err := tx.CheckSanity(); err != nil {
+		t.Fatalf("修改签名后: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(tx *Transaction)
+	}{
+		{"修改输出的币数", func(tx *Transaction) { tx.Outputs[0].Value = 50 }},
+		{"修改输出的接收者", func(tx *Transaction) { tx.Outputs[0].PubKeyHash = []byte("attacker") }},
+		{"修改输入", func(tx *Transaction) { tx.Inputs[0].Out = 1 }},
+		{"增加输出", func(tx *Transaction) { tx.Outputs = append(tx.Outputs, TxOutput{1, []byte("x")}) }},
+		{"ID为空", func(tx *Transaction) { tx.ID = nil }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx := testTx(true, MinerReward)
+			tt.modify(tx)
+			if err := tx.CheckSanity(); !errors.Is(err, ErrTxIDMismatch) {
+				t.Errorf("得到 %v, 期望 %v", err, ErrTxIDMismatch)
+			}
+		})
+	}
+}
+
+func TestBlockSanity(t *testing.T) {
+	dup := testTx(false, 1)
+	tests := []struct {
+		name string
+		txs  []*Transaction
+		want error
+	}{
+		{"只有挖矿交易", []*Transaction{testTx(true, MinerReward)}, nil},
+		{"挖矿交易在最前面", []*Transaction{testTx(true, MinerReward), testTx(false, 1)}, nil},
+		{"奖励分为多个输出", []*Transaction{testTx(true, 15, 5)}, nil},
+		{"没有挖矿交易", []*Transaction{testTx(false, 1)}, ErrBadMinerTx},
+		{"挖矿交易不在最前面", []*Transaction{testTx(false, 1), testTx(true, MinerReward)}, ErrBadMinerTx},
+		{"两笔挖矿交易", []*Transaction{testTx(true, MinerReward), testTx(true, MinerReward)}, ErrBadMinerTx},
+		{"重复的交易", append([]*Transaction{testTx(true, MinerReward)}, dup, dup), ErrDuplicateTx},
+		{"奖励过高", []*Transaction{testTx(true, 1000)}, ErrBadMinerReward},
+		{"奖励过低", []*Transaction{testTx(true, 1)}, ErrBadMinerReward},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			block := NewBlock(&BlockHeader{Version: BlockVersion, Bits: Difficulty}, tt.txs)
+			if err := block.CheckSanity(); !errors.Is(err, tt.want) {
+				t.Errorf("得到 %v, 期望 %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestTransactionOutputValue(t *testing.T) {
+	tests := []struct {
+		name  string
+		value float64
+		want  error
+	}{
+		{"正数", 1.5, nil},
+		{"零", 0, nil},
+		{"负数", -1, ErrNegativeOutput},
+		{"NaN", math.NaN(), ErrInvalidOutput},
+		{"正无穷", math.Inf(1), ErrInvalidOutput},
+		{"负无穷", math.Inf(-1), ErrInvalidOutput},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx := testTx(false, 1, tt.value)
+			if err := tx.CheckSanity(); !errors.Is(err, tt.want) {
+				t.Errorf("得到 %v, 期望 %v", err, tt.want)
+			}
+		})
+	}
+}
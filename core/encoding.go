@@ -0,0 +1,401 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// 区块和交易的二进制编码（线格式）
+//
+// 交易ID、签名、数据库存储以及网络传输均使用这里定义的编码，而不是encoding/gob。
+// 编码是确定性的：相同的数据总是得到相同的字节序列，因此其它语言的客户端也可以构建和验证交易。
+//
+// 基本类型：
+//   uint8/uint32/int32/int64  定长，大端字节序
+//   float64                   IEEE 754 二进制表示，按uint64大端写入
+//   bytes                     uint32长度前缀 + 内容，长度为0表示空（解码为nil）
+//   string                    与bytes相同，内容为UTF-8字节
+//
+// 交易（Transaction）：
+//   version  uint8    编码版本，当前为 EncodingVersion
+//   id       bytes
+//   inputs   uint32个数，随后每个输入依次为：id bytes, out int32, signature bytes, pubKey bytes
+//   outputs  uint32个数，随后每个输出依次为：value float64, pubKeyHash bytes
+//
+// 区块头（BlockHeader），区块哈希即区块头编码的sha256哈希：
+//   version  uint8
+//   blockVersion int32, prevHash bytes, merkleRoot bytes, timestamp int64,
+//   bits int32, nonce int64, height int64
+//
+// 区块体（区块中的交易，与区块头分开存储）：
+//   version  uint8
+//   txs      uint32个数，随后每笔交易为 bytes（内容为上面定义的交易编码）
+//
+// 区块（Block，网络传输使用）：
+//   version  uint8
+//   header   bytes（内容为区块头编码）
+//   txs      与区块体中的txs相同
+//
+// 输出集合（TxOutputs，UTXO集的存储格式）：
+//   version  uint8
+//   outputs  uint32个数，随后每个输出与交易中的输出编码相同
+//
+// p2p网络消息（命令之后的payload）同样以version开头，字段顺序见p2p/wire.go
+
+// EncodingVersion 当前的编码版本
+const EncodingVersion = 1
+
+var (
+	ErrUnsupportedEncoding = errors.New("不支持的编码版本")
+	ErrMalformedData       = errors.New("编码数据格式错误")
+)
+
+// Encoder 按线格式写入基本类型，p2p网络消息的外层结构也使用它编码
+type Encoder struct {
+	buf bytes.Buffer
+}
+
+func (e *Encoder) WriteUint8(v uint8) {
+	e.buf.WriteByte(v)
+}
+
+func (e *Encoder) WriteUint32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	e.buf.Write(b[:])
+}
+
+func (e *Encoder) WriteInt32(v int32) {
+	e.WriteUint32(uint32(v))
+}
+
+func (e *Encoder) WriteInt64(v int64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(v))
+	e.buf.Write(b[:])
+}
+
+func (e *Encoder) WriteFloat64(v float64) {
+	e.WriteInt64(int64(math.Float64bits(v)))
+}
+
+func (e *Encoder) WriteBytes(v []byte) {
+	e.WriteUint32(uint32(len(v)))
+	e.buf.Write(v)
+}
+
+// WriteString 按字节串写入字符串
+func (e *Encoder) WriteString(v string) {
+	e.WriteBytes([]byte(v))
+}
+
+func (e *Encoder) Bytes() []byte {
+	return e.buf.Bytes()
+}
+
+// Decoder 按线格式读取基本类型
+// 出现错误后，后续的读取都返回零值，调用者只需在最后检查一次err
+type Decoder struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func NewDecoder(data []byte) *Decoder {
+	return &Decoder{data: data}
+}
+
+func (d *Decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || len(d.data)-d.pos < n {
+		d.err = ErrMalformedData
+		return nil
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b
+}
+
+func (d *Decoder) ReadUint8() uint8 {
+	b := d.next(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (d *Decoder) ReadUint32() uint32 {
+	b := d.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (d *Decoder) ReadInt32() int32 {
+	return int32(d.ReadUint32())
+}
+
+func (d *Decoder) ReadInt64() int64 {
+	b := d.next(8)
+	if b == nil {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(b))
+}
+
+func (d *Decoder) ReadFloat64() float64 {
+	return math.Float64frombits(uint64(d.ReadInt64()))
+}
+
+func (d *Decoder) ReadBytes() []byte {
+	n := d.ReadUint32()
+	if d.err != nil || n == 0 {
+		return nil
+	}
+	b := d.next(int(n))
+	if b == nil {
+		return nil
+	}
+	return append([]byte(nil), b...)
+}
+
+// ReadString 读取按字节串写入的字符串
+func (d *Decoder) ReadString() string {
+	return string(d.ReadBytes())
+}
+
+// ReadCount 读取元素个数，个数不能超过剩余字节数除以每个元素的最小长度，防止恶意数据导致超大内存分配
+func (d *Decoder) ReadCount(minSize int) int {
+	n := int(d.ReadUint32())
+	if d.err == nil && n > (len(d.data)-d.pos)/minSize {
+		d.err = ErrMalformedData
+		return 0
+	}
+	return n
+}
+
+// ReadVersion 读取编码版本号，不是当前版本时记录错误
+func (d *Decoder) ReadVersion() {
+	if v := d.ReadUint8(); d.err == nil && v != EncodingVersion {
+		d.err = fmt.Errorf("%w: %d", ErrUnsupportedEncoding, v)
+	}
+}
+
+// Finish 检查是否已经读取完全部数据
+func (d *Decoder) Finish() error {
+	if d.err == nil && d.pos != len(d.data) {
+		d.err = ErrMalformedData
+	}
+	return d.err
+}
+
+func (e *Encoder) writeOutput(out TxOutput) {
+	e.WriteFloat64(out.Value)
+	e.WriteBytes(out.PubKeyHash)
+}
+
+func (d *Decoder) readOutput() TxOutput {
+	return TxOutput{
+		Value:      d.ReadFloat64(),
+		PubKeyHash: d.ReadBytes(),
+	}
+}
+
+// EncodeTransaction 按线格式编码交易
+func EncodeTransaction(tx *Transaction) []byte {
+	e := &Encoder{}
+	e.WriteUint8(EncodingVersion)
+	e.WriteBytes(tx.ID)
+
+	e.WriteUint32(uint32(len(tx.Inputs)))
+	for _, in := range tx.Inputs {
+		e.WriteBytes(in.ID)
+		e.WriteInt32(int32(in.Out))
+		e.WriteBytes(in.Signature)
+		e.WriteBytes(in.PubKey)
+	}
+
+	e.WriteUint32(uint32(len(tx.Outputs)))
+	for _, out := range tx.Outputs {
+		e.writeOutput(out)
+	}
+
+	return e.Bytes()
+}
+
+// DecodeTransaction 按线格式解码交易
+func DecodeTransaction(data []byte) (*Transaction, error) {
+	d := NewDecoder(data)
+	tx := d.readTransaction()
+	if err := d.Finish(); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+func (d *Decoder) readTransaction() *Transaction {
+	tx := &Transaction{}
+	d.ReadVersion()
+	tx.ID = d.ReadBytes()
+
+	//输入至少包含三个长度前缀和out，共16个字节
+	inputs := d.ReadCount(16)
+	for i := 0; i < inputs && d.err == nil; i++ {
+		tx.Inputs = append(tx.Inputs, TxInput{
+			ID:        d.ReadBytes(),
+			Out:       int(d.ReadInt32()),
+			Signature: d.ReadBytes(),
+			PubKey:    d.ReadBytes(),
+		})
+	}
+
+	//输出至少包含value和一个长度前缀，共12个字节
+	outputs := d.ReadCount(12)
+	for i := 0; i < outputs && d.err == nil; i++ {
+		tx.Outputs = append(tx.Outputs, d.readOutput())
+	}
+
+	return tx
+}
+
+// EncodeHeader 按线格式编码区块头
+func EncodeHeader(h *BlockHeader) []byte {
+	e := &Encoder{}
+	e.WriteUint8(EncodingVersion)
+	e.WriteInt32(h.Version)
+	e.WriteBytes(h.PrevHash)
+	e.WriteBytes(h.MerkleRoot)
+	e.WriteInt64(h.Timestamp)
+	e.WriteInt32(int32(h.Bits))
+	e.WriteInt64(int64(h.Nonce))
+	e.WriteInt64(int64(h.Height))
+
+	return e.Bytes()
+}
+
+// DecodeHeader 按线格式解码区块头
+func DecodeHeader(data []byte) (*BlockHeader, error) {
+	d := NewDecoder(data)
+	h := d.readHeader()
+	if err := d.Finish(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (d *Decoder) readHeader() *BlockHeader {
+	h := &BlockHeader{}
+	d.ReadVersion()
+	h.Version = d.ReadInt32()
+	h.PrevHash = d.ReadBytes()
+	h.MerkleRoot = d.ReadBytes()
+	h.Timestamp = d.ReadInt64()
+	h.Bits = int(d.ReadInt32())
+	h.Nonce = int(d.ReadInt64())
+	h.Height = int(d.ReadInt64())
+
+	return h
+}
+
+func (e *Encoder) writeTransactions(txs []*Transaction) {
+	e.WriteUint32(uint32(len(txs)))
+	for _, tx := range txs {
+		e.WriteBytes(EncodeTransaction(tx))
+	}
+}
+
+func (d *Decoder) readTransactions() []*Transaction {
+	var txs []*Transaction
+
+	count := d.ReadCount(4)
+	for i := 0; i < count && d.err == nil; i++ {
+		txData := d.ReadBytes()
+		if d.err != nil {
+			break
+		}
+		tx, err := DecodeTransaction(txData)
+		if err != nil {
+			d.err = err
+			break
+		}
+		txs = append(txs, tx)
+	}
+
+	return txs
+}
+
+// EncodeBody 按线格式编码区块体
+func EncodeBody(txs []*Transaction) []byte {
+	e := &Encoder{}
+	e.WriteUint8(EncodingVersion)
+	e.writeTransactions(txs)
+
+	return e.Bytes()
+}
+
+// DecodeBody 按线格式解码区块体
+func DecodeBody(data []byte) ([]*Transaction, error) {
+	d := NewDecoder(data)
+	d.ReadVersion()
+	txs := d.readTransactions()
+	if err := d.Finish(); err != nil {
+		return nil, err
+	}
+	return txs, nil
+}
+
+// EncodeBlock 按线格式编码区块
+func EncodeBlock(b *Block) []byte {
+	e := &Encoder{}
+	e.WriteUint8(EncodingVersion)
+	e.WriteBytes(EncodeHeader(&b.BlockHeader))
+	e.writeTransactions(b.Transactions)
+
+	return e.Bytes()
+}
+
+// DecodeBlock 按线格式解码区块，区块哈希由区块头重新计算
+func DecodeBlock(data []byte) (*Block, error) {
+	d := NewDecoder(data)
+	d.ReadVersion()
+	headerData := d.ReadBytes()
+	txs := d.readTransactions()
+	if err := d.Finish(); err != nil {
+		return nil, err
+	}
+
+	header, err := DecodeHeader(headerData)
+	if err != nil {
+		return nil, err
+	}
+	return NewBlock(header, txs), nil
+}
+
+// EncodeOutputs 按线格式编码输出集合
+func EncodeOutputs(outputs *TxOutputs) []byte {
+	e := &Encoder{}
+	e.WriteUint8(EncodingVersion)
+	e.WriteUint32(uint32(len(outputs.Outputs)))
+	for _, out := range outputs.Outputs {
+		e.writeOutput(out)
+	}
+	return e.Bytes()
+}
+
+// DecodeOutputs 按线格式解码输出集合
+func DecodeOutputs(data []byte) (TxOutputs, error) {
+	var outputs TxOutputs
+	d := NewDecoder(data)
+	d.ReadVersion()
+	count := d.ReadCount(12)
+	for i := 0; i < count && d.err == nil; i++ {
+		outputs.Outputs = append(outputs.Outputs, d.readOutput())
+	}
+	return outputs, d.Finish()
+}
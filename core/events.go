@@ -0,0 +1,89 @@
+package blockchain
+
+import (
+	"bytes"
+
+	badger "github.com/dgraph-io/badger"
+	log "github.com/sirupsen/logrus"
+
+	"linechain/util/event"
+)
+
+// 区块链事件：主链有新的最新区块时发布ChainHeadEvent，最新区块切换到另一条分支时先发布ChainReorgEvent，
+// 再按高度顺序为新分支上的每个区块发布ChainHeadEvent
+
+// ChainHeadEvent 区块成为主链的最新区块
+type ChainHeadEvent struct {
+	Block *Block
+}
+
+// ChainReorgEvent 主链重组：Removed为离开主链的区块（从旧的最新区块开始），Added为加入主链的区块（按高度从低到高）
+type ChainReorgEvent struct {
+	OldHead    []byte
+	NewHead    []byte
+	ForkHeight int //分叉点（两条分支共同的区块）的高度
+	Removed    []*BlockHeader
+	Added      []*Block
+}
+
+// chainFeed 区块链事件源；同一个数据库的Blockchain实例（ContinueBlockchain）共用
+var chainFeed event.Feed
+
+// SubscribeChainEvents 订阅区块链事件（ChainHeadEvent和ChainReorgEvent）
+func SubscribeChainEvents(buffer int) *event.Subscription {
+	return chainFeed.Subscribe(buffer)
+}
+
+// publishHead 发布最新区块变化的事件，oldHead为之前的最新区块哈希
+func (chain *Blockchain) publishHead(oldHead []byte, block *Block) {
+	if len(oldHead) == 0 || bytes.Equal(block.PrevHash, oldHead) {
+		chainFeed.Send(ChainHeadEvent{Block: block})
+		return
+	}
+
+	reorg, err := chain.reorgBetween(oldHead, block.Hash)
+	if err != nil {
+		log.Errorf("计算主链重组失败: %s", err)
+		chainFeed.Send(ChainHeadEvent{Block: block})
+		return
+	}
+	log.Warnf("主链重组: 分叉高度 %d，移除 %d 个区块，加入 %d 个区块", reorg.ForkHeight, len(reorg.Removed), len(reorg.Added))
+	chainFeed.Send(*reorg)
+	for _, added := range reorg.Added {
+		chainFeed.Send(ChainHeadEvent{Block: added})
+	}
+}
+
+// reorgBetween 从两个最新区块分别沿PrevHash回溯到共同的区块
+func (chain *Blockchain) reorgBetween(oldHead, newHead []byte) (*ChainReorgEvent, error) {
+	reorg := &ChainReorgEvent{OldHead: oldHead, NewHead: newHead}
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		oldHeader, err := readHeader(txn, oldHead)
+		if err != nil {
+			return err
+		}
+		newBlock, err := readBlock(txn, newHead)
+		if err != nil {
+			return err
+		}
+		oldHash, newHash := oldHead, newHead
+		for !bytes.Equal(oldHash, newHash) {
+			if oldHeader.Height >= newBlock.Height {
+				reorg.Removed = append(reorg.Removed, oldHeader)
+				oldHash = oldHeader.PrevHash
+				if oldHeader, err = readHeader(txn, oldHash); err != nil {
+					return err
+				}
+			} else {
+				reorg.Added = append([]*Block{newBlock}, reorg.Added...)
+				newHash = newBlock.PrevHash
+				if newBlock, err = readBlock(txn, newHash); err != nil {
+					return err
+				}
+			}
+		}
+		reorg.ForkHeight = oldHeader.Height
+		return nil
+	})
+	return reorg, err
+}
@@ -0,0 +1,65 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+)
+
+// BlockVersion 当前的区块头版本
+const BlockVersion = 1
+
+// BlockHeader 区块头
+// 区块哈希是区块头线格式编码的sha256哈希，POW同样作用于整个区块头，
+// 因此区块头中的任何字段（包括Timestamp、Height和MerkleRoot）都无法在不破坏POW的情况下被修改。
+// 区块头与区块体（交易）分开存储，节点可以只同步和验证区块头
+type BlockHeader struct {
+	Version    int32  `json:"Version"`
+	PrevHash   []byte `json:"PrevHash"`
+	MerkleRoot []byte `json:"MerkleRoot"` //区块中全部交易的Merkle根
+	Timestamp  int64  `json:"Timestamp"`
+	Bits       int    `json:"Bits"` //难度：区块哈希必须小于 2^(256-Bits)
+	Nonce      int    `json:"Nonce"`
+	Height     int    `json:"Height"`
+}
+
+var (
+	ErrBadPrevHash    = errors.New("区块头的PrevHash与前一个区块不一致")
+	ErrBadHeight      = errors.New("区块头的Height不连续")
+	ErrBadBits        = errors.New("区块头的难度不符合共识规则")
+	ErrBadProofOfWork = errors.New("区块头的POW不合法")
+	ErrBadMerkleRoot  = errors.New("区块的MerkleRoot与交易不一致")
+)
+
+// Serialize 按线格式序列化区块头
+func (h *BlockHeader) Serialize() []byte {
+	return EncodeHeader(h)
+}
+
+// Hash 计算区块哈希
+func (h *BlockHeader) Hash() []byte {
+	hash := sha256.Sum256(h.Serialize())
+	return hash[:]
+}
+
+// CheckProofOfWork 检查区块头的难度和POW是否合法（与链上状态无关）
+func (h *BlockHeader) CheckProofOfWork() error {
+	if h.Bits != Difficulty {
+		return ErrBadBits
+	}
+	if !NewHeaderProof(h).Validate() {
+		return ErrBadProofOfWork
+	}
+	return nil
+}
+
+// CheckConnects 检查区块头能否连接在prev之后：PrevHash和Height连续，并且POW合法
+func (h *BlockHeader) CheckConnects(prev *BlockHeader) error {
+	if !bytes.Equal(h.PrevHash, prev.Hash()) {
+		return ErrBadPrevHash
+	}
+	if h.Height != prev.Height+1 {
+		return ErrBadHeight
+	}
+	return h.CheckProofOfWork()
+}
@@ -18,14 +18,11 @@ func (chain *Blockchain) Iterator() *BlockchainIterator {
 
 func (iter *BlockchainIterator) Next() *Block {
 	var block *Block
-	var encodedBlock []byte
 
 	//读操作
 	err := iter.Database.View(func(txn *badger.Txn) error {
-		item, err := txn.Get(iter.CurrentHash)//根据CurrentHash得到当前区块
-		Handle(err)
-		encodedBlock, err = item.ValueCopy(nil)
-		block = DeSerialize(encodedBlock)
+		var err error
+		block, err = readBlock(txn, iter.CurrentHash)//根据CurrentHash得到当前区块
 		return err
 	})
 	Handle(err)
@@ -1,13 +1,17 @@
 package blockchain
 
 import (
+	"bytes"
 	"crypto/sha256"
+	"errors"
 
 	log "github.com/sirupsen/logrus"
 )
 
 type MerkleTree struct {
 	RootNode *MerkleNode
+
+	levels [][][]byte //每一层节点的哈希，levels[0]为叶子层，每层节点数为偶数（奇数时复制最后一个节点）
 }
 
 type MerkleNode struct {
@@ -16,16 +20,44 @@ type MerkleNode struct {
 	Data  []byte
 }
 
+// MerkleProof 交易的Merkle包含证明
+// 由叶子的索引和从叶子到根路径上的兄弟节点哈希组成，只需要区块头中的MerkleRoot即可验证
+type MerkleProof struct {
+	TxID     []byte   `json:"TxID"`
+	Index    int      `json:"Index"`    //叶子（交易）在区块中的索引
+	Siblings [][]byte `json:"Siblings"` //从叶子层到根下一层的兄弟节点哈希
+}
+
+var ErrNotInMerkleTree = errors.New("数据不在Merkle树中")
+
+// 叶子和内部节点的哈希使用不同的前缀，两个子节点哈希拼接成的数据不能冒充叶子
+const (
+	leafPrefix = 0x00
+	nodePrefix = 0x01
+)
+
+// merkleLeafSize 叶子数据（交易ID）的长度
+const merkleLeafSize = sha256.Size
+
+func leafHash(data []byte) []byte {
+	hash := sha256.Sum256(append([]byte{leafPrefix}, data...))
+	return hash[:]
+}
+
+func nodeHash(left, right []byte) []byte {
+	joined := make([]byte, 0, 1+len(left)+len(right))
+	joined = append(append(append(joined, nodePrefix), left...), right...)
+	hash := sha256.Sum256(joined)
+	return hash[:]
+}
+
 func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
 	node := MerkleNode{}
 
 	if left == nil && right == nil {
-		hash := sha256.Sum256(data)
-		node.Data = hash[:]
+		node.Data = leafHash(data)
 	} else {
-		prevHashes := append(left.Data, right.Data...)
-		hash := sha256.Sum256(prevHashes)
-		node.Data = hash[:]
+		node.Data = nodeHash(left.Data, right.Data)
 	}
 
 	node.Left = left
@@ -37,6 +69,7 @@ func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
 func NewMerkleTree(data [][]byte) *MerkleTree {
 
 	var nodes []MerkleNode
+	var levels [][][]byte
 
 	for _, d := range data {
 		node := NewMerkleNode(nil, nil, d)
@@ -54,6 +87,7 @@ func NewMerkleTree(data [][]byte) *MerkleTree {
 			dupNode := nodes[len(nodes)-1]
 			nodes = append(nodes, dupNode)
 		}
+		levels = append(levels, levelHashes(nodes))
 
 		var level []MerkleNode
 		for i := 0; i < len(nodes); i += 2 {
@@ -64,7 +98,75 @@ func NewMerkleTree(data [][]byte) *MerkleTree {
 		nodes = level
 	}
 
-	tree := MerkleTree{&nodes[0]}
+	tree := MerkleTree{&nodes[0], levels}
 
 	return &tree
 }
+
+func levelHashes(nodes []MerkleNode) [][]byte {
+	hashes := make([][]byte, len(nodes))
+	for i, node := range nodes {
+		hashes[i] = node.Data
+	}
+	return hashes
+}
+
+// Proof 生成数据（叶子）的包含证明，data为构建树时提供的原始数据（区块中为交易ID）
+func (tree *MerkleTree) Proof(data []byte) (*MerkleProof, error) {
+	leaf := leafHash(data)
+
+	index := -1
+	if len(tree.levels) == 0 {
+		//只有一个叶子，叶子即为根
+		if bytes.Equal(tree.RootNode.Data, leaf) {
+			index = 0
+		}
+	} else {
+		for i, hash := range tree.levels[0] {
+			if bytes.Equal(hash, leaf) {
+				index = i
+				break
+			}
+		}
+	}
+	if index < 0 {
+		return nil, ErrNotInMerkleTree
+	}
+
+	proof := &MerkleProof{TxID: data, Index: index}
+	for _, level := range tree.levels {
+		proof.Siblings = append(proof.Siblings, level[index^1])
+		index >>= 1
+	}
+
+	return proof, nil
+}
+
+// VerifyMerkleProof 使用区块头中的MerkleRoot验证包含证明
+// 交易ID和兄弟节点都必须是32字节的哈希；叶子与内部节点的哈希前缀不同，内部节点无法冒充交易
+// 奇数层复制最后一个节点带来的歧义（同一个根对应重复最后一笔交易的区块）由区块中不允许重复交易的共识规则排除
+func VerifyMerkleProof(root []byte, proof *MerkleProof) bool {
+	if proof == nil || proof.Index < 0 || len(proof.TxID) != merkleLeafSize {
+		return false
+	}
+	current := leafHash(proof.TxID)
+	index := proof.Index
+
+	for _, sibling := range proof.Siblings {
+		if len(sibling) != sha256.Size {
+			return false
+		}
+		if index%2 == 0 {
+			current = nodeHash(current, sibling)
+		} else {
+			current = nodeHash(sibling, current)
+		}
+		index >>= 1
+	}
+
+	//索引超出证明路径所能表示的范围
+	if index != 0 {
+		return false
+	}
+	return bytes.Equal(current, root)
+}
@@ -0,0 +1,100 @@
+package blockchain
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"testing"
+)
+
+// merkleLeaves 生成n个32字节的叶子（与交易ID的长度相同）
+func merkleLeaves(n int) [][]byte {
+	leaves := make([][]byte, n)
+	for i := range leaves {
+		hash := sha256.Sum256([]byte(fmt.Sprintf("tx-%d", i)))
+		leaves[i] = hash[:]
+	}
+	return leaves
+}
+
+func TestVerifyMerkleProof(t *testing.T) {
+	//叶子数量覆盖单个叶子、偶数和需要复制最后一个节点的奇数层
+	for _, n := range []int{1, 2, 3, 4, 5, 7, 8} {
+		leaves := merkleLeaves(n)
+		tree := NewMerkleTree(leaves)
+		root := tree.RootNode.Data
+
+		for i, leaf := range leaves {
+			proof, err := tree.Proof(leaf)
+			if err != nil {
+				t.Fatalf("%d 个叶子, 叶子 %d: %v", n, i, err)
+			}
+			if proof.Index != i {
+				t.Errorf("%d 个叶子, 叶子 %d: 索引为 %d", n, i, proof.Index)
+			}
+			if !VerifyMerkleProof(root, proof) {
+				t.Errorf("%d 个叶子, 叶子 %d: 有效的证明验证失败", n, i)
+			}
+		}
+	}
+}
+
+func TestVerifyMerkleProofRejects(t *testing.T) {
+	leaves := merkleLeaves(5)
+	tree := NewMerkleTree(leaves)
+	root := tree.RootNode.Data
+
+	valid, err := tree.Proof(leaves[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := NewMerkleTree(merkleLeaves(6)).RootNode.Data
+
+	tests := []struct {
+		name   string
+		root   []byte
+		modify func(p *MerkleProof)
+	}{
+		{"空证明", root, nil},
+		{"其它交易", root, func(p *MerkleProof) { p.TxID = merkleLeaves(10)[9] }},
+		{"交易ID长度不正确", root, func(p *MerkleProof) { p.TxID = append(p.TxID, 0) }},
+		{"内部节点冒充交易", root, func(p *MerkleProof) {
+			//叶子2和叶子3的哈希拼接成64字节的“交易ID”，从上一层开始验证
+			p.TxID = append(append([]byte{}, tree.levels[0][2]...), tree.levels[0][3]...)
+			p.Index = 1
+			p.Siblings = p.Siblings[1:]
+		}},
+		{"兄弟节点长度不正确", root, func(p *MerkleProof) { p.Siblings[0] = p.Siblings[0][:16] }},
+		{"负索引", root, func(p *MerkleProof) { p.Index = -1 }},
+		{"错误的索引", root, func(p *MerkleProof) { p.Index = 3 }},
+		{"超出路径的索引", root, func(p *MerkleProof) { p.Index += 1 << len(p.Siblings) }},
+		{"篡改的兄弟节点", root, func(p *MerkleProof) {
+			p.Siblings[1] = append([]byte{}, p.Siblings[1]...)
+			p.Siblings[1][0] ^= 0xff
+		}},
+		{"缺少兄弟节点", root, func(p *MerkleProof) { p.Siblings = p.Siblings[:len(p.Siblings)-1] }},
+		{"多余的兄弟节点", root, func(p *MerkleProof) { p.Siblings = append(p.Siblings, root) }},
+		{"其它区块的根", other, func(p *MerkleProof) {}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var proof *MerkleProof
+			if tt.modify != nil {
+				copied := *valid
+				copied.Siblings = append([][]byte{}, valid.Siblings...)
+				tt.modify(&copied)
+				proof = &copied
+			}
+			if VerifyMerkleProof(tt.root, proof) {
+				t.Error("无效的证明通过了验证")
+			}
+		})
+	}
+}
+
+func TestMerkleProofNotInTree(t *testing.T) {
+	tree := NewMerkleTree(merkleLeaves(3))
+	if _, err := tree.Proof(merkleLeaves(4)[3]); err != ErrNotInMerkleTree {
+		t.Errorf("得到 %v, 期望 %v", err, ErrNotInMerkleTree)
+	}
+}
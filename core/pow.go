@@ -14,33 +14,36 @@ const Difficulty = 5
 
 // ProofOfWork POW结构
 type ProofOfWork struct {
-	Block  *Block//POW总是针对特定区块进行操作的
+	Header *BlockHeader //POW总是针对特定区块的区块头进行操作的
 	Target *big.Int
 }
 
 // NewProof 创建一个新的Poof
 func NewProof(b *Block) *ProofOfWork {
+	return NewHeaderProof(&b.BlockHeader)
+}
+
+// NewHeaderProof 根据区块头创建POW，目标值由区块头中的难度Bits决定
+func NewHeaderProof(h *BlockHeader) *ProofOfWork {
 	target := big.NewInt(1)
-	target.Lsh(target, uint(256-Difficulty))
+	if h.Bits > 0 && h.Bits < 256 {
+		target.Lsh(target, uint(256-h.Bits))
+	} else {
+		target.SetInt64(0) //非法的难度，任何哈希都无法满足
+	}
 
-	pow := &ProofOfWork{b, target}
-	log.Infof("Target: %x\n", target)
+	pow := &ProofOfWork{h, target}
+	log.Debugf("Target: %x\n", target)
 
 	return pow
 }
 
-
-// InitData 连接交易的hash + prevHash + nonce + POW Difficulty初始化区块数据
+// InitData 使用给定的nonce序列化区块头，区块头包含了版本、prevHash、MerkleRoot、时间戳、难度、nonce和高度
 func (pow *ProofOfWork) InitData(nonce int) []byte {
-	info := bytes.Join(
-		[][]byte{
-			pow.Block.HashTransactions(),
-			pow.Block.PrevHash,
-			ToByte(int64(nonce)),
-			ToByte(int64(Difficulty)),
-		}, []byte{})
-
-	return info
+	header := *pow.Header
+	header.Nonce = nonce
+
+	return header.Serialize()
 }
 
 // Execute the Proof Of Work by incrementing the nonce
@@ -72,7 +75,7 @@ func (pow *ProofOfWork) Validate() bool {
 	var initHash big.Int
 	var hash [32]byte
 
-	info := pow.InitData(pow.Block.Nonce)
+	info := pow.InitData(pow.Header.Nonce)
 	hash = sha256.Sum256(info)
 
 	initHash.SetBytes(hash[:])
@@ -6,7 +6,6 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
-	"encoding/gob"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -24,21 +23,21 @@ type Transaction struct {
 	Outputs []TxOutput//交易输出，由本次交易产生（可能多个）
 }
 
+// Serializer 按线格式序列化交易（见encoding.go）
 func (tx *Transaction) Serializer() []byte {
-	var encoded bytes.Buffer
-
-	encode := gob.NewEncoder(&encoded)
-	err := encode.Encode(tx)
-	Handle(err)
-
-	return encoded.Bytes()
+	return EncodeTransaction(tx)
 }
 
+// Hash 计算交易ID：ID和输入签名置空后线格式编码的sha256哈希
+// 交易ID在签名之前计算，因此不包含签名；签名由VerifySignatures单独验证
 func (tx *Transaction) Hash() []byte {
 	var hash [32]byte
 
-	txCopy := *tx
-	txCopy.ID = []byte{}
+	txCopy := Transaction{[]byte{}, make([]TxInput, len(tx.Inputs)), tx.Outputs}
+	for i, in := range tx.Inputs {
+		in.Signature = nil
+		txCopy.Inputs[i] = in
+	}
 
 	hash = sha256.Sum256(txCopy.Serializer())
 	return hash[:]
@@ -84,10 +83,10 @@ func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transac
 		//，但是比特币允许交易包含引用了不同地址的输入（即来自不同地址发起的交易），所以这里仍然这么做（每一个输入分开签名）
 		//实际上，是将输入的PubKey从自己钱包的PubKey替换为该输入引用输出索引对应的交易的PubKeyHash
 		txCopy.Inputs[inId].PubKey = prevTX.Outputs[in.Out].PubKeyHash
-		dataToSign := fmt.Sprintf("%x\n", txCopy)
+		dataToSign := txCopy.sigHash()
 
 		//签名的是交易副本数据
-		r, s, err := ecdsa.Sign(rand.Reader, &privKey, []byte(dataToSign))
+		r, s, err := ecdsa.Sign(rand.Reader, &privKey, dataToSign)
 		Handle(err)
 		//一个 ECDSA 签名就是一对数字。连接切片，构建签名
 		signature := append(r.Bytes(), s.Bytes()...)
@@ -99,6 +98,12 @@ func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transac
 	}
 }
 
+// sigHash 签名和验证签名所使用的数据：交易副本线格式编码的sha256哈希
+func (tx *Transaction) sigHash() []byte {
+	hash := sha256.Sum256(tx.Serializer())
+	return hash[:]
+}
+
 // TrimmedCopy 创建一个修剪后的交易副本（深度拷贝的副本），用于签名用
 //由于TrimmedCopy是在tx签名前执行，实际上修剪只是在tx基础上，将输入Vin中的每一个vin的PubKey置为nil
 func (tx *Transaction) TrimmedCopy() Transaction {
@@ -173,9 +178,28 @@ func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
 	}
 
 	for _, in := range tx.Inputs {
-		if prevTXs[hex.EncodeToString(in.ID)].ID == nil {
-			log.Fatal("ERROR: Previous Transaction is not valid")
+		prevTX := prevTXs[hex.EncodeToString(in.ID)]
+		if prevTX.ID == nil {
+			return false
+		}
+		if in.Out < 0 || in.Out >= len(prevTX.Outputs) {
+			return false
 		}
+		//输入中的公钥必须是引用的输出所锁定的公钥，否则任何人都可以用自己的密钥签名花费别人的输出
+		if !bytes.Equal(wallet.PublicKeyHash(in.PubKey), prevTX.Outputs[in.Out].PubKeyHash) {
+			return false
+		}
+	}
+
+	return tx.VerifySignatures()
+}
+
+// VerifySignatures 验证交易中每一个输入的签名，与链上状态无关
+// 签名的数据中，输入的PubKey字段为引用的输出的PubKeyHash，Verify已经检查过它等于输入公钥的哈希，
+// 因此这里直接由输入中的公钥计算，无需查找引用的交易，可以在收到交易或区块时先做廉价的检查
+func (tx *Transaction) VerifySignatures() bool {
+	if tx.IsMinerTx() {
+		return true
 	}
 
 	txCopy := tx.TrimmedCopy()//同一笔交易的副本
@@ -183,9 +207,8 @@ func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
 	//迭代每个输入
 	for inId, in := range tx.Inputs {
 		//以下代码跟签名一样，因为在验证阶段，我们需要的是与签名相同的数据
-		prevTX := prevTXs[hex.EncodeToString(in.ID)]
 		txCopy.Inputs[inId].Signature = nil
-		txCopy.Inputs[inId].PubKey = prevTX.Outputs[in.Out].PubKeyHash
+		txCopy.Inputs[inId].PubKey = wallet.PublicKeyHash(in.PubKey)
 
 		//解包存储在`TXInput.Signature`和`TXInput.PubKey`中的值
 
@@ -203,12 +226,12 @@ func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
 		x.SetBytes(in.PubKey[:(keyLen / 2)])
 		y.SetBytes(in.PubKey[(keyLen / 2):])
 
-		dataToVerify := fmt.Sprintf("%x\n", txCopy)
+		dataToVerify := txCopy.sigHash()
 
 		//从解析的坐标创建一个rawPubKey（原生态公钥）
 		rawPubKey := ecdsa.PublicKey{Curve: curve, X: &x, Y: &y}
 		//使用公钥验证副本的签名，是否私钥签名档结果一致（&r和&s是私钥签名txCopy.ID的结果）
-		if ecdsa.Verify(&rawPubKey, []byte(dataToVerify), &r, &s) == false {
+		if ecdsa.Verify(&rawPubKey, dataToVerify, &r, &s) == false {
 			return false
 		}
 		txCopy.Inputs[inId].PubKey = nil
@@ -251,7 +274,7 @@ func MinerTx(to, data string) *Transaction {
 	}
 
 	txIn := TxInput{[]byte{}, -1, nil, []byte(data)}
-	txOut := NewTXOutput(20.000, to)
+	txOut := NewTXOutput(MinerReward, to)
 
 	tx := Transaction{nil, []TxInput{txIn}, []TxOutput{*txOut}}
 
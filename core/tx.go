@@ -2,7 +2,6 @@ package blockchain
 
 import (
 	"bytes"
-	"encoding/gob"
 
 	"linechain/util/env"
 	"linechain/wallet"
@@ -63,19 +62,11 @@ func (out *TxOutput) IsLockWithKey(pubKeyHash []byte) bool {
 }
 
 func (outputs *TxOutputs) Serialize() []byte {
-	var res bytes.Buffer
-	encoder := gob.NewEncoder(&res)
-
-	err := encoder.Encode(outputs)
-	Handle(err)
-	return res.Bytes()
+	return EncodeOutputs(outputs)
 }
 
 func DeSerializeOutputs(data []byte) TxOutputs {
-	var outputs TxOutputs
-	encoder := gob.NewDecoder(bytes.NewReader(data))
-
-	err := encoder.Decode(&outputs)
+	outputs, err := DecodeOutputs(data)
 	Handle(err)
 	return outputs
 }
@@ -0,0 +1,70 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Client JSON-RPC 2.0 HTTP客户端
+type Client struct {
+	url    string
+	http   *http.Client
+	nextID int64
+}
+
+// NewClient 创建客户端，url如 http://localhost:5000/_jsonrpc
+func NewClient(url string) *Client {
+	return &Client{
+		url:  url,
+		http: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Call 调用方法，params为对象（命名参数）、切片（按位置的参数）或nil，result为nil时忽略结果
+// 服务器返回的错误对象以 *Error 返回
+func (c *Client) Call(method string, params interface{}, result interface{}) error {
+	req := Request{
+		JSONRPC: Version,
+		ID:      json.RawMessage(strconv.FormatInt(atomic.AddInt64(&c.nextID, 1), 10)),
+		Method:  method,
+	}
+	if params != nil {
+		data, err := json.Marshal(params)
+		if err != nil {
+			return fmt.Errorf("编码参数出错: %w", err)
+		}
+		req.Params = data
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	httpResp, err := c.http.Post(c.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+	data, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		return err
+	}
+
+	var resp Response
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return fmt.Errorf("解析响应出错（HTTP %s）: %w", httpResp.Status, err)
+	}
+	if resp.Error != nil {
+		return resp.Error
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(resp.Result, result)
+}
@@ -3,29 +3,40 @@ package main
 import (
 	"fmt"
 	"log"
-	"net/rpc/jsonrpc"
 
 	rpc "linechain/json-rpc"
 )
 
-//JSONRPC RPC client
-//Go 标准包提供了对 RPC 的支持，且支持三个级别的 RPC：TCP、HTTP、JSONRPC
-//这里没有通过API服务调用RPC，而是直接连接到RPC服务器
+// JSON-RPC 2.0 客户端示例
+// 这里没有通过API服务调用RPC，而是直接通过HTTP连接到节点的RPC服务器
 func main() {
 	//假定RPC服务器运行在端口5000
-	client, err := jsonrpc.Dial("tcp", "localhost:5000")
+	client := rpc.NewClient("http://localhost:5000/_jsonrpc")
+
+	//区块以十六进制字符串表示哈希（见 blockchain.ConstructJSON）
+	var blocks []struct {
+		Hash     string
+		PrevHash string
+		TxCount  int
+	}
+	err := client.Call("API.GetBlockchain", nil, &blocks) //远程调用RPC服务器进程的方法
 	if err != nil {
-		log.Fatal("dialing:", err)
+		log.Fatal("API error:", err.Error())
 	}
-	args := rpc.Args{
-		Address: "14RwDN6Pj4zFUzdjiB8qUkVMC1QvRG5Cmr",
+	for _, block := range blocks {
+		fmt.Printf("%s %d笔交易\n", block.Hash, block.TxCount)
 	}
-	var bs rpc.Blocks
-	err = client.Call("API.GetBlockchain", args, &bs)//远程调用RPC服务器进程的方法
-	if err != nil {
+
+	//命名参数和按位置的参数是等价的
+	var balance struct {
+		Address string
+		Balance float64
+	}
+	if err := client.Call("API.GetBalance", rpc.Args{Address: "14RwDN6Pj4zFUzdjiB8qUkVMC1QvRG5Cmr"}, &balance); err != nil {
 		log.Fatal("API error:", err.Error())
 	}
-	for _, block := range bs {
-		fmt.Printf("%x", block.PrevHash)
+	if err := client.Call("API.GetBalance", []string{"14RwDN6Pj4zFUzdjiB8qUkVMC1QvRG5Cmr"}, &balance); err != nil {
+		log.Fatal("API error:", err.Error())
 	}
+	fmt.Printf("%s 的余额是 %f\n", balance.Address, balance.Balance)
 }
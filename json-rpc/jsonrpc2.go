@@ -0,0 +1,38 @@
+package rpc
+
+import (
+	"linechain/json-rpc/jsonrpc2"
+)
+
+// JSON-RPC 2.0协议的实现在jsonrpc2包中，这里保留原来的名称，供HTTP、WebSocket服务和客户端使用
+
+const Version = jsonrpc2.Version
+
+// 标准错误码
+const (
+	CodeParseError     = jsonrpc2.CodeParseError
+	CodeInvalidRequest = jsonrpc2.CodeInvalidRequest
+	CodeMethodNotFound = jsonrpc2.CodeMethodNotFound
+	CodeInvalidParams  = jsonrpc2.CodeInvalidParams
+	CodeInternalError  = jsonrpc2.CodeInternalError
+	CodeServerError    = jsonrpc2.CodeServerError
+)
+
+var (
+	ErrInvalidMethod = jsonrpc2.ErrInvalidMethod
+	ErrDuplicate     = jsonrpc2.ErrDuplicate
+)
+
+type (
+	Request  = jsonrpc2.Request
+	Response = jsonrpc2.Response
+	Error    = jsonrpc2.Error
+	Registry = jsonrpc2.Registry
+)
+
+var (
+	NewError      = jsonrpc2.NewError
+	NewRegistry   = jsonrpc2.NewRegistry
+	errorResponse = jsonrpc2.ErrorResponse
+	decodeInto    = jsonrpc2.DecodeInto
+)
@@ -0,0 +1,307 @@
+package jsonrpc2
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// JSON-RPC 2.0（https://www.jsonrpc.org/specification）
+// 支持命名参数（params为对象）和按位置的参数（params为数组，依次对应参数结构体的字段）、批量请求和通知（没有id的请求不返回响应）
+// 方法注册在Registry中，与CommandLine解耦：任何 func() (R, error) 或 func(A) (R, error) 形式的函数都可以注册为方法
+// 本包只实现协议，不依赖区块链和p2p网络；节点的API由rpc包注册（见json-rpc/server.go）
+
+const Version = "2.0"
+
+// 标准错误码
+const (
+	CodeParseError     = -32700 //请求不是合法的JSON
+	CodeInvalidRequest = -32600 //请求不是合法的请求对象
+	CodeMethodNotFound = -32601 //方法不存在
+	CodeInvalidParams  = -32602 //参数不正确
+	CodeInternalError  = -32603 //服务器内部错误
+	CodeServerError    = -32000 //方法执行出错
+)
+
+var (
+	ErrInvalidMethod = errors.New("方法必须是 func() (R, error) 或 func(A) (R, error)，A为结构体")
+	ErrDuplicate     = errors.New("方法已注册")
+)
+
+// Request 请求对象，ID为空表示通知
+type Request struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+// Response 响应对象，Result和Error二者只有一个
+type Response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+}
+
+// Error 错误对象
+type Error struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s (%d)", e.Message, e.Code)
+}
+
+// NewError 创建错误对象，方法返回 *Error 时原样返回给客户端，返回其它错误时错误码为CodeServerError
+func NewError(code int, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+// method 注册的方法
+type method struct {
+	fn      reflect.Value
+	argType reflect.Type //参数结构体的类型，方法没有参数时为nil
+}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// Registry JSON-RPC方法的注册表
+type Registry struct {
+	mutex   sync.RWMutex
+	methods map[string]*method
+}
+
+func NewRegistry() *Registry {
+	return &Registry{methods: map[string]*method{}}
+}
+
+// Register 注册方法，fn必须是 func() (R, error) 或 func(A) (R, error)，A为结构体
+func (r *Registry) Register(name string, fn interface{}) error {
+	v := reflect.ValueOf(fn)
+	t := v.Type()
+	if t.Kind() != reflect.Func || t.NumIn() > 1 || t.NumOut() != 2 || t.Out(1) != errorType {
+		return fmt.Errorf("%w: %s", ErrInvalidMethod, name)
+	}
+	m := &method{fn: v}
+	if t.NumIn() == 1 {
+		if t.In(0).Kind() != reflect.Struct {
+			return fmt.Errorf("%w: %s", ErrInvalidMethod, name)
+		}
+		m.argType = t.In(0)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, ok := r.methods[name]; ok {
+		return fmt.Errorf("%w: %s", ErrDuplicate, name)
+	}
+	r.methods[name] = m
+	return nil
+}
+
+// Methods 返回全部已注册的方法名（按名称排序）
+func (r *Registry) Methods() []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	names := make([]string, 0, len(r.methods))
+	for name := range r.methods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (r *Registry) method(name string) (*method, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	m, ok := r.methods[name]
+	return m, ok
+}
+
+// Handle 处理请求体：单个请求返回单个响应，批量请求返回响应数组；全部是通知时返回nil（不需要响应）
+func (r *Registry) Handle(body []byte) interface{} {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return ErrorResponse(nil, CodeInvalidRequest, "请求为空")
+	}
+	if body[0] != '[' {
+		resp := r.handleOne(body)
+		if resp == nil {
+			return nil
+		}
+		return resp
+	}
+
+	var batch []json.RawMessage
+	if err := json.Unmarshal(body, &batch); err != nil {
+		return ErrorResponse(nil, CodeParseError, "解析请求出错: "+err.Error())
+	}
+	if len(batch) == 0 {
+		return ErrorResponse(nil, CodeInvalidRequest, "批量请求为空")
+	}
+	var responses []*Response
+	for _, raw := range batch {
+		if resp := r.handleOne(raw); resp != nil {
+			responses = append(responses, resp)
+		}
+	}
+	if len(responses) == 0 {
+		return nil
+	}
+	return responses
+}
+
+// handleOne 处理单个请求，通知返回nil
+func (r *Registry) handleOne(raw json.RawMessage) *Response {
+	var req Request
+	if err := json.Unmarshal(raw, &req); err != nil {
+		//批量请求中的元素不是对象时，json能解析但不是请求对象
+		var v interface{}
+		if json.Unmarshal(raw, &v) == nil {
+			return ErrorResponse(nil, CodeInvalidRequest, "请求不是对象")
+		}
+		return ErrorResponse(nil, CodeParseError, "解析请求出错: "+err.Error())
+	}
+	if req.JSONRPC != Version || req.Method == "" {
+		return ErrorResponse(req.ID, CodeInvalidRequest, `请求必须包含 "jsonrpc": "2.0" 和 method`)
+	}
+	notification := len(req.ID) == 0
+
+	result, rpcErr := r.call(&req)
+	if notification {
+		return nil
+	}
+	if rpcErr != nil {
+		return &Response{JSONRPC: Version, ID: req.ID, Error: rpcErr}
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return ErrorResponse(req.ID, CodeInternalError, "编码结果出错: "+err.Error())
+	}
+	return &Response{JSONRPC: Version, ID: req.ID, Result: data}
+}
+
+// call 解码参数并调用方法
+func (r *Registry) call(req *Request) (result interface{}, rpcErr *Error) {
+	m, ok := r.method(req.Method)
+	if !ok {
+		return nil, NewError(CodeMethodNotFound, "方法不存在: "+req.Method)
+	}
+
+	var in []reflect.Value
+	if m.argType != nil {
+		arg, err := decodeParams(m.argType, req.Params)
+		if err != nil {
+			return nil, NewError(CodeInvalidParams, err.Error())
+		}
+		in = append(in, arg)
+	} else if !emptyParams(req.Params) {
+		return nil, NewError(CodeInvalidParams, "方法没有参数")
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			rpcErr = NewError(CodeInternalError, fmt.Sprintf("执行 %s 出错: %v", req.Method, p))
+		}
+	}()
+	out := m.fn.Call(in)
+	if err, _ := out[1].Interface().(error); err != nil {
+		var e *Error
+		if errors.As(err, &e) {
+			return nil, e
+		}
+		return nil, NewError(CodeServerError, err.Error())
+	}
+	return out[0].Interface(), nil
+}
+
+// emptyParams params缺省、为null或者为空数组、空对象
+func emptyParams(params json.RawMessage) bool {
+	switch string(bytes.Join(bytes.Fields(params), nil)) {
+	case "", "null", "[]", "{}":
+		return true
+	}
+	return false
+}
+
+// decodeParams 将params解码为参数结构体：
+// 对象为命名参数（字段名不区分大小写）；数组为按位置的参数，依次对应结构体导出的字段，
+// 只有一个对象元素的数组也作为命名参数（兼容JSON-RPC 1.0风格的 "params": [{...}]）
+func decodeParams(argType reflect.Type, params json.RawMessage) (reflect.Value, error) {
+	arg := reflect.New(argType)
+	params = bytes.TrimSpace(params)
+	if len(params) == 0 || string(params) == "null" {
+		return arg.Elem(), nil
+	}
+
+	switch params[0] {
+	case '{':
+		if err := json.Unmarshal(params, arg.Interface()); err != nil {
+			return arg, fmt.Errorf("参数不正确: %w", err)
+		}
+	case '[':
+		var positional []json.RawMessage
+		if err := json.Unmarshal(params, &positional); err != nil {
+			return arg, fmt.Errorf("参数不正确: %w", err)
+		}
+		if len(positional) == 1 && bytes.HasPrefix(bytes.TrimSpace(positional[0]), []byte("{")) {
+			if err := json.Unmarshal(positional[0], arg.Interface()); err != nil {
+				return arg, fmt.Errorf("参数不正确: %w", err)
+			}
+			break
+		}
+		fields := exportedFields(argType)
+		if len(positional) > len(fields) {
+			return arg, fmt.Errorf("参数过多: 最多 %d 个", len(fields))
+		}
+		for i, raw := range positional {
+			field := arg.Elem().Field(fields[i])
+			if err := json.Unmarshal(raw, field.Addr().Interface()); err != nil {
+				return arg, fmt.Errorf("第 %d 个参数（%s）不正确: %w", i+1, argType.Field(fields[i]).Name, err)
+			}
+		}
+	default:
+		return arg, errors.New("params必须是对象或数组")
+	}
+	return arg.Elem(), nil
+}
+
+// DecodeInto 按命名参数或按位置的参数将params解码到args指向的结构体（如WebSocket的订阅参数）
+func DecodeInto(args interface{}, params json.RawMessage) error {
+	ptr := reflect.ValueOf(args)
+	v, err := decodeParams(ptr.Elem().Type(), params)
+	if err != nil {
+		return err
+	}
+	ptr.Elem().Set(v)
+	return nil
+}
+
+// exportedFields 结构体导出字段的索引
+func exportedFields(t reflect.Type) []int {
+	var fields []int
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).IsExported() {
+			fields = append(fields, i)
+		}
+	}
+	return fields
+}
+
+// ErrorResponse 创建错误响应，id为空时响应的id为null
+func ErrorResponse(id json.RawMessage, code int, message string) *Response {
+	if len(id) == 0 {
+		id = json.RawMessage("null")
+	}
+	return &Response{JSONRPC: Version, ID: id, Error: NewError(code, message)}
+}
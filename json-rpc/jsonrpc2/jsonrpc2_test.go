@@ -0,0 +1,146 @@
+package jsonrpc2
+
+import (
+	"errors"
+	"testing"
+)
+
+type addArgs struct {
+	A int
+	B int
+}
+
+func newTestRegistry(t *testing.T) *Registry {
+	r := NewRegistry()
+	methods := map[string]interface{}{
+		"add":  func(args addArgs) (int, error) { return args.A + args.B, nil },
+		"ping": func() (string, error) { return "pong", nil },
+		"fail": func() (int, error) { return 0, errors.New("失败") },
+		"deny": func() (int, error) { return 0, NewError(42, "拒绝") },
+		"boom": func() (int, error) { panic("boom") },
+	}
+	for name, fn := range methods {
+		if err := r.Register(name, fn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return r
+}
+
+// result 响应中与测试相关的部分：id、结果和错误码
+type result struct {
+	id     string
+	result string
+	code   int
+}
+
+func summarize(resp *Response) result {
+	res := result{id: string(resp.ID), result: string(resp.Result)}
+	if resp.Error != nil {
+		res.code = resp.Error.Code
+	}
+	return res
+}
+
+func TestRegistryHandle(t *testing.T) {
+	tests := []struct {
+		name  string
+		body  string
+		batch bool     //期望返回响应数组
+		want  []result //为空表示不返回响应
+	}{
+		{"命名参数", `{"jsonrpc":"2.0","id":1,"method":"add","params":{"a":1,"B":2}}`, false, []result{{"1", "3", 0}}},
+		{"按位置的参数", `{"jsonrpc":"2.0","id":2,"method":"add","params":[1,2]}`, false, []result{{"2", "3", 0}}},
+		{"部分按位置的参数", `{"jsonrpc":"2.0","id":3,"method":"add","params":[5]}`, false, []result{{"3", "5", 0}}},
+		{"数组中的单个对象", `{"jsonrpc":"2.0","id":4,"method":"add","params":[{"A":1,"B":2}]}`, false, []result{{"4", "3", 0}}},
+		{"按位置的参数过多", `{"jsonrpc":"2.0","id":5,"method":"add","params":[1,2,3]}`, false, []result{{"5", "", CodeInvalidParams}}},
+		{"按位置的参数类型错误", `{"jsonrpc":"2.0","id":6,"method":"add","params":["x",2]}`, false, []result{{"6", "", CodeInvalidParams}}},
+		{"params不是对象或数组", `{"jsonrpc":"2.0","id":7,"method":"add","params":3}`, false, []result{{"7", "", CodeInvalidParams}}},
+		{"无参数方法的空数组", `{"jsonrpc":"2.0","id":"a","method":"ping","params":[]}`, false, []result{{`"a"`, `"pong"`, 0}}},
+		{"无参数方法收到参数", `{"jsonrpc":"2.0","id":8,"method":"ping","params":[1]}`, false, []result{{"8", "", CodeInvalidParams}}},
+		{"方法不存在", `{"jsonrpc":"2.0","id":9,"method":"nope"}`, false, []result{{"9", "", CodeMethodNotFound}}},
+		{"方法返回错误", `{"jsonrpc":"2.0","id":10,"method":"fail"}`, false, []result{{"10", "", CodeServerError}}},
+		{"方法返回错误对象", `{"jsonrpc":"2.0","id":11,"method":"deny"}`, false, []result{{"11", "", 42}}},
+		{"方法panic", `{"jsonrpc":"2.0","id":12,"method":"boom"}`, false, []result{{"12", "", CodeInternalError}}},
+		{"版本不正确", `{"jsonrpc":"1.0","id":13,"method":"ping"}`, false, []result{{"13", "", CodeInvalidRequest}}},
+		{"缺少方法", `{"jsonrpc":"2.0","id":14}`, false, []result{{"14", "", CodeInvalidRequest}}},
+		{"不合法的JSON", `{"jsonrpc":`, false, []result{{"null", "", CodeParseError}}},
+		{"空请求", `  `, false, []result{{"null", "", CodeInvalidRequest}}},
+
+		{"通知", `{"jsonrpc":"2.0","method":"ping"}`, false, nil},
+		{"出错的通知", `{"jsonrpc":"2.0","method":"nope"}`, false, nil},
+
+		{"批量请求", `[
+			{"jsonrpc":"2.0","id":1,"method":"add","params":[1,2]},
+			{"jsonrpc":"2.0","method":"add","params":[3,4]},
+			{"jsonrpc":"2.0","id":2,"method":"nope"},
+			{"jsonrpc":"2.0","id":3,"method":"ping"}
+		]`, true, []result{{"1", "3", 0}, {"2", "", CodeMethodNotFound}, {"3", `"pong"`, 0}}},
+		{"全部是通知的批量请求", `[{"jsonrpc":"2.0","method":"ping"},{"jsonrpc":"2.0","method":"fail"}]`, false, nil},
+		{"空的批量请求", `[]`, false, []result{{"null", "", CodeInvalidRequest}}},
+		{"批量请求中不是对象的元素", `[1,{"jsonrpc":"2.0","id":1,"method":"ping"}]`, true, []result{{"null", "", CodeInvalidRequest}, {"1", `"pong"`, 0}}},
+		{"不合法的批量请求", `[{"jsonrpc":"2.0"`, false, []result{{"null", "", CodeParseError}}},
+	}
+
+	r := newTestRegistry(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []result
+			batch := false
+			switch out := r.Handle([]byte(tt.body)).(type) {
+			case nil:
+			case *Response:
+				got = append(got, summarize(out))
+			case []*Response:
+				batch = true
+				for _, resp := range out {
+					got = append(got, summarize(resp))
+				}
+			default:
+				t.Fatalf("未知的返回类型 %T", out)
+			}
+
+			if batch != tt.batch {
+				t.Errorf("返回响应数组 %v, 期望 %v", batch, tt.batch)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("得到 %d 个响应 %v, 期望 %d 个 %v", len(got), got, len(tt.want), tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("第 %d 个响应为 %+v, 期望 %+v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRegistryRegister(t *testing.T) {
+	tests := []struct {
+		name string
+		fn   interface{}
+		want error
+	}{
+		{"无参数", func() (int, error) { return 0, nil }, nil},
+		{"结构体参数", func(addArgs) (int, error) { return 0, nil }, nil},
+		{"不是函数", 1, ErrInvalidMethod},
+		{"参数不是结构体", func(int) (int, error) { return 0, nil }, ErrInvalidMethod},
+		{"参数过多", func(addArgs, addArgs) (int, error) { return 0, nil }, ErrInvalidMethod},
+		{"缺少错误返回值", func() int { return 0 }, ErrInvalidMethod},
+		{"第二个返回值不是错误", func() (int, int) { return 0, 0 }, ErrInvalidMethod},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := NewRegistry().Register("m", tt.fn)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("得到 %v, 期望 %v", err, tt.want)
+			}
+		})
+	}
+
+	r := newTestRegistry(t)
+	if err := r.Register("ping", func() (int, error) { return 0, nil }); !errors.Is(err, ErrDuplicate) {
+		t.Errorf("重复注册: 得到 %v, 期望 %v", err, ErrDuplicate)
+	}
+}
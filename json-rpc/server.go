@@ -1,18 +1,25 @@
 package rpc
 
 import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
-	"net/rpc"
-	"net/rpc/jsonrpc"
-	"os"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 
 	"linechain/console/utils"
 	blockchain "linechain/core"
-	appUtils "linechain/util/utils"
+	"linechain/util/lifecycle"
+	"linechain/wallet"
 
+	"github.com/libp2p/go-libp2p/core/peer"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -20,122 +27,308 @@ var (
 	port = "5000"
 )
 
+const (
+	hashLength        = 32               //交易ID和区块哈希的长度
+	maxRequestSize    = 1 << 20          //请求体的大小上限（1MB）
+	readHeaderTimeout = 10 * time.Second //读取请求头的超时时间
+)
+
+// API 节点的RPC方法，方法名为 "API.方法名"（如 API.GetBalance）
+// 非法的参数返回CodeInvalidParams错误，执行失败（响应中的Error不为空）返回CodeServerError错误，
+// 错误的Data为命令行工具的错误码
 type API struct {
-	RPCEnabled bool
-	cmd        *utils.CommandLine
+	cmd *utils.CommandLine
 }
 
-type HttpConn struct {
-	in  io.Reader
-	out io.Writer
+// appError 将命令行工具响应中的错误转换为JSON-RPC错误，Error为空（nil或零值）表示成功
+func appError(e *utils.Error) error {
+	if e == nil || (e.Code == 0 && e.Message == "") {
+		return nil
+	}
+	return &Error{Code: CodeServerError, Message: e.Message, Data: e.Code}
 }
 
-func (conn *HttpConn) Read(p []byte) (n int, err error) {
-	return conn.in.Read(p)
+// invalidParams 参数非法的错误
+func invalidParams(format string, args ...interface{}) error {
+	return NewError(CodeInvalidParams, fmt.Sprintf(format, args...))
 }
-func (conn *HttpConn) Write(d []byte) (n int, err error) {
-	return conn.out.Write(d)
-}
-func (conn *HttpConn) Close() error {
+
+// checkAddress 检查钱包地址参数
+func checkAddress(name, address string) error {
+	if !wallet.ValidateAddress(address) {
+		return invalidParams("%s 不是合法的钱包地址: %q", name, address)
+	}
 	return nil
 }
-/**
-* instanceId 与blockchain实例保持一致，这里是为了指定钱包目录
-**/
-func (api *API) CreateWallet(args Args,instanceId string, address *string) error {
-	*address = api.cmd.CreateWallet(instanceId)
+
+// checkHash 检查十六进制的哈希参数（交易ID、区块哈希、MerkleRoot）
+func checkHash(name, value string) error {
+	if hash, err := hex.DecodeString(value); err != nil || len(hash) != hashLength {
+		return invalidParams("%s 不是合法的哈希: %q", name, value)
+	}
 	return nil
 }
 
-func (api *API) GetBalance(args Args, balance *utils.BalanceResponse) error {
-	*balance = api.cmd.GetBalance(args.Address)
+// checkPeerID 检查节点ID参数
+func checkPeerID(id string) error {
+	if _, err := peer.Decode(id); err != nil {
+		return invalidParams("PeerID 不是合法的节点ID: %q", id)
+	}
 	return nil
 }
 
-func (api *API) GetBlockchain(args Args, data *Blocks) error {
-	*data = api.cmd.GetBlockchain()
-	return nil
+// CreateWallet 在节点实例的钱包目录中创建钱包
+func (api *API) CreateWallet() (string, error) {
+	return api.cmd.CreateWallet(api.cmd.Blockchain.InstanceId), nil
 }
 
-func (api *API) GetBlockByHeight(args BlockArgs, data *blockchain.Block) error {
-	*data = api.cmd.GetBlockByHeight(args.Height)
-	return nil
+func (api *API) GetBalance(args Args) (utils.BalanceResponse, error) {
+	if err := checkAddress("Address", args.Address); err != nil {
+		return utils.BalanceResponse{}, err
+	}
+	resp := api.cmd.GetBalance(args.Address)
+	return resp, appError(resp.Error)
 }
 
-func (api *API) Send(args SendArgs, data *utils.SendResponse) error {
-	*data = api.cmd.Send(args.SendFrom, args.SendTo, args.Amount, args.Mine)
-	return nil
+func (api *API) GetBlockchain() (*Blocks, error) {
+	blocks := Blocks(api.cmd.GetBlockchain())
+	return &blocks, nil
 }
 
-// StartServer 启动节点RPC服务，默认的 rpcPort 为5000
-// 注意，节点的RPC服务并非是节点服务的必须，节点是否提供了RPC服务，由启动节点时提供的rpc参数决定（等同于StartServer的rpcEnabled参数）
-// 因为 StartServer 是被cli.StartNode调用的，而 StartServer 被调用的时机是以 rpcEnabled=true 为前提条件
-// 因此这里的 StartServer 中的参数rpcEnabled一定是 true
-// 实际上，在函数StartServer体中，rpcEnabled的值的意义没有实际被用到
-func StartServer(cli *utils.CommandLine, rpcEnabled bool, rpcPort string, rpcAddr string) {
-	if rpcPort != "" {
-		port = rpcPort
+func (api *API) GetBlockByHeight(args BlockArgs) (blockchain.Block, error) {
+	if args.Height < 1 {
+		return blockchain.Block{}, invalidParams("Height 必须大于0: %d", args.Height)
+	}
+	return api.cmd.GetBlockByHeight(args.Height), nil
+}
+
+func (api *API) Send(args SendArgs) (utils.SendResponse, error) {
+	if err := checkAddress("SendFrom", args.SendFrom); err != nil {
+		return utils.SendResponse{}, err
+	}
+	if err := checkAddress("SendTo", args.SendTo); err != nil {
+		return utils.SendResponse{}, err
+	}
+	if args.Amount <= 0 {
+		return utils.SendResponse{}, invalidParams("Amount 必须大于0: %v", args.Amount)
+	}
+	resp := api.cmd.Send(args.SendFrom, args.SendTo, args.Amount, args.Mine)
+	return resp, appError(resp.Error)
+}
+
+func (api *API) GetTxProof(args TxProofArgs) (utils.TxProofResponse, error) {
+	if err := checkHash("TxID", args.TxID); err != nil {
+		return utils.TxProofResponse{}, err
+	}
+	resp := api.cmd.GetTxProof(args.TxID)
+	return resp, appError(resp.Error)
+}
+
+func (api *API) VerifyTxProof(args VerifyTxProofArgs) (utils.VerifyTxProofResponse, error) {
+	if err := checkHash("TxID", args.TxID); err != nil {
+		return utils.VerifyTxProofResponse{}, err
+	}
+	if args.BlockHash == "" && args.MerkleRoot == "" {
+		return utils.VerifyTxProofResponse{}, invalidParams("BlockHash 和 MerkleRoot 至少提供一个")
+	}
+	if args.Index < 0 {
+		return utils.VerifyTxProofResponse{}, invalidParams("Index 不能为负数: %d", args.Index)
+	}
+	for _, sibling := range args.Siblings {
+		if err := checkHash("Siblings", sibling); err != nil {
+			return utils.VerifyTxProofResponse{}, err
+		}
+	}
+	resp := api.cmd.VerifyTxProof(args.TxID, args.BlockHash, args.MerkleRoot, args.Index, args.Siblings)
+	return resp, appError(resp.Error)
+}
+
+func (api *API) GetSyncStatus() (utils.SyncStatusResponse, error) {
+	resp := api.cmd.GetSyncStatus()
+	return resp, appError(resp.Error)
+}
+
+func (api *API) GetPeers() (utils.PeersResponse, error) {
+	resp := api.cmd.GetPeers()
+	return resp, appError(resp.Error)
+}
+
+func (api *API) ListBanned() (utils.BanListResponse, error) {
+	resp := api.cmd.ListBanned()
+	return resp, appError(resp.Error)
+}
+
+func (api *API) BanPeer(args BanArgs) (utils.BanResponse, error) {
+	if err := checkPeerID(args.PeerID); err != nil {
+		return utils.BanResponse{}, err
 	}
+	if args.Duration != "" {
+		if _, err := time.ParseDuration(args.Duration); err != nil {
+			return utils.BanResponse{}, invalidParams("Duration 不是合法的时长: %q", args.Duration)
+		}
+	}
+	resp := api.cmd.BanPeer(args.PeerID, args.Duration)
+	return resp, appError(resp.Error)
+}
+
+func (api *API) UnbanPeer(args BanArgs) (utils.BanResponse, error) {
+	if err := checkPeerID(args.PeerID); err != nil {
+		return utils.BanResponse{}, err
+	}
+	resp := api.cmd.UnbanPeer(args.PeerID)
+	return resp, appError(resp.Error)
+}
+
+func (api *API) ReloadAllowlist() (utils.AllowlistResponse, error) {
+	resp := api.cmd.ReloadAllowlist()
+	return resp, appError(resp.Error)
+}
 
-	publicAPI := &API{
-		rpcEnabled,
-		cli,
+// RegisterAPI 将节点的RPC方法注册到registry
+func RegisterAPI(registry *Registry, cli *utils.CommandLine) error {
+	api := &API{cli}
+	methods := map[string]interface{}{
+		"API.CreateWallet":     api.CreateWallet,
+		"API.GetBalance":       api.GetBalance,
+		"API.GetBlockchain":    api.GetBlockchain,
+		"API.GetBlockByHeight": api.GetBlockByHeight,
+		"API.Send":             api.Send,
+		"API.GetTxProof":       api.GetTxProof,
+		"API.VerifyTxProof":    api.VerifyTxProof,
+		"API.GetSyncStatus":    api.GetSyncStatus,
+		"API.GetPeers":         api.GetPeers,
+		"API.ListBanned":       api.ListBanned,
+		"API.BanPeer":          api.BanPeer,
+		"API.UnbanPeer":        api.UnbanPeer,
+		"API.ReloadAllowlist":  api.ReloadAllowlist,
+	}
+	for name, fn := range methods {
+		if err := registry.Register(name, fn); err != nil {
+			return err
+		}
 	}
-	defer cli.Blockchain.Database.Close()
+	return nil
+}
 
-	// 启动协程，程序退出后进行资源清理
-	go appUtils.CloseDB(cli.Blockchain)
+// Server 节点的JSON-RPC 2.0 HTTP服务（包括WebSocket订阅），由生命周期管理器停止
+type Server struct {
+	Registry *Registry
+	http     *http.Server
+	origins  []string //允许的浏览器来源（Origin），"*"表示任意来源
 
-	//服务器需要注册对象实例， 通过对象的类型名暴露服务。
-	//注册后这个对象的输出方法就可以远程调用，rpc库封装了底层传输的细节，包括序列化(默认Gob序列化器)
-	//Go 的 RPC 和传统的 RPC 系统不同，它只支持 Go 开发的服务器与客户端之间的交互（因为在内部采用了 Gob 来编码）
-	err := rpc.Register(publicAPI)//通过 API 的实例，将 API 的方法注册在 DefaultServer 中
-	checkError("注册API出错:", err)
+	wsMutex sync.Mutex
+	wsConns map[*wsConn]struct{}
+}
 
-	//将 RPC 服务绑定到 HTTP 服务中去，利用HTTP传输数据（而不是直接通过TCP）
-	rpc.HandleHTTP()
+// StartServer 启动节点RPC服务，默认的 rpcPort 为5000，在协程中处理请求，不阻塞调用者
+// 请求以POST发送到 /_jsonrpc（也可以发送到 /），WebSocket连接到 /ws，GET / 用于检查服务是否在运行
+// origins为允许的浏览器来源，未列出的网页不能调用RPC方法或建立WebSocket连接（与RPC服务同源的网页总是允许）
+func StartServer(cli *utils.CommandLine, rpcPort string, rpcAddr string, origins []string) (*Server, error) {
+	if rpcPort != "" {
+		port = rpcPort
+	}
 
-	tcpAddr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("%s:%s", rpcAddr, port))
-	checkError("解析监听TCP地址和端口错误:", err)
+	registry := NewRegistry()
+	if err := RegisterAPI(registry, cli); err != nil {
+		return nil, fmt.Errorf("注册API出错: %w", err)
+	}
 
-	listener, err := net.ListenTCP("tcp", tcpAddr)
-	checkError("监听服务启动错误:", err)
+	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%s", rpcAddr, port))
+	if err != nil {
+		return nil, fmt.Errorf("监听服务启动错误: %w", err)
+	}
 
-	//网站 root 路由
-	//可通过网页打开http://localhost:port/来测试
-	http.HandleFunc("/", func(res http.ResponseWriter, req *http.Request) {
-		io.WriteString(res, "RPC服务正在运行!")
+	server := &Server{Registry: registry, origins: origins, wsConns: map[*wsConn]struct{}{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/_jsonrpc", server.serveJSONRPC)
+	mux.HandleFunc(wsPath, server.serveWS)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		//网站 root 路由，可通过网页打开http://localhost:port/来测试
+		if r.Method == http.MethodPost {
+			server.serveJSONRPC(w, r)
+			return
+		}
+		io.WriteString(w, "RPC服务正在运行!")
 	})
+	server.http = &http.Server{Handler: mux, ReadHeaderTimeout: readHeaderTimeout}
 	log.Infof("rpc服务运行于端口: %s", port)
 
-	//循环处理来自客户端的请求
-	for {
-		conn, err := listener.Accept()//阻塞，直到有客户端连接进来
-		if err != nil {
-			continue
+	go func() {
+		if err := server.http.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Errorf("rpc服务出错: %v", err)
 		}
-		jsonrpc.ServeConn(conn)
-		http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			//URL:[scheme:][//[userinfo@]host][/]path[?query][#fragment]
-			if r.URL.Path == "/_jsonrpc" {
-				serverCodec := jsonrpc.NewServerCodec(&HttpConn{in: r.Body, out: w})
-				w.Header().Set("Content-type", "application/json")
-				w.WriteHeader(200)
-				err := rpc.ServeRequest(serverCodec)
-				if err != nil {
-					log.Errorf("在服务于JSON请求时出错: %v", err)
-					http.Error(w, "在服务于JSON请求时出错", 500)
-					return
-				}
-			}
-		}))
-	}
-
-}
-
-func checkError(message string, err error) {
+	}()
+	return server, nil
+}
+
+// allowOrigin 请求的来源是否允许：非浏览器客户端不带Origin，总是允许；
+// 浏览器中的网页只有与RPC服务同源或在允许的来源列表中时才能访问，防止用户打开的任意网页调用本地节点的RPC方法
+func (server *Server) allowOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range server.origins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// serveJSONRPC 处理一个HTTP请求中的单个或批量JSON-RPC请求
+func (server *Server) serveJSONRPC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "JSON-RPC请求必须使用POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if !server.allowOrigin(r) {
+		http.Error(w, "不允许的来源", http.StatusForbidden)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestSize))
 	if err != nil {
-		log.Info(message, err.Error())
-		os.Exit(1)
+		writeJSON(w, errorResponse(nil, CodeParseError, "读取请求出错: "+err.Error()))
+		return
+	}
+	resp := server.Registry.Handle(body)
+	if resp == nil {
+		//全部是通知，不需要响应
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, resp)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("写入JSON-RPC响应出错: %v", err)
+	}
+}
+
+// Close 停止接受新的请求，关闭WebSocket连接，等待处理中的请求完成后关闭RPC服务
+func (server *Server) Close(ctx context.Context) error {
+	err := server.http.Shutdown(ctx)
+	server.closeConns()
+	return err
+}
+
+// LifecycleHook RPC服务的生命周期回调：启动时开始监听，退出时关闭服务，dependsOn为RPC服务依赖的子系统
+func LifecycleHook(cli *utils.CommandLine, rpcPort string, rpcAddr string, origins []string, dependsOn ...string) lifecycle.Hook {
+	var server *Server
+	return lifecycle.Hook{
+		Name:      "rpc",
+		DependsOn: dependsOn,
+		Start: func(context.Context) (err error) {
+			server, err = StartServer(cli, rpcPort, rpcAddr, origins)
+			return err
+		},
+		Stop: func(ctx context.Context) error {
+			return server.Close(ctx)
+		},
 	}
 }
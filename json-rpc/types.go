@@ -22,6 +22,25 @@ type BlockArgs struct {
 	Height  int
 }
 
+type TxProofArgs struct {
+	TxID string
+}
+
+// VerifyTxProofArgs 交易包含证明的验证参数，MerkleRoot和BlockHash至少提供一个
+type VerifyTxProofArgs struct {
+	TxID       string
+	BlockHash  string
+	MerkleRoot string
+	Index      int
+	Siblings   []string
+}
+
+// BanArgs 禁止节点的参数，Duration为Go的时长格式（如 "1h30m"），为空时使用节点的缺省禁止时长
+type BanArgs struct {
+	PeerID   string
+	Duration string
+}
+
 type Blocks []*blockchain.Block
 
 func (bs *Blocks) MarshalJSON() ([]byte, error) {
@@ -37,3 +56,46 @@ func (bs *Blocks) MarshalJSON() ([]byte, error) {
 	buffer.WriteString("]")
 	return buffer.Bytes(), nil
 }
+
+// SubscribeArgs WebSocket订阅的参数：Name为订阅名称，addressActivity还需要Address
+type SubscribeArgs struct {
+	Name    string
+	Address string
+}
+
+// UnsubscribeArgs 取消WebSocket订阅的参数
+type UnsubscribeArgs struct {
+	ID string
+}
+
+// HeadResult newHeads订阅推送的区块头
+type HeadResult struct {
+	Hash       string
+	PrevHash   string
+	MerkleRoot string
+	Height     int
+	Timestamp  int64
+	Bits       int
+	Nonce      int
+	TxCount    int
+}
+
+// ReorgResult reorg订阅推送的主链重组
+type ReorgResult struct {
+	OldHead    string
+	NewHead    string
+	ForkHeight int
+	Removed    []string //离开主链的区块哈希（从旧的最新区块开始）
+	Added      []string //加入主链的区块哈希（按高度从低到高）
+}
+
+// ActivityResult addressActivity订阅推送的地址相关交易
+type ActivityResult struct {
+	Address   string
+	TxID      string
+	Received  float64 //交易输出给该地址的金额
+	Spent     bool    //交易是否花费了该地址的输出
+	Pending   bool    //交易是否还在内存池中（未确认）
+	BlockHash string  //包含交易的区块，Pending时为空
+	Height    int
+}
@@ -0,0 +1,438 @@
+package rpc
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+
+	blockchain "linechain/core"
+	"linechain/memopool"
+	"linechain/p2p"
+	"linechain/util/event"
+	"linechain/wallet"
+)
+
+// WebSocket订阅：客户端连接到 /ws，用JSON-RPC 2.0请求 subscribe 和 unsubscribe，
+// 服务器以通知（method为subscription）推送订阅的事件；其它方法也可以通过同一个连接调用
+//
+// 订阅名称：
+//   - newHeads：主链的新区块（区块头）
+//   - newPendingTransactions：进入内存池的新交易（交易ID）
+//   - addressActivity：与地址相关的交易，包括内存池中的交易和加入主链的区块中的交易
+//   - reorg：主链重组
+//
+// 事件由区块链（Blockchain.AddBlock、MineBlock）和内存池发布；客户端处理太慢、事件缓冲区溢出时，
+// 服务器推送一个错误后结束该订阅
+
+const (
+	wsPath            = "/ws"
+	wsEventBuffer     = 256              //每个订阅的事件缓冲区大小
+	wsSendBuffer      = 256              //每个连接待发送消息的缓冲区大小
+	wsWriteTimeout    = 10 * time.Second //写消息的超时时间
+	wsPongTimeout     = 60 * time.Second //超过该时间没有收到pong，认为连接已断开
+	wsPingInterval    = 30 * time.Second //发送ping的间隔
+	maxSubscriptions  = 32               //每个连接最多的订阅数量
+	subscriptionEvent = "subscription"   //推送事件的通知方法名
+)
+
+var (
+	ErrUnknownSubscription = errors.New("未知的订阅名称，支持 newHeads、newPendingTransactions、addressActivity、reorg")
+	ErrTooManySubscription = fmt.Errorf("每个连接最多 %d 个订阅", maxSubscriptions)
+	errConnClosed          = errors.New("连接已关闭")
+)
+
+// upgrader 来源检查由服务器的allowOrigin完成
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+}
+
+// Notification 服务器推送的通知
+type Notification struct {
+	JSONRPC string             `json:"jsonrpc"`
+	Method  string             `json:"method"`
+	Params  NotificationParams `json:"params"`
+}
+
+// NotificationParams 通知的参数：订阅ID和事件内容，订阅因错误结束时Error不为空
+type NotificationParams struct {
+	Subscription string      `json:"subscription"`
+	Result       interface{} `json:"result,omitempty"`
+	Error        *Error      `json:"error,omitempty"`
+}
+
+// wsConn 一个WebSocket连接
+type wsConn struct {
+	server *Server
+	conn   *websocket.Conn
+	send   chan interface{}
+
+	mutex sync.Mutex
+	subs  map[string][]*event.Subscription //订阅ID -> 事件订阅（addressActivity同时订阅区块链和内存池）
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// serveWS 将HTTP连接升级为WebSocket连接
+func (server *Server) serveWS(w http.ResponseWriter, r *http.Request) {
+	up := upgrader
+	up.CheckOrigin = server.allowOrigin
+	conn, err := up.Upgrade(w, r, nil)
+	if err != nil {
+		log.Debugf("WebSocket升级失败: %v", err)
+		return
+	}
+	c := &wsConn{
+		server: server,
+		conn:   conn,
+		send:   make(chan interface{}, wsSendBuffer),
+		subs:   map[string][]*event.Subscription{},
+		closed: make(chan struct{}),
+	}
+	server.addConn(c)
+	go c.writeLoop()
+	c.readLoop()
+}
+
+func (server *Server) addConn(c *wsConn) {
+	server.wsMutex.Lock()
+	defer server.wsMutex.Unlock()
+
+	server.wsConns[c] = struct{}{}
+}
+
+func (server *Server) removeConn(c *wsConn) {
+	server.wsMutex.Lock()
+	defer server.wsMutex.Unlock()
+
+	delete(server.wsConns, c)
+}
+
+// closeConns 关闭全部WebSocket连接（http.Server.Shutdown不会关闭已升级的连接）
+func (server *Server) closeConns() {
+	server.wsMutex.Lock()
+	conns := make([]*wsConn, 0, len(server.wsConns))
+	for c := range server.wsConns {
+		conns = append(conns, c)
+	}
+	server.wsMutex.Unlock()
+
+	for _, c := range conns {
+		c.close()
+	}
+}
+
+// close 关闭连接并取消全部订阅
+func (c *wsConn) close() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.conn.Close()
+		c.server.removeConn(c)
+
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		for id, subs := range c.subs {
+			for _, sub := range subs {
+				sub.Unsubscribe()
+			}
+			delete(c.subs, id)
+		}
+	})
+}
+
+// readLoop 读取客户端的请求，直到连接关闭
+func (c *wsConn) readLoop() {
+	defer c.close()
+
+	c.conn.SetReadLimit(maxRequestSize)
+	c.conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	})
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Debugf("WebSocket连接出错: %v", err)
+			}
+			return
+		}
+		if resp := c.handle(data); resp != nil {
+			if !c.write(resp) {
+				return
+			}
+		}
+	}
+}
+
+// writeLoop 发送响应和通知，并定期发送ping
+func (c *wsConn) writeLoop() {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+	defer c.close()
+
+	for {
+		select {
+		case msg := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := c.conn.WriteJSON(msg); err != nil {
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// write 将消息放入发送队列，连接已关闭时返回false
+func (c *wsConn) write(msg interface{}) bool {
+	select {
+	case c.send <- msg:
+		return true
+	case <-c.closed:
+		return false
+	}
+}
+
+// handle 处理一条消息：subscribe和unsubscribe由连接处理，其它请求（包括批量请求）交给方法注册表
+func (c *wsConn) handle(data []byte) interface{} {
+	var req Request
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 || trimmed[0] != '{' || json.Unmarshal(trimmed, &req) != nil ||
+		(req.Method != "subscribe" && req.Method != "unsubscribe") {
+		return c.server.Registry.Handle(data)
+	}
+	if req.JSONRPC != Version {
+		return errorResponse(req.ID, CodeInvalidRequest, `请求必须包含 "jsonrpc": "2.0" 和 method`)
+	}
+
+	var result interface{}
+	var rpcErr *Error
+	if req.Method == "subscribe" {
+		result, rpcErr = c.subscribe(req.Params)
+	} else {
+		result, rpcErr = c.unsubscribe(req.Params)
+	}
+	if len(req.ID) == 0 {
+		return nil
+	}
+	if rpcErr != nil {
+		return &Response{JSONRPC: Version, ID: req.ID, Error: rpcErr}
+	}
+	encoded, _ := json.Marshal(result)
+	return &Response{JSONRPC: Version, ID: req.ID, Result: encoded}
+}
+
+// subscribe 创建订阅，返回订阅ID
+func (c *wsConn) subscribe(params json.RawMessage) (interface{}, *Error) {
+	var args SubscribeArgs
+	if err := decodeInto(&args, params); err != nil {
+		return nil, NewError(CodeInvalidParams, err.Error())
+	}
+
+	var subs []*event.Subscription
+	var convert func(interface{}) []interface{}
+	switch args.Name {
+	case "newHeads":
+		subs = []*event.Subscription{blockchain.SubscribeChainEvents(wsEventBuffer)}
+		convert = headResults
+	case "reorg":
+		subs = []*event.Subscription{blockchain.SubscribeChainEvents(wsEventBuffer)}
+		convert = reorgResults
+	case "newPendingTransactions":
+		subs = []*event.Subscription{p2p.SubscribePendingTxs(wsEventBuffer)}
+		convert = pendingTxResults
+	case "addressActivity":
+		if !wallet.ValidateAddress(args.Address) {
+			return nil, NewError(CodeInvalidParams, "非法地址: "+args.Address)
+		}
+		subs = []*event.Subscription{
+			blockchain.SubscribeChainEvents(wsEventBuffer),
+			p2p.SubscribePendingTxs(wsEventBuffer),
+		}
+		convert = activityResults(args.Address)
+	default:
+		return nil, NewError(CodeInvalidParams, ErrUnknownSubscription.Error())
+	}
+
+	id := newSubscriptionID()
+	c.mutex.Lock()
+	if err := c.canSubscribe(); err != nil {
+		c.mutex.Unlock()
+		for _, sub := range subs {
+			sub.Unsubscribe()
+		}
+		return nil, NewError(CodeServerError, err.Error())
+	}
+	c.subs[id] = subs
+	c.mutex.Unlock()
+
+	for _, sub := range subs {
+		go c.forward(id, sub, convert)
+	}
+	return id, nil
+}
+
+// canSubscribe 持有c.mutex时检查能否添加订阅：连接已关闭（订阅不会再被取消）或订阅数量已达上限时不能添加
+func (c *wsConn) canSubscribe() error {
+	select {
+	case <-c.closed:
+		return errConnClosed
+	default:
+	}
+	if len(c.subs) >= maxSubscriptions {
+		return ErrTooManySubscription
+	}
+	return nil
+}
+
+// unsubscribe 取消订阅，返回订阅是否存在
+func (c *wsConn) unsubscribe(params json.RawMessage) (interface{}, *Error) {
+	var args UnsubscribeArgs
+	if err := decodeInto(&args, params); err != nil {
+		return nil, NewError(CodeInvalidParams, err.Error())
+	}
+	return c.removeSubscription(args.ID), nil
+}
+
+func (c *wsConn) removeSubscription(id string) bool {
+	c.mutex.Lock()
+	subs, ok := c.subs[id]
+	delete(c.subs, id)
+	c.mutex.Unlock()
+
+	for _, sub := range subs {
+		sub.Unsubscribe()
+	}
+	return ok
+}
+
+// forward 将事件转换为通知推送给客户端；订阅因事件缓冲区溢出结束时推送错误并取消整个订阅
+func (c *wsConn) forward(id string, sub *event.Subscription, convert func(interface{}) []interface{}) {
+	for ev := range sub.C() {
+		for _, result := range convert(ev) {
+			if !c.write(&Notification{Version, subscriptionEvent, NotificationParams{Subscription: id, Result: result}}) {
+				return
+			}
+		}
+	}
+	if err := sub.Err(); err != nil {
+		c.write(&Notification{Version, subscriptionEvent, NotificationParams{Subscription: id, Error: NewError(CodeServerError, err.Error())}})
+		c.removeSubscription(id)
+	}
+}
+
+func newSubscriptionID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return "0x" + hex.EncodeToString(id)
+}
+
+func headResults(ev interface{}) []interface{} {
+	head, ok := ev.(blockchain.ChainHeadEvent)
+	if !ok {
+		return nil
+	}
+	block := head.Block
+	return []interface{}{&HeadResult{
+		Hash:       hex.EncodeToString(block.Hash),
+		PrevHash:   hex.EncodeToString(block.PrevHash),
+		MerkleRoot: hex.EncodeToString(block.MerkleRoot),
+		Height:     block.Height,
+		Timestamp:  block.Timestamp,
+		Bits:       block.Bits,
+		Nonce:      block.Nonce,
+		TxCount:    len(block.Transactions),
+	}}
+}
+
+func reorgResults(ev interface{}) []interface{} {
+	reorg, ok := ev.(blockchain.ChainReorgEvent)
+	if !ok {
+		return nil
+	}
+	result := &ReorgResult{
+		OldHead:    hex.EncodeToString(reorg.OldHead),
+		NewHead:    hex.EncodeToString(reorg.NewHead),
+		ForkHeight: reorg.ForkHeight,
+	}
+	for _, header := range reorg.Removed {
+		result.Removed = append(result.Removed, hex.EncodeToString(header.Hash()))
+	}
+	for _, block := range reorg.Added {
+		result.Added = append(result.Added, hex.EncodeToString(block.Hash))
+	}
+	return []interface{}{result}
+}
+
+func pendingTxResults(ev interface{}) []interface{} {
+	if tx, ok := ev.(memopool.NewTxEvent); ok {
+		return []interface{}{hex.EncodeToString(tx.Tx.ID)}
+	}
+	return nil
+}
+
+// activityResults 筛选与地址相关的交易：交易输出给该地址，或者交易的输入使用了该地址的公钥
+func activityResults(address string) func(interface{}) []interface{} {
+	fullHash := wallet.Base58Decode([]byte(address))
+	pubKeyHash := fullHash[1 : len(fullHash)-4]
+
+	activity := func(tx *blockchain.Transaction) *ActivityResult {
+		result := &ActivityResult{Address: address, TxID: hex.EncodeToString(tx.ID)}
+		related := false
+		for _, out := range tx.Outputs {
+			if out.IsLockWithKey(pubKeyHash) {
+				result.Received += out.Value
+				related = true
+			}
+		}
+		if !tx.IsMinerTx() {
+			for _, in := range tx.Inputs {
+				if bytes.Equal(wallet.PublicKeyHash(in.PubKey), pubKeyHash) {
+					result.Spent = true
+					related = true
+					break
+				}
+			}
+		}
+		if !related {
+			return nil
+		}
+		return result
+	}
+
+	return func(ev interface{}) []interface{} {
+		var results []interface{}
+		switch ev := ev.(type) {
+		case memopool.NewTxEvent:
+			if result := activity(&ev.Tx); result != nil {
+				result.Pending = true
+				results = append(results, result)
+			}
+		case blockchain.ChainHeadEvent:
+			for _, tx := range ev.Block.Transactions {
+				if result := activity(tx); result != nil {
+					result.BlockHash = hex.EncodeToString(ev.Block.Hash)
+					result.Height = ev.Block.Height
+					results = append(results, result)
+				}
+			}
+		}
+		return results
+	}
+}
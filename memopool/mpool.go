@@ -5,35 +5,64 @@ import (
 	"sync"
 
 	blockchain "linechain/core"
+	"linechain/util/event"
 )
 
 // MemoPool 交易内存池数据结构
+// 挖矿协程与网络消息处理协程会同时访问内存池，所有的读写都需要经过mutex保护
 type MemoPool struct {
-	Pending map[string]blockchain.Transaction//挂起的交易队列
-	Queued  map[string]blockchain.Transaction//排队的交易队列
-	Wg      sync.WaitGroup
+	Pending map[string]blockchain.Transaction //挂起的交易队列
+	Queued  map[string]blockchain.Transaction //排队的交易队列
+
+	mutex sync.RWMutex
+	feed  event.Feed //新交易进入内存池的事件
+}
+
+// NewTxEvent 新的交易进入内存池
+type NewTxEvent struct {
+	Tx blockchain.Transaction
+}
+
+// Subscribe 订阅新交易进入内存池的事件（NewTxEvent）
+func (memo *MemoPool) Subscribe(buffer int) *event.Subscription {
+	return memo.feed.Subscribe(buffer)
 }
 
 // Move 将交易从一个队列中移到另外一个队列
 func (memo *MemoPool) Move(tnx blockchain.Transaction, to string) {
+	memo.mutex.Lock()
+	defer memo.mutex.Unlock()
+
 	if to == "pending" {
-		memo.Remove(hex.EncodeToString(tnx.ID), "queued")
+		delete(memo.Queued, hex.EncodeToString(tnx.ID))
 		memo.Pending[hex.EncodeToString(tnx.ID)] = tnx
 	}
 
 	if to == "queued" {
-		memo.Remove(hex.EncodeToString(tnx.ID), "pending")
+		delete(memo.Pending, hex.EncodeToString(tnx.ID))
 		memo.Queued[hex.EncodeToString(tnx.ID)] = tnx
 	}
 }
 
 // Add 添加新的交易到交易内存池
 func (memo *MemoPool) Add(tnx blockchain.Transaction) {
-	memo.Pending[hex.EncodeToString(tnx.ID)] = tnx
+	memo.mutex.Lock()
+	id := hex.EncodeToString(tnx.ID)
+	_, pending := memo.Pending[id]
+	_, queued := memo.Queued[id]
+	memo.Pending[id] = tnx
+	memo.mutex.Unlock()
+
+	if !pending && !queued {
+		memo.feed.Send(NewTxEvent{Tx: tnx})
+	}
 }
 
 // Remove从某个队列中删除交易
 func (memo *MemoPool) Remove(txID string, from string) {
+	memo.mutex.Lock()
+	defer memo.mutex.Unlock()
+
 	if from == "queued" {
 		delete(memo.Queued, txID)
 		return
@@ -45,27 +74,78 @@ func (memo *MemoPool) Remove(txID string, from string) {
 	}
 }
 
-// GetTransactions 从挂起交易队列中得到指定数量的交易
+// Get 从挂起交易队列中查找交易
+func (memo *MemoPool) Get(txID string) (blockchain.Transaction, bool) {
+	memo.mutex.RLock()
+	defer memo.mutex.RUnlock()
+
+	tx, ok := memo.Pending[txID]
+	return tx, ok
+}
+
+// Find 从挂起和排队队列中查找交易
+func (memo *MemoPool) Find(txID string) (blockchain.Transaction, bool) {
+	memo.mutex.RLock()
+	defer memo.mutex.RUnlock()
+
+	if tx, ok := memo.Pending[txID]; ok {
+		return tx, true
+	}
+	tx, ok := memo.Queued[txID]
+	return tx, ok
+}
+
+// PendingCount 挂起交易队列中的交易数量
+func (memo *MemoPool) PendingCount() int {
+	memo.mutex.RLock()
+	defer memo.mutex.RUnlock()
+
+	return len(memo.Pending)
+}
+
+// GetTransactions 从挂起交易队列中得到最多count个交易的ID
 func (memo *MemoPool) GetTransactions(count int) (txs [][]byte) {
-	i := 0
+	memo.mutex.RLock()
+	defer memo.mutex.RUnlock()
+
 	for _, tx := range memo.Pending {
-		txs = append(txs, tx.ID)
-		if i == count {
+		if len(txs) >= count {
 			break
 		}
-		i++
+		txs = append(txs, tx.ID)
+	}
+	return txs
+}
+
+// Transactions 返回挂起和排队队列中的全部交易
+func (memo *MemoPool) Transactions() []blockchain.Transaction {
+	memo.mutex.RLock()
+	defer memo.mutex.RUnlock()
+
+	txs := make([]blockchain.Transaction, 0, len(memo.Pending)+len(memo.Queued))
+	for _, tx := range memo.Pending {
+		txs = append(txs, tx)
+	}
+	for _, tx := range memo.Queued {
+		txs = append(txs, tx)
 	}
 	return txs
 }
 
 // RemoveFromAll 从挂起和排队队列中全部删除某个交易
 func (memo *MemoPool) RemoveFromAll(txID string) {
+	memo.mutex.Lock()
+	defer memo.mutex.Unlock()
+
 	delete(memo.Queued, txID)
 	delete(memo.Pending, txID)
 }
 
 // ClearAll 从内存池中清除全部的交易
 func (memo *MemoPool) ClearAll() {
+	memo.mutex.Lock()
+	defer memo.mutex.Unlock()
+
 	memo.Pending = map[string]blockchain.Transaction{}
 	memo.Queued = map[string]blockchain.Transaction{}
 }
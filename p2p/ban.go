@@ -0,0 +1,278 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	BanThreshold       = 100            //不当行为分数达到该值时，断开并禁止节点
+	DefaultBanDuration = 24 * time.Hour //缺省的禁止时长
+	scoreHalfLife      = time.Hour      //不当行为分数的半衰期，偶尔的不当行为（如迟到的响应）不会日积月累导致禁止
+)
+
+// 各种不当行为的分数
+const (
+	scoreMalformed      = 20  //无法解码的消息
+	scoreOversize       = 20  //超出大小上限的消息
+	scoreUnknownCommand = 5   //未知命令
+	scoreInvalidBlock   = 100 //非法区块
+	scoreInvalidHeaders = 50  //非法区块头
+	scoreInvalidTx      = 10  //非法交易
+	scoreUnrequested    = 10  //未请求的区块或区块头
+	scoreFalseHeight    = 10  //声明的高度高于实际发送的区块头
+)
+
+var ErrNotBanned = errors.New("节点未被禁止")
+
+// PeerError 节点发来的消息不合法，Score为发送者的不当行为分数
+type PeerError struct {
+	Score int
+	Err   error
+}
+
+func (e *PeerError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PeerError) Unwrap() error {
+	return e.Err
+}
+
+// misbehavior 将错误标记为节点的不当行为
+func misbehavior(score int, err error) error {
+	return &PeerError{score, err}
+}
+
+// contextMisbehavior 与链上状态有关的检查（如区块高度、交易引用的输出）失败时的错误：
+// 只有通过流直接发来的消息才是发送者的不当行为；通道中的消息由相连节点转发，
+// 转发节点只能做与状态无关的检查（验证器已经拒绝了这类非法消息），不应该为消息的内容受罚
+func contextMisbehavior(direct bool, score int, err error) error {
+	if !direct {
+		return err
+	}
+	return misbehavior(score, err)
+}
+
+// BanEntry 禁止列表中的一项
+type BanEntry struct {
+	PeerID string    `json:"PeerID"`
+	Until  time.Time `json:"Until"`
+	Reason string    `json:"Reason"`
+}
+
+// BanManager 记录各节点的不当行为分数，并禁止分数达到BanThreshold的节点
+// 被禁止的节点在禁止期间由连接拦截器（connectionGater）拒绝，无法与本节点建立连接。
+// 禁止列表保存在JSON文件中，节点重启后依然有效
+type BanManager struct {
+	mutex sync.Mutex
+	host  host.Host
+
+	path     string                 //禁止列表文件
+	duration time.Duration          //缺省的禁止时长
+	scores   map[peer.ID]*peerScore //各节点的不当行为分数
+	banned   map[peer.ID]*BanEntry  //被禁止的节点
+}
+
+// peerScore 随时间衰减的不当行为分数
+type peerScore struct {
+	value   float64
+	updated time.Time
+}
+
+// decayed 按半衰期衰减到now时的分数
+func (ps *peerScore) decayed(now time.Time) float64 {
+	return ps.value * math.Pow(0.5, float64(now.Sub(ps.updated))/float64(scoreHalfLife))
+}
+
+// NewBanManager 创建BanManager，并从文件中读取禁止列表
+func NewBanManager(path string, duration time.Duration) *BanManager {
+	if duration <= 0 {
+		duration = DefaultBanDuration
+	}
+	bm := &BanManager{
+		path:     path,
+		duration: duration,
+		scores:   map[peer.ID]*peerScore{},
+		banned:   map[peer.ID]*BanEntry{},
+	}
+
+	var entries []*BanEntry
+	if err := Load(path, &entries); err != nil {
+		if !os.IsNotExist(err) {
+			log.Warnf("读取禁止列表 %s 失败: %s", path, err)
+		}
+		return bm
+	}
+	for _, entry := range entries {
+		id, err := peer.Decode(entry.PeerID)
+		if err != nil || time.Now().After(entry.Until) {
+			continue
+		}
+		bm.banned[id] = entry
+	}
+	log.Infof("禁止列表中有 %d 个节点", len(bm.banned))
+	return bm
+}
+
+// banListPath 实例的禁止列表文件
+func banListPath(instanceId string) string {
+	if instanceId != "" {
+		return path.Join(Root, "tmp", fmt.Sprintf("banlist_%s.json", instanceId))
+	}
+	return path.Join(Root, "tmp", "banlist.json")
+}
+
+// SetHost 设置主机，用于断开被禁止的节点
+func (bm *BanManager) SetHost(h host.Host) {
+	bm.mutex.Lock()
+	defer bm.mutex.Unlock()
+
+	bm.host = h
+}
+
+// Misbehaving 增加节点的不当行为分数，达到BanThreshold时禁止该节点
+// 分数按scoreHalfLife衰减，已经衰减到不足1分的节点在这里移除
+func (bm *BanManager) Misbehaving(id peer.ID, score int, reason string) {
+	now := time.Now()
+	bm.mutex.Lock()
+	for other, ps := range bm.scores {
+		if other != id && ps.decayed(now) < 1 {
+			delete(bm.scores, other)
+		}
+	}
+	ps, ok := bm.scores[id]
+	if !ok {
+		ps = &peerScore{updated: now}
+		bm.scores[id] = ps
+	}
+	ps.value = ps.decayed(now) + float64(score)
+	ps.updated = now
+	total := int(ps.value)
+	bm.mutex.Unlock()
+
+	log.Warnf("节点 %s 的不当行为（%s），分数 +%d，当前 %d", ShortID(id), reason, score, total)
+	if total >= BanThreshold {
+		bm.Ban(id, 0, reason)
+	}
+}
+
+// Score 返回节点当前（衰减后）的不当行为分数
+func (bm *BanManager) Score(id peer.ID) int {
+	bm.mutex.Lock()
+	defer bm.mutex.Unlock()
+
+	ps, ok := bm.scores[id]
+	if !ok {
+		return 0
+	}
+	return int(ps.decayed(time.Now()))
+}
+
+// Ban 禁止节点，duration为0时使用缺省的禁止时长，并断开与该节点的连接
+func (bm *BanManager) Ban(id peer.ID, duration time.Duration, reason string) error {
+	if duration <= 0 {
+		duration = bm.duration
+	}
+
+	bm.mutex.Lock()
+	bm.banned[id] = &BanEntry{id.Pretty(), time.Now().Add(duration), reason}
+	delete(bm.scores, id)
+	err := bm.save()
+	h := bm.host
+	bm.mutex.Unlock()
+
+	log.Warnf("禁止节点 %s %s: %s", ShortID(id), duration, reason)
+	if h != nil {
+		h.Network().ClosePeer(id)
+	}
+	return err
+}
+
+// Unban 解除对节点的禁止
+func (bm *BanManager) Unban(id peer.ID) error {
+	bm.mutex.Lock()
+	defer bm.mutex.Unlock()
+
+	if _, ok := bm.banned[id]; !ok {
+		return ErrNotBanned
+	}
+	delete(bm.banned, id)
+	log.Infof("解除对节点 %s 的禁止", ShortID(id))
+	return bm.save()
+}
+
+// IsBanned 节点是否被禁止，过期的禁止在这里移除
+func (bm *BanManager) IsBanned(id peer.ID) bool {
+	bm.mutex.Lock()
+	defer bm.mutex.Unlock()
+
+	entry, ok := bm.banned[id]
+	if !ok {
+		return false
+	}
+	if time.Now().After(entry.Until) {
+		delete(bm.banned, id)
+		bm.save()
+		return false
+	}
+	return true
+}
+
+// List 返回禁止列表（按解除时间排序）
+func (bm *BanManager) List() []BanEntry {
+	bm.mutex.Lock()
+	defer bm.mutex.Unlock()
+
+	now := time.Now()
+	entries := []BanEntry{}
+	for _, entry := range bm.banned {
+		if now.Before(entry.Until) {
+			entries = append(entries, *entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Until.Before(entries[j].Until)
+	})
+	return entries
+}
+
+// save 将禁止列表写入文件，调用者需持有锁
+func (bm *BanManager) save() error {
+	if bm.path == "" {
+		return nil
+	}
+	entries := []*BanEntry{}
+	for _, entry := range bm.banned {
+		entries = append(entries, entry)
+	}
+	if err := os.MkdirAll(path.Dir(bm.path), 0755); err != nil {
+		return err
+	}
+	if err := Save(bm.path, entries); err != nil {
+		log.Errorf("保存禁止列表失败: %s", err)
+		return err
+	}
+	return nil
+}
+
+// misbehaving 记录消息发送者的不当行为：PeerError计入ReceivedFrom节点的分数，其它错误只记录日志
+// 通道消息的ReceivedFrom为转发该消息的节点，通道中的非法消息已被验证器拒绝，这里只处理通过验证但在处理时出错的消息
+func (net *Network) misbehaving(content *ChannelContent, err error) {
+	var peerErr *PeerError
+	if !errors.As(err, &peerErr) || content.ReceivedFrom == "" || net.Bans == nil {
+		log.Warnf("处理来自 %s 的消息失败: %s", content.SendFrom, err)
+		return
+	}
+	net.Bans.Misbehaving(content.ReceivedFrom, peerErr.Score, err.Error())
+}
@@ -5,11 +5,22 @@ import (
 	"encoding/json"
 
 	"github.com/libp2p/go-libp2p/core/peer"
+	log "github.com/sirupsen/logrus"
+
+	blockchain "linechain/core"
 
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
 )
 
-const ChannelBufSize = 128
+const (
+	ChannelBufSize = 128
+
+	// messageOverhead 消息中除区块或交易数据之外的开销（命令、SendFrom等字段以及编码开销）
+	messageOverhead = 4 * 1024
+	// MaxMessageSize 通道中单条消息的最大字节数
+	// 消息为JSON格式，Payload经过base64编码，体积约为原来的4/3
+	MaxMessageSize = (blockchain.MaxBlockSize+messageOverhead)*4/3 + messageOverhead
+)
 
 // Channel 的数据结构
 type Channel struct {
@@ -28,9 +39,28 @@ type ChannelContent struct {
 	SendFrom string
 	SendTo   string
 	Payload  []byte
+
+	//以下字段不参与编码，由接收方填写
+	ReceivedFrom peer.ID `json:"-"` //实际发来消息的节点（通道中为转发消息的节点，流中为对端节点），用于记录不当行为
+	Origin       peer.ID `json:"-"` //经过签名验证的消息发布者（通道中为最初发布消息的节点，流中与ReceivedFrom相同），用于速率限制
+	Direct       bool    `json:"-"` //是否是通过流直接收到的点对点消息
+}
+
+// rateLimitKey 速率限制按哪个节点计数：有签名的发布者时为发布者，否则为发来消息的节点
+func (content *ChannelContent) rateLimitKey() peer.ID {
+	if content.Origin != "" {
+		return content.Origin
+	}
+	return content.ReceivedFrom
 }
 
-func JoinChannel(ctx context.Context, pub *pubsub.PubSub, selfID peer.ID, channelName string, subscribe bool) (*Channel, error) {
+// JoinChannel 加入通道，chain为本地区块链，用于验证通道中的区块
+func JoinChannel(ctx context.Context, pub *pubsub.PubSub, selfID peer.ID, channelName string, subscribe bool, chain *blockchain.Blockchain) (*Channel, error) {
+	// 注册验证器，gossipsub在转发消息之前先验证，非法消息不再传播
+	if err := pub.RegisterTopicValidator(topicName(channelName), messageValidator(chain)); err != nil {
+		return nil, err
+	}
+
 	// 加入发布者，以便于其它节点发现并连接
 	// 所有类型的节点均可发布消息到订阅-发布系统中
 	topic, err := pub.Join(topicName(channelName))
@@ -105,6 +135,11 @@ func (channel *Channel) readLoop() {
 		if content.ReceivedFrom == channel.self {
 			continue
 		}
+		// 超出大小上限的消息在解码前直接丢弃
+		if len(content.Data) > MaxMessageSize {
+			log.Warnf("丢弃来自 %s 的超大消息: %d 字节", content.ReceivedFrom.Pretty(), len(content.Data))
+			continue
+		}
 
 		NewContent := new(ChannelContent)
 		//解析出消息的Data部分（结构与Publish函数创建的消息结构一致）
@@ -120,6 +155,8 @@ func (channel *Channel) readLoop() {
 		}
 
 		// 对于非定向消息（SendTo为空）或指定本channel接收到消息，则加入到该channel的消息队列中
+		NewContent.ReceivedFrom = content.ReceivedFrom
+		NewContent.Origin = content.GetFrom()
 		channel.Content <- NewContent
 	}
 }
@@ -27,9 +27,12 @@ type CLIUI struct {
 	MiningChannel    *Channel
 	FullNodesChannel *Channel
 	app              *tview.Application
-	peersList        *tview.TextView
+	peersList        *tview.TextView //各节点的高度和延迟
+	blocksView       *tview.TextView //最近的区块
+	statusView       *tview.TextView //同步进度、内存池和挖矿状态
 
 	hostWindow *tview.TextView
+	cmdWindow  *tview.TextView //斜杠命令的结果面板
 	inputCh    chan string   //带缓冲的通道，缓冲数量1
 	doneCh     chan struct{} //带缓冲的通道，缓冲数量32
 }
@@ -91,15 +94,44 @@ func NewCLIUI(generalChannel *Channel, miningChannel *Channel, fullNodesChannel
 	peersList.SetBorder(true)
 	peersList.SetTitle("Peers")
 
+	// 仪表盘：最近的区块、同步/内存池/挖矿状态
+	blocksView := tview.NewTextView()
+	blocksView.SetBorder(true)
+	blocksView.SetTitle("Blocks")
+
+	statusView := tview.NewTextView()
+	statusView.SetBorder(true)
+	statusView.SetTitle("Status")
+
+	// 斜杠命令（如 /peers、/block 1）的结果显示在命令面板中
+	cmdBox := tview.NewTextView()
+	cmdBox.SetDynamicColors(true)
+	cmdBox.SetBorder(true)
+	cmdBox.SetTitle("Commands (/help)")
+	cmdBox.SetChangedFunc(func() {
+		app.Draw()
+	})
+
+	sidePanel := tview.NewFlex().
+		SetDirection(tview.FlexRow).
+		AddItem(statusView, 0, 1, false).
+		AddItem(peersList, 0, 1, false)
+
 	chatPanel := tview.NewFlex().
 		AddItem(msgBox, 0, 1, false).
-		AddItem(peersList, 20, 1, false)
+		AddItem(sidePanel, 42, 1, false)
+
+	bottomPanel := tview.NewFlex().
+		AddItem(blocksView, 0, 1, false).
+		AddItem(cmdBox, 0, 1, false)
 
 	flex := tview.NewFlex().
 		SetDirection(tview.FlexRow).
-		AddItem(chatPanel, 0, 1, false)
+		AddItem(chatPanel, 0, 2, false).
+		AddItem(bottomPanel, 0, 1, false).
+		AddItem(input, 1, 1, true)
 
-	app.SetRoot(flex, true)
+	app.SetRoot(flex, true).SetFocus(input)
 
 	return &CLIUI{
 		GeneralChannel:   generalChannel,
@@ -107,52 +139,39 @@ func NewCLIUI(generalChannel *Channel, miningChannel *Channel, fullNodesChannel
 		FullNodesChannel: fullNodesChannel,
 		app:              app,
 		peersList:        peersList,
+		blocksView:       blocksView,
+		statusView:       statusView,
 		hostWindow:       msgBox,
+		cmdWindow:        cmdBox,
 		inputCh:          inputCh,
 		doneCh:           make(chan struct{}, 1),
 	}
 }
 
-// Run 在后台开启日志事件循环，然后为文本UI开启事件循环
+// Run 在后台开启日志事件循环（与其它事件循环一样，p2p网络停止时等待它结束），然后为文本UI开启事件循环
 func (ui *CLIUI) Run(net *Network) error {
-	go ui.handleEvents(net)
+	net.Engine.Observe(ui)
+	net.goLoop(func() { ui.handleEvents(net) })
 	defer ui.end()
 
 	return ui.app.Run()
 }
 
+// Stop 退出文字界面（如收到退出信号时）
+func (ui *CLIUI) Stop() {
+	ui.app.Stop()
+}
+
 // End表示事件循环正常退出
 func (ui *CLIUI) end() {
 	ui.doneCh <- struct{}{}
 }
 
-// refreshPeers 拉取当前在channel中的peer list，并显示peer id的最后八个字符在UI上
-func (ui *CLIUI) refreshPeers() {
-	peers := ui.GeneralChannel.ListPeers()
-	minerPeers := ui.MiningChannel.ListPeers()
-	idStrs := make([]string, len(peers))
-
-	for i, p := range peers {
-		peerId := strings.ToUpper(ShortID(p))
-		if len(minerPeers) != 0 {
-			isMiner := false
-			for _, minerPeer := range minerPeers {
-				if minerPeer == p {
-					isMiner = true
-					break
-				}
-			}
-			if isMiner {
-				idStrs[i] = "MINER: " + peerId
-			} else {
-				idStrs[i] = peerId
-			}
-		} else {
-			idStrs[i] = peerId
-		}
-	}
-
-	ui.peersList.SetText(strings.Join(idStrs, "\n"))
+// refreshDashboard 刷新仪表盘：最近的区块、同步/内存池/挖矿状态以及各节点的高度和延迟
+func (ui *CLIUI) refreshDashboard(d *dashboard) {
+	ui.blocksView.SetText(d.recentBlocks())
+	ui.statusView.SetText(d.status())
+	ui.peersList.SetText(d.peerTable())
 	ui.app.Draw()
 }
 
@@ -161,36 +180,16 @@ func (ui *CLIUI) displaySelfMessage(msg string) {
 	fmt.Fprintf(ui.hostWindow, "%s %s\n", prompt, msg)
 }
 
-// func (ui *CLIUI) displayContent(content *ChannelContent) {
-// 	prompt := withColor("green", fmt.Sprintf("<%s>:", strings.ToUpper(content.SendFrom)))
-// 	fmt.Fprintf(ui.hostWindow, "%s %s\n", prompt, content.Message)
-// }
-
-// HandleStream 真正处理来自全网发来的且可以处理的消息内容
-func (ui *CLIUI) HandleStream(net *Network, content *ChannelContent) {
-	// ui.displayContent(content)
-	if content.Payload != nil {
-		command := BytesToCmd(content.Payload[:commandLength])
-		log.Infof("Received  %s command \n", command)
-
-		switch command {
-		case "block":
-			net.HandleBlock(content)
-		case "inv":
-			net.HandleInv(content)
-		case "getblocks":
-			net.HandleGetBlocks(content)
-		case "getdata":
-			net.HandleGetData(content)
-		case "tx":
-			net.HandleTx(content)
-		case "gettxfrompool":
-			net.HandleGetTxFromPool(content)
-		case "version":
-			net.HandleVersion(content)
-		default:
-			log.Warn("Unknown Command")
-		}
+func (ui *CLIUI) displayContent(content *ChannelContent) {
+	prompt := withColor("green", fmt.Sprintf("<%s>:", strings.ToUpper(content.SendFrom)))
+	fmt.Fprintf(ui.hostWindow, "%s %s\n", prompt, content.Message)
+}
+
+// OnMessage 作为协议引擎的观察者，显示其它节点发来的文本消息
+// 协议消息由引擎处理，处理过程记录在日志中，日志显示在文字界面上
+func (ui *CLIUI) OnMessage(content *ChannelContent, command string, err error) {
+	if command == "" {
+		ui.displayContent(content)
 	}
 }
 
@@ -264,12 +263,12 @@ func (ui *CLIUI) readFromLogs(instanceId string) {
 	}
 }
 
-// handleEvents 运行一个事件循环，以将用户输入发送到channel中,并且显示从channel中接收到的消息。
-// 它也定期地在UI刷新peers list
-// 同时接收三个通道的消息并进行处理（注意三个通道消息接收后，处理函数相同，均为HandleStream）
+// handleEvents 运行一个事件循环，以将用户输入发送到channel中，并定期地在UI刷新仪表盘
+// 三个通道和点对点流的消息由协议引擎（Engine）处理，UI只作为观察者显示其它节点发来的文本消息
 func (ui *CLIUI) handleEvents(net *Network) {
-	peerRefreshTicker := time.NewTicker(time.Second)
-	defer peerRefreshTicker.Stop()
+	refreshTicker := time.NewTicker(dashboardRefresh)
+	defer refreshTicker.Stop()
+	dashboard := newDashboard(net)
 
 	go ui.readFromLogs(net.Blockchain.InstanceId)
 	log.Info("HOST ADDR: ", net.Host.Addrs())
@@ -277,24 +276,20 @@ func (ui *CLIUI) handleEvents(net *Network) {
 	for {
 		select {
 		case input := <-ui.inputCh:
+			//斜杠命令在命令面板中显示结果，其它输入作为文本消息发布
+			if strings.HasPrefix(input, "/") {
+				ui.runCommand(net, input)
+				continue
+			}
 			err := ui.GeneralChannel.Publish(input, nil, "") //未指定消息接收者，意味着所有节点均会收到
 			if err != nil {
 				log.Errorf("Publish error: %s", err)
 			}
 			ui.displaySelfMessage(input)
 
-		case <-peerRefreshTicker.C:
-			// 定期刷新peers list
-			ui.refreshPeers()
-
-		case m := <-ui.GeneralChannel.Content: //如果 GeneralChannel 收到消息
-			ui.HandleStream(net, m)
-
-		case m := <-ui.MiningChannel.Content: //如果 MiningChannel 收到消息
-			ui.HandleStream(net, m)
-
-		case m := <-ui.FullNodesChannel.Content: //如果 FullNodesChannel 收到消息
-			ui.HandleStream(net, m)
+		case <-refreshTicker.C:
+			// 定期刷新仪表盘
+			ui.refreshDashboard(dashboard)
 
 		case <-ui.GeneralChannel.ctx.Done():
 			return
@@ -305,6 +300,18 @@ func (ui *CLIUI) handleEvents(net *Network) {
 	}
 }
 
+// runCommand 执行斜杠命令，并在命令面板中显示结果
+func (ui *CLIUI) runCommand(net *Network, line string) {
+	fmt.Fprintf(ui.cmdWindow, "%s\n", withColor("yellow", "> "+line))
+	result, err := net.runTUICommand(line)
+	if err != nil {
+		fmt.Fprintf(ui.cmdWindow, "%s\n", withColor("red", tview.Escape(err.Error())))
+	} else {
+		fmt.Fprintf(ui.cmdWindow, "%s\n", tview.Escape(result))
+	}
+	ui.cmdWindow.ScrollToEnd()
+}
+
 // withColor 使用color tags封装字符串以显示在UI的消息文本框中
 func withColor(color, msg string) string {
 	return fmt.Sprintf("[%s]%s[-]", color, msg)
@@ -0,0 +1,299 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	mrand "math/rand"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	log "github.com/sirupsen/logrus"
+
+	blockchain "linechain/core"
+)
+
+// 紧凑区块（compact block）转发
+// 节点挖出或接受一个新的tip区块后，不再让对方下载完整区块，而是把区块头和每笔交易的短ID直接发给相连的节点；
+// 对方用内存池中的交易重建区块，只向发送者请求内存池中缺少的交易。挖矿交易不会在对方的内存池中，总是随紧凑区块一起发送。
+// 短ID冲突导致重建的区块MerkleRoot不一致时，改为下载完整区块。不支持紧凑区块的节点（协议版本低于3）仍然收到inv
+
+const (
+	compactBlocksVersion = 3  //支持紧凑区块的最低协议版本
+	maxPendingCompact    = 16 //等待缺失交易的紧凑区块数量上限
+)
+
+var ErrBadCompactBlock = errors.New("紧凑区块不合法")
+
+// partialBlock 正在用内存池重建的区块，missing为缺少的交易在区块中的位置
+type partialBlock struct {
+	header   *blockchain.BlockHeader
+	txs      []*blockchain.Transaction
+	missing  []int
+	from     peer.ID //紧凑区块的发送者，缺少的交易向它请求
+	sendFrom string
+	created  time.Time
+}
+
+// shortIDKey 短ID的密钥，由区块哈希和发送者选择的随机数得到，使攻击者无法预先构造短ID冲突的交易
+func shortIDKey(blockHash []byte, nonce uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], nonce)
+	key := sha256.Sum256(append(append([]byte{}, blockHash...), buf[:]...))
+	return key[:]
+}
+
+// shortTxID 交易的短ID：sha256(key + 交易ID)的前6个字节
+func shortTxID(key, txID []byte) uint64 {
+	h := sha256.Sum256(append(append([]byte{}, key...), txID...))
+	return binary.BigEndian.Uint64(h[:8]) >> 16
+}
+
+// newCmpctBlock 由完整区块构建紧凑区块
+func newCmpctBlock(sendFrom string, block *blockchain.Block) CmpctBlock {
+	cmpct := CmpctBlock{
+		SendFrom: sendFrom,
+		Header:   blockchain.EncodeHeader(&block.BlockHeader),
+		Nonce:    mrand.Uint64(),
+	}
+	key := shortIDKey(block.Hash, cmpct.Nonce)
+	for i, tx := range block.Transactions {
+		if tx.IsMinerTx() {
+			cmpct.Prefilled = append(cmpct.Prefilled, PrefilledTx{i, blockchain.EncodeTransaction(tx)})
+			continue
+		}
+		cmpct.ShortIDs = append(cmpct.ShortIDs, shortTxID(key, tx.ID))
+	}
+	return cmpct
+}
+
+// AnnounceBlock 将新的tip区块通知给相连的节点（except除外，即区块的来源节点）：
+// 支持紧凑区块的节点直接收到紧凑区块，其它节点收到inv
+func (net *Network) AnnounceBlock(block *blockchain.Block, except peer.ID) {
+	data := newCmpctBlock(net.Host.ID().Pretty(), block)
+	cmpct := append(CmdToBytes("cmpctblock"), encodeMessage(&data)...)
+
+	//只通知握手成功的节点，DHT等其它协议的节点不支持本协议
+	for _, info := range net.Peers.List() {
+		if info.PeerID == except.Pretty() {
+			continue
+		}
+		if info.Version >= compactBlocksVersion {
+			net.send(net.GeneralChannel, "发送 cmpctblock 命令", cmpct, info.PeerID)
+		} else {
+			net.SendInv(info.PeerID, "block", [][]byte{block.Hash})
+		}
+	}
+}
+
+func (net *Network) HandleCmpctBlock(content *ChannelContent) error {
+	var payload CmpctBlock
+	if err := decodePayload(content, &payload); err != nil {
+		return err
+	}
+
+	header, err := blockchain.DecodeHeader(payload.Header)
+	if err != nil {
+		return misbehavior(scoreMalformed, err)
+	}
+	if err := header.CheckProofOfWork(); err != nil {
+		return misbehavior(scoreInvalidBlock, err)
+	}
+	total := len(payload.ShortIDs) + len(payload.Prefilled)
+	if total == 0 || total > blockchain.MaxBlockTxs {
+		return misbehavior(scoreMalformed, fmt.Errorf("%w: %d 笔交易", ErrBadCompactBlock, total))
+	}
+
+	net.Peers.UpdateHeight(net.replyTo(content, payload.SendFrom), header.Height)
+
+	hash := header.Hash()
+	if net.Blockchain.HasBlock(hash) || net.Sync.Syncing() {
+		return nil
+	}
+	if !net.Blockchain.HasBlock(header.PrevHash) {
+		//本地缺少该区块之前的区块，说明对方的链更高，通过同步补全
+		log.Infof("紧凑区块 %x 的前一个区块不存在，开始同步", hash)
+		net.Sync.UpdatePeer(net.replyTo(content, payload.SendFrom), header.Height)
+		return nil
+	}
+
+	//先放入随区块发送的交易，其余位置按顺序对应短ID
+	txs := make([]*blockchain.Transaction, total)
+	last := -1
+	for _, pre := range payload.Prefilled {
+		if pre.Index <= last || pre.Index >= total {
+			return misbehavior(scoreMalformed, fmt.Errorf("%w: prefilled 位置 %d", ErrBadCompactBlock, pre.Index))
+		}
+		last = pre.Index
+		tx, err := blockchain.DecodeTransaction(pre.Tx)
+		if err != nil {
+			return misbehavior(scoreMalformed, err)
+		}
+		txs[pre.Index] = tx
+	}
+
+	//内存池中交易的短ID，同一短ID对应多笔交易时无法确定，当作缺少处理
+	key := shortIDKey(hash, payload.Nonce)
+	pool := map[uint64]*blockchain.Transaction{}
+	for _, tx := range memoryPool.Transactions() {
+		tx := tx
+		id := shortTxID(key, tx.ID)
+		if _, ok := pool[id]; ok {
+			pool[id] = nil
+			continue
+		}
+		pool[id] = &tx
+	}
+
+	partial := &partialBlock{
+		header:   header,
+		txs:      txs,
+		from:     content.ReceivedFrom,
+		sendFrom: net.replyTo(content, payload.SendFrom),
+		created:  time.Now(),
+	}
+	next := 0
+	for i := range txs {
+		if txs[i] != nil {
+			continue
+		}
+		if tx := pool[payload.ShortIDs[next]]; tx != nil {
+			txs[i] = tx
+		} else {
+			partial.missing = append(partial.missing, i)
+		}
+		next++
+	}
+
+	if len(partial.missing) == 0 {
+		log.Infof("用内存池重建了紧凑区块 %x（%d 笔交易）", hash, total)
+		return net.completeBlock(partial)
+	}
+
+	log.Infof("紧凑区块 %x 缺少 %d/%d 笔交易，向 %s 请求", hash, len(partial.missing), total, payload.SendFrom)
+	net.addPartial(hex.EncodeToString(hash), partial)
+	net.SendGetBlockTxn(net.replyTo(content, payload.SendFrom), hash, partial.missing)
+	return nil
+}
+
+// replyTo 回复的目标节点：通过流收到的消息回复流的对端节点
+func (net *Network) replyTo(content *ChannelContent, sendFrom string) string {
+	if content.ReceivedFrom != "" {
+		return content.ReceivedFrom.Pretty()
+	}
+	return sendFrom
+}
+
+// addPartial 记录等待缺失交易的区块，同时清除超时的区块
+func (net *Network) addPartial(key string, partial *partialBlock) {
+	net.compactMutex.Lock()
+	defer net.compactMutex.Unlock()
+
+	for k, p := range net.partials {
+		if time.Since(p.created) > blockRequestTimeout || len(net.partials) >= maxPendingCompact {
+			delete(net.partials, k)
+		}
+	}
+	net.partials[key] = partial
+}
+
+// takePartial 取出等待缺失交易的区块
+func (net *Network) takePartial(key string) (*partialBlock, bool) {
+	net.compactMutex.Lock()
+	defer net.compactMutex.Unlock()
+
+	partial, ok := net.partials[key]
+	delete(net.partials, key)
+	return partial, ok
+}
+
+// completeBlock 重建完成的区块：短ID冲突会使MerkleRoot不一致，这时改为下载完整区块
+func (net *Network) completeBlock(partial *partialBlock) error {
+	block := blockchain.NewBlock(partial.header, partial.txs)
+	if !bytes.Equal(block.MerkleRoot, block.HashTransactions()) {
+		log.Warnf("重建的区块 %x MerkleRoot不一致，下载完整区块", block.Hash)
+		peerId := partial.sendFrom
+		if partial.from != "" {
+			peerId = partial.from.Pretty()
+		}
+		net.SendGetData(peerId, "block", block.Hash)
+		return nil
+	}
+	if err := block.CheckSanity(); err != nil {
+		return misbehavior(scoreInvalidBlock, fmt.Errorf("区块 %x: %w", block.Hash, err))
+	}
+	if err := verifyBlockSignatures(block); err != nil {
+		return misbehavior(scoreInvalidBlock, fmt.Errorf("区块 %x: %w", block.Hash, err))
+	}
+	return net.acceptBlock(partial.sendFrom, partial.from, true, block)
+}
+
+// SendGetBlockTxn 向peerId节点请求区块中指定位置的交易
+func (net *Network) SendGetBlockTxn(peerId string, blockHash []byte, indexes []int) {
+	payload := encodeMessage(&GetBlockTxn{net.Host.ID().Pretty(), blockHash, indexes})
+	request := append(CmdToBytes("getblocktxn"), payload...)
+	net.send(net.GeneralChannel, "发送 getblocktxn 命令", request, peerId)
+}
+
+func (net *Network) HandleGetBlockTxn(content *ChannelContent) error {
+	var payload GetBlockTxn
+	if err := decodePayload(content, &payload); err != nil {
+		return err
+	}
+
+	block, err := net.Blockchain.GetBlock(payload.BlockHash)
+	if err != nil {
+		return nil
+	}
+	if len(payload.Indexes) > len(block.Transactions) {
+		return misbehavior(scoreMalformed, fmt.Errorf("%w: 请求 %d 笔交易", ErrBadCompactBlock, len(payload.Indexes)))
+	}
+	var txs [][]byte
+	for _, i := range payload.Indexes {
+		if i < 0 || i >= len(block.Transactions) {
+			return misbehavior(scoreMalformed, fmt.Errorf("%w: 交易位置 %d", ErrBadCompactBlock, i))
+		}
+		txs = append(txs, blockchain.EncodeTransaction(block.Transactions[i]))
+	}
+	net.SendBlockTxn(net.replyTo(content, payload.SendFrom), block.Hash, txs)
+	return nil
+}
+
+// SendBlockTxn 将区块中的交易发送给peerId节点
+func (net *Network) SendBlockTxn(peerId string, blockHash []byte, txs [][]byte) {
+	payload := encodeMessage(&BlockTxn{net.Host.ID().Pretty(), blockHash, txs})
+	request := append(CmdToBytes("blocktxn"), payload...)
+	net.send(net.GeneralChannel, "发送 blocktxn 命令", request, peerId)
+}
+
+func (net *Network) HandleBlockTxn(content *ChannelContent) error {
+	var payload BlockTxn
+	if err := decodePayload(content, &payload); err != nil {
+		return err
+	}
+
+	key := hex.EncodeToString(payload.BlockHash)
+	partial, ok := net.takePartial(key)
+	if !ok {
+		return misbehavior(scoreUnrequested, fmt.Errorf("未请求的区块交易 %x", payload.BlockHash))
+	}
+	if content.ReceivedFrom != partial.from {
+		net.addPartial(key, partial)
+		return misbehavior(scoreUnrequested, fmt.Errorf("未请求的区块交易 %x", payload.BlockHash))
+	}
+	if len(payload.Txs) != len(partial.missing) {
+		net.SendGetData(net.replyTo(content, partial.sendFrom), "block", payload.BlockHash)
+		return misbehavior(scoreMalformed, fmt.Errorf("%w: 区块 %x 的交易与请求不符", ErrBadCompactBlock, payload.BlockHash))
+	}
+	for i, data := range payload.Txs {
+		tx, err := blockchain.DecodeTransaction(data)
+		if err != nil {
+			return misbehavior(scoreMalformed, err)
+		}
+		partial.txs[partial.missing[i]] = tx
+	}
+	return net.completeBlock(partial)
+}
@@ -0,0 +1,145 @@
+package p2p
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
+	"github.com/libp2p/go-libp2p/p2p/net/connmgr"
+	"github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+	log "github.com/sirupsen/logrus"
+)
+
+// 连接数量和资源的限制
+// 连接管理器（connmgr）在连接数超过高水位时，按节点的标签分值断开连接，直到低水位；
+// 连接拦截器限制入站连接的数量，并限制同一IP段（IPv4的/16、IPv6的/32）的节点数量，使保留的节点分布在不同的网段中；
+// 资源管理器（rcmgr）限制流的数量和内存的使用
+const (
+	DefaultLowPeers   = 32 //连接数的低水位
+	DefaultHighPeers  = 96 //连接数的高水位
+	DefaultMaxInbound = 64 //入站连接数的上限
+
+	maxPeersPerGroup = 4                //同一IP段的节点数上限（本地地址和内网地址不限制）
+	connGracePeriod  = 30 * time.Second //新连接在该时间内不会被连接管理器断开
+
+	protectSync  = "sync"      //同步节点的保护标签
+	tagHandshake = "linechain" //完成版本握手的节点的标签
+	handshakeTag = 10          //完成版本握手的节点的标签分值，连接管理器优先断开没有握手的节点（如只用于DHT的节点）
+)
+
+// newConnManager 创建连接管理器，low、high为0时使用缺省值
+func newConnManager(low, high int) (*connmgr.BasicConnMgr, error) {
+	if low <= 0 {
+		low = DefaultLowPeers
+	}
+	if high <= 0 {
+		high = DefaultHighPeers
+	}
+	if high < low {
+		return nil, fmt.Errorf("连接数的高水位 %d 小于低水位 %d", high, low)
+	}
+	return connmgr.NewConnManager(low, high, connmgr.WithGracePeriod(connGracePeriod))
+}
+
+// newResourceManager 创建资源管理器：在libp2p缺省限制的基础上，限制入站连接数、流的数量和内存（MB），为0时使用缺省值
+func newResourceManager(maxInbound, maxStreams int, maxMemory int64) (network.ResourceManager, error) {
+	limits := rcmgr.DefaultLimits
+	libp2p.SetDefaultServiceLimits(&limits)
+	config := limits.AutoScale()
+
+	if maxInbound > 0 {
+		config.System.ConnsInbound = maxInbound
+	}
+	if maxStreams > 0 {
+		config.System.Streams = maxStreams
+		config.System.StreamsInbound = maxStreams
+		config.System.StreamsOutbound = maxStreams
+	}
+	if maxMemory > 0 {
+		config.System.Memory = maxMemory << 20
+	}
+	log.Infof("资源限制: 入站连接 %d，流 %d，内存 %d MB",
+		config.System.ConnsInbound, config.System.Streams, config.System.Memory>>20)
+	return rcmgr.NewResourceManager(rcmgr.NewFixedLimiter(config))
+}
+
+// connLimits 连接拦截器中的连接数量限制
+type connLimits struct {
+	host        host.Host
+	maxInbound  int
+	maxPerGroup int
+}
+
+// inbound 当前的入站连接数
+func (l *connLimits) inbound() int {
+	count := 0
+	for _, conn := range l.host.Network().Conns() {
+		if conn.Stat().Direction == network.DirInbound {
+			count++
+		}
+	}
+	return count
+}
+
+// groupPeers 除p以外已连接的、处于group网段的节点数
+func (l *connLimits) groupPeers(p peer.ID, group string) int {
+	peers := map[peer.ID]struct{}{}
+	for _, conn := range l.host.Network().Conns() {
+		remote := conn.RemotePeer()
+		if remote == p {
+			continue
+		}
+		if g, ok := addrGroup(conn.RemoteMultiaddr()); ok && g == group {
+			peers[remote] = struct{}{}
+		}
+	}
+	return len(peers)
+}
+
+// allowed 新连接是否在限制之内，已经连接的节点建立新连接时不受限制
+func (l *connLimits) allowed(dir network.Direction, p peer.ID, addr multiaddr.Multiaddr) bool {
+	if l == nil || l.host == nil || len(l.host.Network().ConnsToPeer(p)) > 0 {
+		return true
+	}
+	if dir == network.DirInbound && l.maxInbound > 0 && l.inbound() >= l.maxInbound {
+		log.Debugf("入站连接已达上限 %d，拒绝节点 %s", l.maxInbound, ShortID(p))
+		return false
+	}
+	if group, ok := addrGroup(addr); ok && l.groupPeers(p, group) >= l.maxPerGroup {
+		log.Debugf("网段 %s 的节点已达上限 %d，拒绝节点 %s", group, l.maxPerGroup, ShortID(p))
+		return false
+	}
+	return true
+}
+
+// addrGroup 地址所在的IP段：IPv4为/16，IPv6为/32；本地地址和内网地址不分组，返回false
+func addrGroup(addr multiaddr.Multiaddr) (string, bool) {
+	ip, err := manet.ToIP(addr)
+	if err != nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+		return "", false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(16, 32)), Mask: net.CIDRMask(16, 32)}).String(), true
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(32, 128)), Mask: net.CIDRMask(32, 128)}).String(), true
+}
+
+// protectPeer 保护节点的连接不被连接管理器断开
+func (net *Network) protectPeer(peerId string, tag string) {
+	if id, err := peer.Decode(peerId); err == nil {
+		net.Host.ConnManager().Protect(id, tag)
+	}
+}
+
+// unprotectPeer 取消对节点连接的保护
+func (net *Network) unprotectPeer(peerId string, tag string) {
+	if id, err := peer.Decode(peerId); err == nil {
+		net.Host.ConnManager().Unprotect(id, tag)
+	}
+}
@@ -0,0 +1,316 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
+	log "github.com/sirupsen/logrus"
+
+	blockchain "linechain/core"
+	"linechain/wallet"
+)
+
+// 文字界面的仪表盘：最近的区块、内存池和交易费分布、同步进度、矿工的算力以及各节点的高度和延迟
+
+const (
+	dashboardRefresh = 2 * time.Second  //仪表盘的刷新间隔
+	dashboardBlocks  = 10               //最近区块面板显示的区块数量
+	pingInterval     = 30 * time.Second //测量节点延迟的间隔
+	pingTimeout      = 10 * time.Second //单次测量延迟的超时时间
+	feeCachePerRound = 50               //每次刷新最多计算交易费的新交易数量（计算需要在区块链中查找引用的交易）
+)
+
+// feeBuckets 交易费分布的区间上限（不含），最后一个区间没有上限
+var feeBuckets = []float64{0, 0.001, 0.01, 0.1}
+
+// MiningStats 矿工的挖矿统计
+type MiningStats struct {
+	Blocks    int           //本节点挖出的区块数量
+	Attempts  int64         //挖出最近一个区块尝试的nonce数量
+	Elapsed   time.Duration //挖出最近一个区块的用时
+	Hashrate  float64       //挖出最近一个区块时的算力（哈希次数/秒）
+	LastBlock time.Time     //挖出最近一个区块的时间
+}
+
+// recordMined 记录挖出的区块：POW的nonce从0开始，尝试次数为Nonce+1
+func (net *Network) recordMined(block *blockchain.Block, elapsed time.Duration) {
+	net.statsMutex.Lock()
+	defer net.statsMutex.Unlock()
+
+	net.mining.Blocks++
+	net.mining.Attempts = int64(block.Nonce) + 1
+	net.mining.Elapsed = elapsed
+	net.mining.LastBlock = time.Now()
+	if elapsed > 0 {
+		net.mining.Hashrate = float64(net.mining.Attempts) / elapsed.Seconds()
+	}
+}
+
+// MiningStats 返回挖矿统计
+func (net *Network) MiningStats() MiningStats {
+	net.statsMutex.Lock()
+	defer net.statsMutex.Unlock()
+
+	return net.mining
+}
+
+// PingLoop 定期测量与握手成功的节点之间的延迟，结果由ping服务记录在Peerstore中（LatencyEWMA）
+func (net *Network) PingLoop() {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	ctx := net.GeneralChannel.ctx
+	for {
+		select {
+		case <-ticker.C:
+			for _, p := range net.Peers.List() {
+				id, err := peer.Decode(p.PeerID)
+				if err != nil {
+					continue
+				}
+				net.pingPeer(ctx, id)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (net *Network) pingPeer(ctx context.Context, id peer.ID) {
+	ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+
+	result := <-ping.Ping(ctx, net.Host, id)
+	if result.Error != nil {
+		log.Debugf("测量节点 %s 的延迟失败: %s", ShortID(id), result.Error)
+	}
+}
+
+// dashboard 仪表盘各面板的内容，缓存最近的区块和交易费，避免每次刷新都读取区块链
+type dashboard struct {
+	net *Network
+
+	lastHash []byte
+	blocks   string
+	fees     map[string]float64 //交易ID -> 交易费，只保留内存池中的交易
+}
+
+func newDashboard(net *Network) *dashboard {
+	return &dashboard{
+		net:  net,
+		fees: map[string]float64{},
+	}
+}
+
+// recentBlocks 最近的区块：高度、哈希、交易数量和矿工，只在主链的最新区块变化时重新读取
+func (d *dashboard) recentBlocks() string {
+	chain := d.net.Blockchain.ContinueBlockchain()
+	if d.blocks != "" && bytes.Equal(chain.LastHash, d.lastHash) {
+		return d.blocks
+	}
+
+	lines := []string{fmt.Sprintf("%-7s %-18s %-4s %s", "高度", "哈希", "交易", "矿工")}
+	iter := chain.Iterator()
+	for i := 0; iter != nil && i < dashboardBlocks; i++ {
+		block := iter.Next()
+		lines = append(lines, fmt.Sprintf("%-7d %-18s %-4d %s",
+			block.Height, shortHash(block.Hash), len(block.Transactions), blockMiner(block)))
+		if len(block.PrevHash) == 0 {
+			break
+		}
+	}
+	d.lastHash = chain.LastHash
+	d.blocks = strings.Join(lines, "\n")
+	return d.blocks
+}
+
+// blockMiner 区块的矿工地址（挖矿奖励交易的接收者）
+func blockMiner(block *blockchain.Block) string {
+	for _, tx := range block.Transactions {
+		if tx.IsMinerTx() && len(tx.Outputs) > 0 {
+			return wallet.AddressFromPubKeyHash(tx.Outputs[0].PubKeyHash)
+		}
+	}
+	return "-"
+}
+
+func shortHash(hash []byte) string {
+	s := hex.EncodeToString(hash)
+	if len(s) > 16 {
+		return s[:8] + ".." + s[len(s)-6:]
+	}
+	return s
+}
+
+// status 同步进度、内存池（交易数量和交易费分布）以及挖矿状态
+func (d *dashboard) status() string {
+	net := d.net
+	var lines []string
+
+	p := net.Sync.Progress()
+	if p.Syncing {
+		lines = append(lines, fmt.Sprintf("同步中 %d/%d（%.1f%%）", p.Height, p.TargetHeight, p.Percent))
+		lines = append(lines, fmt.Sprintf("区块头 %d  请求中 %d  剩余 %s", p.HeaderHeight, p.InFlight, formatETA(p.ETA)))
+	} else {
+		lines = append(lines, fmt.Sprintf("已同步  高度 %d  已知节点 %d", p.Height, p.Peers))
+	}
+
+	txs := memoryPool.Transactions()
+	lines = append(lines, "", fmt.Sprintf("内存池 %d 笔交易（挂起 %d）", len(txs), memoryPool.PendingCount()))
+	counts, unknown := d.feeHistogram(txs)
+	for i, count := range counts {
+		lines = append(lines, fmt.Sprintf("  %-14s %s %d", feeBucketLabel(i), histogramBar(count), count))
+	}
+	if unknown > 0 {
+		lines = append(lines, fmt.Sprintf("  %-14s %d", "未知", unknown))
+	}
+
+	if net.Miner {
+		stats := net.MiningStats()
+		state := "挖矿中"
+		if net.MiningPaused() {
+			state = "已暂停"
+		}
+		lines = append(lines, "", fmt.Sprintf("%s  已挖出 %d 个区块", state, stats.Blocks))
+		if stats.Blocks > 0 {
+			lines = append(lines, fmt.Sprintf("算力 %s  最近区块用时 %s", formatHashrate(stats.Hashrate), stats.Elapsed.Round(time.Millisecond)))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// feeHistogram 内存池交易的交易费分布，unknown为无法计算交易费的交易数量（如引用的交易不在区块链中）
+func (d *dashboard) feeHistogram(txs []blockchain.Transaction) (counts []int, unknown int) {
+	counts = make([]int, len(feeBuckets)+1)
+	chain := d.net.Blockchain.ContinueBlockchain()
+	pool := map[string]bool{}
+	computed := 0
+	for i := range txs {
+		id := hex.EncodeToString(txs[i].ID)
+		pool[id] = true
+		fee, ok := d.fees[id]
+		if !ok {
+			if computed >= feeCachePerRound {
+				unknown++
+				continue
+			}
+			computed++
+			if fee, ok = txFee(chain, &txs[i]); !ok {
+				fee = -1
+			}
+			d.fees[id] = fee
+		}
+		if fee < 0 {
+			unknown++
+			continue
+		}
+		counts[feeBucket(fee)]++
+	}
+	//清除已经离开内存池的交易
+	for id := range d.fees {
+		if !pool[id] {
+			delete(d.fees, id)
+		}
+	}
+	return counts, unknown
+}
+
+// txFee 交易费：输入引用的输出金额之和减去输出金额之和
+func txFee(chain *blockchain.Blockchain, tx *blockchain.Transaction) (float64, bool) {
+	if tx.IsMinerTx() {
+		return 0, true
+	}
+	fee := float64(0)
+	for _, in := range tx.Inputs {
+		prevTx, err := chain.FindTransaction(in.ID)
+		if err != nil || in.Out < 0 || in.Out >= len(prevTx.Outputs) {
+			return 0, false
+		}
+		fee += prevTx.Outputs[in.Out].Value
+	}
+	for _, out := range tx.Outputs {
+		fee -= out.Value
+	}
+	return fee, fee >= 0
+}
+
+func feeBucket(fee float64) int {
+	if fee == 0 {
+		return 0
+	}
+	for i := 1; i < len(feeBuckets); i++ {
+		if fee < feeBuckets[i] {
+			return i
+		}
+	}
+	return len(feeBuckets)
+}
+
+func feeBucketLabel(i int) string {
+	switch {
+	case i == 0:
+		return "无交易费"
+	case i < len(feeBuckets):
+		return fmt.Sprintf("< %g", feeBuckets[i])
+	default:
+		return fmt.Sprintf(">= %g", feeBuckets[len(feeBuckets)-1])
+	}
+}
+
+// histogramBar 交易费分布的柱形，最长20个字符
+func histogramBar(count int) string {
+	if count > 20 {
+		count = 20
+	}
+	return strings.Repeat("#", count)
+}
+
+func formatETA(seconds int64) string {
+	if seconds <= 0 {
+		return "未知"
+	}
+	return (time.Duration(seconds) * time.Second).String()
+}
+
+func formatHashrate(rate float64) string {
+	units := []string{"H/s", "KH/s", "MH/s", "GH/s"}
+	i := 0
+	for rate >= 1000 && i < len(units)-1 {
+		rate /= 1000
+		i++
+	}
+	return fmt.Sprintf("%.2f %s", rate, units[i])
+}
+
+// peerTable 各节点的高度和延迟（由PingLoop测量），按节点ID排序
+func (d *dashboard) peerTable() string {
+	peers := d.net.Peers.List()
+	if len(peers) == 0 {
+		return "没有握手成功的节点"
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].PeerID < peers[j].PeerID
+	})
+	lines := []string{fmt.Sprintf("%-9s %-7s %s", "节点", "高度", "延迟")}
+	for _, p := range peers {
+		latency := "-"
+		if id, err := peer.Decode(p.PeerID); err == nil {
+			if l := d.net.Host.Peerstore().LatencyEWMA(id); l > 0 {
+				latency = l.Round(time.Millisecond).String()
+			}
+			name := strings.ToUpper(ShortID(id))
+			if p.Services.Has(SFMiner) {
+				name += "*"
+			}
+			lines = append(lines, fmt.Sprintf("%-9s %-7d %s", name, p.BestHeight, latency))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
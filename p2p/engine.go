@@ -0,0 +1,155 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Handler 处理一种命令的消息，返回的不当行为错误（PeerError）计入发来消息的节点的分数
+type Handler func(content *ChannelContent) error
+
+// Observer 观察协议引擎处理的消息，如文字界面显示其它节点发来的文本消息
+// command为消息的命令，没有payload的文本消息为空；err为处理函数返回的错误
+type Observer interface {
+	OnMessage(content *ChannelContent, command string, err error)
+}
+
+// Engine 协议引擎：运行自己的事件循环，接收三个通道和点对点流的消息，按命令分派给注册的处理函数
+// 消息的处理不依赖文字界面，节点可以不运行UI而作为后台服务运行
+type Engine struct {
+	net *Network
+
+	mutex     sync.RWMutex
+	handlers  map[string]Handler
+	observers []Observer
+}
+
+// NewEngine 创建协议引擎，并注册全部协议命令的处理函数
+func NewEngine(net *Network) *Engine {
+	e := &Engine{
+		net:      net,
+		handlers: map[string]Handler{},
+	}
+	e.Register("block", net.HandleBlock)
+	e.Register("inv", net.HandleInv)
+	e.Register("getblocks", net.HandleGetBlocks)
+	e.Register("getheaders", net.HandleGetHeaders)
+	e.Register("headers", net.HandleHeaders)
+	e.Register("getdata", net.HandleGetData)
+	e.Register("tx", net.HandleTx)
+	e.Register("gettxfrompool", net.HandleGetTxFromPool)
+	e.Register("version", net.HandleVersion)
+	e.Register("cmpctblock", net.HandleCmpctBlock)
+	e.Register("getblocktxn", net.HandleGetBlockTxn)
+	e.Register("blocktxn", net.HandleBlockTxn)
+	return e
+}
+
+// Register 注册command命令的处理函数，已注册的处理函数被替换
+func (e *Engine) Register(command string, handler Handler) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.handlers[command] = handler
+}
+
+// Observe 添加消息的观察者
+func (e *Engine) Observe(observer Observer) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.observers = append(e.observers, observer)
+}
+
+func (e *Engine) handler(command string) (Handler, bool) {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	handler, ok := e.handlers[command]
+	return handler, ok
+}
+
+// notify 通知全部观察者
+func (e *Engine) notify(content *ChannelContent, command string, err error) {
+	e.mutex.RLock()
+	observers := e.observers
+	e.mutex.RUnlock()
+
+	for _, observer := range observers {
+		observer.OnMessage(content, command, err)
+	}
+}
+
+// Dispatch 检查消息的长度、大小和速率限制，再交给命令的处理函数
+// 处理函数返回的不当行为错误（PeerError）计入发来消息的节点的分数，分数达到上限的节点被禁止
+func (e *Engine) Dispatch(content *ChannelContent) {
+	net := e.net
+	//没有payload的文本消息（来自UI的输入）只通知观察者
+	if content.Payload == nil {
+		e.notify(content, "", nil)
+		return
+	}
+	if len(content.Payload) < commandLength {
+		net.misbehaving(content, misbehavior(scoreMalformed, errors.New("消息长度不足，无法解析命令")))
+		return
+	}
+	command := BytesToCmd(content.Payload[:commandLength])
+	log.Infof("Received  %s command \n", command)
+
+	//在解码payload之前检查大小，超出上限的消息直接丢弃
+	if len(content.Payload) > maxPayloadSize(command) {
+		net.misbehaving(content, misbehavior(scoreOversize, fmt.Errorf("超大的 %s 消息: %d 字节", command, len(content.Payload))))
+		return
+	}
+	receivedMessages.WithLabelValues(command).Inc()
+
+	//按节点、按命令的速率限制，超出限制的消息直接丢弃
+	//通道消息按最初发布消息的节点限制，否则诚实的转发节点会因为转发其它节点的消息被限制
+	if origin := content.rateLimitKey(); origin != "" && !net.Limiter.Allow(origin, command) {
+		return
+	}
+
+	var err error
+	if handler, ok := e.handler(command); ok {
+		err = handler(content)
+	} else {
+		err = misbehavior(scoreUnknownCommand, fmt.Errorf("未知命令 %s", command))
+	}
+	if err != nil {
+		net.misbehaving(content, err)
+	}
+	e.notify(content, command, err)
+}
+
+// Run 引擎的事件循环：同时接收三个通道和点对点流的消息并分派处理，直到节点退出
+func (e *Engine) Run() {
+	net := e.net
+	for {
+		select {
+		case m := <-net.GeneralChannel.Content: //如果 GeneralChannel 收到消息
+			e.dispatch(m)
+
+		case m := <-net.MiningChannel.Content: //如果 MiningChannel 收到消息
+			e.dispatch(m)
+
+		case m := <-net.FullNodesChannel.Content: //如果 FullNodesChannel 收到消息
+			e.dispatch(m)
+
+		case m := <-net.Direct: //如果其它节点通过流直接发来消息
+			e.dispatch(m)
+
+		case <-net.GeneralChannel.ctx.Done():
+			return
+		}
+	}
+}
+
+// dispatch 通道关闭时收到的nil消息直接忽略
+func (e *Engine) dispatch(content *ChannelContent) {
+	if content != nil {
+		e.Dispatch(content)
+	}
+}
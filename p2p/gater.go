@@ -0,0 +1,168 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/libp2p/go-libp2p/core/control"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	log "github.com/sirupsen/logrus"
+)
+
+var ErrNoAllowlist = errors.New("节点未启用白名单")
+
+// Allowlist 允许连接的节点白名单，用于联盟网络：只有白名单中的节点才能与本节点建立连接
+// 白名单文件为节点ID的JSON数组，可以在运行时重新加载（SIGHUP或RPC）
+type Allowlist struct {
+	mutex sync.RWMutex
+	path  string
+	peers map[peer.ID]struct{}
+}
+
+// NewAllowlist 从文件中读取白名单，path为空时不启用白名单，允许所有节点连接
+func NewAllowlist(path string) (*Allowlist, error) {
+	al := &Allowlist{path: path}
+	if path == "" {
+		return al, nil
+	}
+	if _, err := al.Reload(); err != nil {
+		return nil, err
+	}
+	return al, nil
+}
+
+// Enabled 是否启用了白名单
+func (al *Allowlist) Enabled() bool {
+	return al != nil && al.path != ""
+}
+
+// Reload 重新读取白名单文件，文件有误时保留原来的白名单，返回新的白名单中的节点
+func (al *Allowlist) Reload() ([]peer.ID, error) {
+	if !al.Enabled() {
+		return nil, ErrNoAllowlist
+	}
+
+	var ids []string
+	if err := Load(al.path, &ids); err != nil {
+		return nil, err
+	}
+	peers := map[peer.ID]struct{}{}
+	for _, s := range ids {
+		id, err := peer.Decode(s)
+		if err != nil {
+			return nil, err
+		}
+		peers[id] = struct{}{}
+	}
+
+	al.mutex.Lock()
+	al.peers = peers
+	al.mutex.Unlock()
+
+	log.Infof("白名单 %s 中有 %d 个节点", al.path, len(peers))
+	return al.Peers(), nil
+}
+
+// Allowed 节点是否允许连接，未启用白名单时允许所有节点
+func (al *Allowlist) Allowed(id peer.ID) bool {
+	if !al.Enabled() {
+		return true
+	}
+	al.mutex.RLock()
+	defer al.mutex.RUnlock()
+
+	_, ok := al.peers[id]
+	return ok
+}
+
+// Peers 返回白名单中的节点
+func (al *Allowlist) Peers() []peer.ID {
+	if !al.Enabled() {
+		return nil
+	}
+	al.mutex.RLock()
+	defer al.mutex.RUnlock()
+
+	ids := make([]peer.ID, 0, len(al.peers))
+	for id := range al.peers {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// DisconnectDisallowed 断开已连接的、不在白名单中的节点（重新加载白名单后调用）
+func (al *Allowlist) DisconnectDisallowed(h host.Host) {
+	for _, id := range h.Network().Peers() {
+		if !al.Allowed(id) {
+			log.Infof("节点 %s 不在白名单中，断开连接", ShortID(id))
+			h.Network().ClosePeer(id)
+		}
+	}
+}
+
+// ReloadAllowlist 重新加载白名单，并断开不在新白名单中的节点
+func (net *Network) ReloadAllowlist() ([]peer.ID, error) {
+	ids, err := net.Allowlist.Reload()
+	if err != nil {
+		return nil, err
+	}
+	net.Allowlist.DisconnectDisallowed(net.Host)
+	return ids, nil
+}
+
+// reloadAllowlistOnHUP 收到SIGHUP信号时重新加载白名单
+func (net *Network) reloadAllowlistOnHUP(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-hup:
+			if _, err := net.ReloadAllowlist(); err != nil {
+				log.Errorf("重新加载白名单失败: %s", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// connectionGater libp2p的连接拦截器：拒绝被禁止的节点、启用白名单时不在白名单中的节点，以及超出连接数量限制的节点
+type connectionGater struct {
+	bans      *BanManager
+	allowlist *Allowlist
+	limits    *connLimits
+}
+
+func (g *connectionGater) allowed(p peer.ID) bool {
+	return g.allowlist.Allowed(p) && !g.bans.IsBanned(p)
+}
+
+func (g *connectionGater) InterceptPeerDial(p peer.ID) bool {
+	return g.allowed(p)
+}
+
+func (g *connectionGater) InterceptAddrDial(p peer.ID, _ multiaddr.Multiaddr) bool {
+	return g.allowed(p)
+}
+
+// InterceptAccept 此时还不知道对方的节点ID，在InterceptSecured中检查
+func (g *connectionGater) InterceptAccept(network.ConnMultiaddrs) bool {
+	return true
+}
+
+func (g *connectionGater) InterceptSecured(dir network.Direction, p peer.ID, addrs network.ConnMultiaddrs) bool {
+	return g.allowed(p) && g.limits.allowed(dir, p, addrs.RemoteMultiaddr())
+}
+
+func (g *connectionGater) InterceptUpgraded(network.Conn) (bool, control.DisconnectReason) {
+	return true, 0
+}
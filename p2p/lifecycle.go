@@ -0,0 +1,167 @@
+package p2p
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+
+	log "github.com/sirupsen/logrus"
+
+	blockchain "linechain/core"
+	"linechain/util/lifecycle"
+)
+
+// 节点的生命周期：各子系统向生命周期管理器注册启动和停止回调，收到SIGINT或SIGTERM（或用户退出文字界面）时按依赖关系有序退出
+// 退出时内存池中的交易保存到文件，重启后重新验证并加载
+
+// mempoolPath 实例的内存池文件
+func mempoolPath(instanceId string) string {
+	if instanceId != "" {
+		return path.Join(Root, "tmp", fmt.Sprintf("mempool_%s.json", instanceId))
+	}
+	return path.Join(Root, "tmp", "mempool.json")
+}
+
+// saveMempool 将内存池中的交易保存到文件
+func (net *Network) saveMempool() error {
+	txs := memoryPool.Transactions()
+	if len(txs) == 0 {
+		return nil
+	}
+	encoded := make([][]byte, 0, len(txs))
+	for i := range txs {
+		encoded = append(encoded, txs[i].Serializer())
+	}
+	file := mempoolPath(net.Blockchain.InstanceId)
+	if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+		return err
+	}
+	if err := Save(file, encoded); err != nil {
+		return err
+	}
+	log.Infof("内存池中的 %d 笔交易已保存", len(encoded))
+	return nil
+}
+
+// loadMempool 读取上次退出时保存的内存池，重新验证后加入内存池并通知其它节点，读取后删除文件
+func (net *Network) loadMempool() {
+	file := mempoolPath(net.Blockchain.InstanceId)
+	var encoded [][]byte
+	if err := Load(file, &encoded); err != nil {
+		if !os.IsNotExist(err) {
+			log.Warnf("读取内存池文件 %s 失败: %s", file, err)
+		}
+		return
+	}
+	defer os.Remove(file)
+
+	count := 0
+	for _, data := range encoded {
+		tx, err := blockchain.DecodeTransaction(data)
+		if err != nil || tx.CheckSanity() != nil || !net.Blockchain.VerifyTransaction(tx) {
+			continue
+		}
+		net.acceptTx(tx, "")
+		count++
+	}
+	log.Infof("从内存池文件中恢复了 %d/%d 笔交易", count, len(encoded))
+}
+
+// registerHooks 注册节点各子系统的生命周期回调，依赖关系为：数据库 <- 内存池 <- p2p网络 <- 矿工
+// 退出时按相反的顺序停止：先停止挖矿，再停止p2p网络的事件循环并断开全部连接，然后保存内存池，最后关闭数据库
+func (net *Network) registerHooks(cancel context.CancelFunc) {
+	lc := net.Lifecycle
+	lc.Register(lifecycle.Hook{
+		Name: "db",
+		Stop: func(context.Context) error {
+			return net.Blockchain.Database.Close()
+		},
+	})
+	lc.Register(lifecycle.Hook{
+		Name:      "mempool",
+		DependsOn: []string{"db"},
+		Start: func(context.Context) error {
+			net.loadMempool()
+			return nil
+		},
+		Stop: func(context.Context) error {
+			return net.saveMempool()
+		},
+	})
+	lc.Register(lifecycle.Hook{
+		Name:      "p2p",
+		DependsOn: []string{"db", "mempool"},
+		Start: func(context.Context) error {
+			net.startLoops()
+			return nil
+		},
+		Stop: func(ctx context.Context) error {
+			cancel()
+			if err := net.waitLoops(ctx); err != nil {
+				return err
+			}
+			return net.Host.Close()
+		},
+	})
+	if net.Miner {
+		minerCtx, stopMiner := context.WithCancel(context.Background())
+		minerDone := make(chan struct{})
+		lc.Register(lifecycle.Hook{
+			Name:      "miner",
+			DependsOn: []string{"p2p", "mempool"},
+			Start: func(context.Context) error {
+				go func() {
+					defer close(minerDone)
+					net.MinersEventLoop(minerCtx)
+				}()
+				return nil
+			},
+			Stop: func(ctx context.Context) error {
+				stopMiner()
+				select {
+				case <-minerDone:
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			},
+		})
+	}
+}
+
+// startLoops 向全网请求区块信息，并启用协程，处理网络节点事件，运行协议引擎、区块同步管理器、交易转发和速率限制器
+func (net *Network) startLoops() {
+	RequestBlocks(net)
+
+	net.goLoop(func() { HandleEvents(net) })
+	net.goLoop(net.Engine.Run)
+	net.goLoop(net.Sync.Run)
+	net.goLoop(net.Relay.Run)
+	net.goLoop(net.Limiter.Run)
+	net.goLoop(net.PingLoop)
+}
+
+// goLoop 在协程中运行事件循环，退出时等待它结束
+func (net *Network) goLoop(loop func()) {
+	net.loops.Add(1)
+	go func() {
+		defer net.loops.Done()
+		loop()
+	}()
+}
+
+// waitLoops 等待全部事件循环结束
+func (net *Network) waitLoops(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		net.loops.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,51 @@
+package p2p
+
+import (
+	"context"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/discovery/mdns"
+	log "github.com/sirupsen/logrus"
+)
+
+// MdnsServiceName 局域网mDNS发现的服务名，只有服务名相同的节点才能相互发现
+const MdnsServiceName = "linechain-mdns"
+
+const mdnsConnectTimeout = 10 * time.Second //连接mDNS发现的节点的超时时间
+
+// mdnsNotifee 接收mDNS发现的节点，并与之建立连接
+type mdnsNotifee struct {
+	ctx  context.Context
+	host host.Host
+}
+
+// HandlePeerFound 由mDNS服务在发现节点时调用，在协程中连接，不阻塞mDNS的解析
+// 被禁止的节点由连接拦截器拒绝
+func (n *mdnsNotifee) HandlePeerFound(pi peer.AddrInfo) {
+	if pi.ID == n.host.ID() {
+		return //不连接自己
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(n.ctx, mdnsConnectTimeout)
+		defer cancel()
+
+		if err := n.host.Connect(ctx, pi); err != nil {
+			log.Warnf("连接mDNS发现的节点 %s 失败: %s", ShortID(pi.ID), err)
+			return
+		}
+		log.Info("已经连接到mDNS发现的节点:", pi)
+	}()
+}
+
+// SetupMDNS 启动局域网mDNS发现：同一局域网或同一台主机上的节点无需引导节点和互联网即可在数秒内相互发现
+// 返回的服务在节点退出时关闭
+func SetupMDNS(ctx context.Context, h host.Host) (mdns.Service, error) {
+	service := mdns.NewMdnsService(h, MdnsServiceName, &mdnsNotifee{ctx: ctx, host: h})
+	if err := service.Start(); err != nil {
+		return nil, err
+	}
+	log.Info("已启动mDNS局域网节点发现")
+	return service, nil
+}
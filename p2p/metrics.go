@@ -0,0 +1,56 @@
+package p2p
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+// 节点的Prometheus指标，通过 --metrics 指定的地址的 /metrics 路径导出
+var (
+	receivedMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "linechain",
+		Subsystem: "p2p",
+		Name:      "messages_received_total",
+		Help:      "按命令统计的收到的消息数",
+	}, []string{"command"})
+
+	rateLimitedMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "linechain",
+		Subsystem: "p2p",
+		Name:      "rate_limited_messages_total",
+		Help:      "按命令统计的超出速率限制而被丢弃的消息数",
+	}, []string{"command"})
+
+	rateLimitPenalties = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "linechain",
+		Subsystem: "p2p",
+		Name:      "rate_limit_penalties_total",
+		Help:      "因持续超出速率限制而计入不当行为分数的次数",
+	})
+
+	rateLimiterPeers = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "linechain",
+		Subsystem: "p2p",
+		Name:      "rate_limiter_peers",
+		Help:      "速率限制器中记录的节点数",
+	})
+)
+
+// StartMetrics 在addr上启动指标的HTTP服务，addr为空时不启动
+func StartMetrics(addr string) {
+	if addr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		log.Infof("指标服务监听在 %s/metrics", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Errorf("指标服务退出: %s", err)
+		}
+	}()
+}
@@ -3,12 +3,12 @@ package p2p
 import (
 	"bytes"
 	"context"
-	"crypto/rand"
-	"encoding/gob"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"io"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -17,7 +17,6 @@ import (
 	"github.com/multiformats/go-multiaddr"
 
 	dht "github.com/libp2p/go-libp2p-kad-dht"
-	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/peer"
 	mplex "github.com/libp2p/go-libp2p/p2p/muxer/mplex"
 	yamux "github.com/libp2p/go-libp2p/p2p/muxer/yamux"
@@ -28,17 +27,22 @@ import (
 
 	blockchain "linechain/core"
 	"linechain/memopool"
-	appUtils "linechain/util/utils"
+	"linechain/util/event"
+	"linechain/util/lifecycle"
 
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
 	"github.com/libp2p/go-libp2p/core/host"
 )
 
 const (
-	version       = 1
 	commandLength = 20 //命令长度为20个字节
 )
 
+const (
+	DefaultRendezvous = "rendezvous:wlsell.com" //缺省的节点发现会合点
+	PrivateDHTPrefix  = "/linechain"            //私有DHT的协议前缀，DHT协议为/linechain/kad/1.0.0
+)
+
 // 说明：以下很多由Network实例调用的方法，方法的实例net由startNode调用获得
 
 //定义全局变量
@@ -47,136 +51,276 @@ var (
 	MiningChannel    = "mining-channel"
 	FullNodesChannel = "fullnodes-channel"
 	MinerAddress     = ""
-	blocksInTransit  = [][]byte{}         //待交换中所有block的哈希（通过发送inv，获取的block可能有多个，可以先缓存于此）
 	memoryPool       = memopool.MemoPool{ //交易池
 		Pending: map[string]blockchain.Transaction{},
 		Queued:  map[string]blockchain.Transaction{},
-		Wg:      sync.WaitGroup{},
 	}
 )
 
-// SendBlock 将block发送给peerId节点（通过general通道，这个通道的消息所有节点均需要订阅）
-// 如果指定peerId，则只发给指定的节点；如果peerId为空，则发布给全网
+// SubscribePendingTxs 订阅新交易进入内存池的事件（memopool.NewTxEvent），如RPC服务的WebSocket订阅
+func SubscribePendingTxs(buffer int) *event.Subscription {
+	return memoryPool.Subscribe(buffer)
+}
+
+// maxPayloadSize 返回各命令payload（含命令头）的大小上限
+// 区块和交易以共识规则中的大小上限为准，inv可以携带大量哈希，其它命令只携带少量字段
+func maxPayloadSize(command string) int {
+	switch command {
+	case "block":
+		return commandLength + blockchain.MaxBlockSize + messageOverhead
+	case "tx":
+		return commandLength + blockchain.MaxTxSize + messageOverhead
+	case "inv":
+		return commandLength + blockchain.MaxBlockSize
+	case "getdata":
+		return commandLength + maxInvPerMsg*(hashLength+binary.MaxVarintLen32) + messageOverhead
+	case "headers":
+		return commandLength + maxHeadersPerMsg*maxHeaderSize + messageOverhead
+	case "cmpctblock", "blocktxn":
+		return commandLength + blockchain.MaxBlockSize + messageOverhead
+	case "getblocktxn":
+		return commandLength + blockchain.MaxBlockTxs*binary.MaxVarintLen32 + messageOverhead
+	default:
+		return commandLength + messageOverhead
+	}
+}
+
+// decodePayload 解码消息中命令之后的payload，无法解码时返回不当行为错误
+func decodePayload(content *ChannelContent, m wireMessage) error {
+	if err := decodeMessage(content.Payload[commandLength:], m); err != nil {
+		return misbehavior(scoreMalformed, err)
+	}
+	return nil
+}
+
+// SendBlock 将block发送给peerId节点
+// 如果指定peerId，则通过流只发给指定的节点；如果peerId为空，则通过general通道（所有节点均订阅）发布给全网
 func (net *Network) SendBlock(peerId string, b *blockchain.Block) {
 	data := Block{net.Host.ID().Pretty(), b.Serialize()}
-	payload := GobEncode(data)
+	payload := encodeMessage(&data)
 
 	//命令构成：cmd+payload，连接两个相同类型的切片，构成新切片
 	//slice = append(slice, anotherSlice...)
 	request := append(CmdToBytes("block"), payload...)
 
-	if peerId != "" {
-		net.GeneralChannel.Publish("发送 block 命令", request, peerId)
-	} else {
-		net.GeneralChannel.Publish("发送 block 命令", request, "")
-	}
+	net.send(net.GeneralChannel, "发送 block 命令", request, peerId)
 }
 
 //处理收到的block消息
-func (net *Network) HandleBlock(content *ChannelContent) {
-	var buff bytes.Buffer
+func (net *Network) HandleBlock(content *ChannelContent) error {
 	var payload Block
+	if err := decodePayload(content, &payload); err != nil {
+		return err
+	}
 
-	buff.Write(content.Payload[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-
+	block, err := blockchain.DecodeBlock(payload.Block)
 	if err != nil {
-		log.Panic(err)
+		return misbehavior(scoreMalformed, err)
 	}
 
-	blockData := payload.Block
-	block := blockchain.DeSerialize(blockData)
+	//不满足共识规则中大小限制的区块直接丢弃
+	if err := block.CheckSanity(); err != nil {
+		return misbehavior(scoreInvalidBlock, fmt.Errorf("区块 %x: %w", block.Hash, err))
+	}
+	if err := verifyBlockSignatures(block); err != nil {
+		return misbehavior(scoreInvalidBlock, fmt.Errorf("区块 %x: %w", block.Hash, err))
+	}
 
-	// fmt.Printf("Valid: %s\n", strconv.FormatBool(validate))
-	// 验证区块后再将其加入到区块链中
+	//通过流收到的区块必须是本节点请求过的，迟到的响应直接丢弃
+	if content.Direct {
+		switch net.takeRequested(block.Hash) {
+		case requestUnknown:
+			return misbehavior(scoreUnrequested, fmt.Errorf("未请求的区块 %x", block.Hash))
+		case requestLate:
+			return nil
+		}
+	}
+
+	//同步中请求的区块由同步管理器按顺序写入区块链
+	sendFrom := net.replyTo(content, payload.SendFrom)
+	net.Peers.UpdateHeight(sendFrom, block.Height)
+	if net.Sync.HandleBlock(sendFrom, block) {
+		return nil
+	}
+	return net.acceptBlock(sendFrom, content.ReceivedFrom, content.Direct, block)
+}
+
+// acceptBlock 验证不在同步中的新区块并加入区块链，区块成为新的tip时通知其它相连的节点
+// sendFrom为区块的发送者，from为发来区块的相连节点（通道中的区块为转发节点），
+// direct表示区块是否通过流直接发来，只有直接发来的区块验证失败时才记录from的不当行为
+func (net *Network) acceptBlock(sendFrom string, from peer.ID, direct bool, block *blockchain.Block) error {
+	if net.Blockchain.HasBlock(block.Hash) {
+		return nil
+	}
 
+	//没有前一个区块哈希的区块只能是本网络的创始区块，而创始区块已经在本地
+	if err := checkGenesis(block, net.GenesisHash); err != nil {
+		return contextMisbehavior(direct, scoreInvalidBlock, err)
+	}
+
+	// 验证区块后再将其加入到区块链中
 	if block.IsGenesis() {
 		net.Blockchain.AddBlock(block)
 	} else {
-		lastBlock, err := net.Blockchain.GetBlock(net.Blockchain.LastHash)
+		prevBlock, err := net.Blockchain.GetBlock(block.PrevHash)
 		if err != nil {
-			log.Info(err)
+			//本地缺少该区块之前的区块，说明对方的链更高，通过同步补全
+			log.Infof("区块 %x 的前一个区块不存在，开始同步", block.Hash)
+			net.Sync.UpdatePeer(sendFrom, block.Height)
+			return nil
 		}
 		log.Info(block.Height)
-		valid := block.IsBlockValid(lastBlock)
+		valid := block.IsBlockValid(prevBlock)
 		log.Info("Block validity:", strconv.FormatBool(valid))
-		if valid {
-			net.Blockchain.AddBlock(block)
+		if !valid {
+			//非法区块不再导致本节点退出，而是记录发送者的不当行为
+			return contextMisbehavior(direct, scoreInvalidBlock, fmt.Errorf("非法区块 %x，其 height 是: %d", block.Hash, block.Height))
+		}
+		//检查其中的交易引用的输出（沿区块自己的祖先查找），侧链上的区块也要检查，否则重组时会采用未经验证的交易
+		if err := net.Blockchain.VerifyBlockTransactions(block); err != nil {
+			return contextMisbehavior(direct, scoreInvalidBlock, fmt.Errorf("区块 %x: %w", block.Hash, err))
+		}
 
-			//从内存池中移除交易
-			for _, tx := range block.Transactions {
-				txID := hex.EncodeToString(tx.ID)
-				memoryPool.RemoveFromAll(txID)
-			}
-		} else {
-			log.Fatalf("发现一个非法区块，其 height 是: %d", block.Height)
+		oldHead := net.Blockchain.LastHash
+		net.Blockchain.AddBlock(block)
+		net.updateUTXO(oldHead, block)
 
-			//出现非法区块是非常严重的业务逻辑错误，程序需要终止执行
-			//同步调用CloseDB进行阻塞，等待程序强行终止信号，退出程序（不会继续执行本行代码之后的代码）
-			appUtils.CloseDB(net.Blockchain)
+		//新的tip到达，刷新矿工的区块模板
+		if net.Miner && bytes.Equal(net.Blockchain.LastHash, block.Hash) {
+			net.Template.Refresh(block)
 		}
 	}
 
-	if len(block.Transactions) > 0 {
-		for _, tx := range block.Transactions {
-			memoryPool.RemoveFromAll(hex.EncodeToString(tx.ID))
-		}
+	//从内存池中移除交易
+	for _, tx := range block.Transactions {
+		memoryPool.RemoveFromAll(hex.EncodeToString(tx.ID))
 	}
 
 	log.Infof("Added block %x \n", block.Hash)
-	log.Infof("Block in transit %d", len(blocksInTransit))
-
-	if len(blocksInTransit) > 0 {
-		//取出第一个待交换的block的hash
-		blockHash := blocksInTransit[0]
-		//发送getdata（block）命令，请求完整区块
-		net.SendGetData(payload.SendFrom, "block", blockHash)
-		//将此block的hash从待交换block hashes列表中移除
-		blocksInTransit = blocksInTransit[1:]
+
+	if bytes.Equal(net.Blockchain.LastHash, block.Hash) {
+		net.AnnounceBlock(block, from)
+	}
+	return nil
+}
+
+// updateUTXO 区块加入区块链后更新UTXO集合：区块连接在之前的最新区块之后时只应用该区块，
+// 主链切换到其它分支时重建UTXO集合，区块在侧链上时UTXO集合不变
+func (net *Network) updateUTXO(oldHead []byte, block *blockchain.Block) {
+	if !bytes.Equal(net.Blockchain.LastHash, block.Hash) {
+		return
+	}
+	UTXO := blockchain.UTXOSet{Blockchain: net.Blockchain}
+	if bytes.Equal(block.PrevHash, oldHead) {
+		UTXO.Update(block)
 	} else {
-		UTXO := blockchain.UTXOSet{Blockchain: net.Blockchain}
 		UTXO.Compute()
 	}
 }
-func (net *Network) SendGetData(peerId string, _type string, id []byte) {
-	payload := GobEncode(GetData{net.Host.ID().Pretty(), _type, id})
-	request := append(CmdToBytes("getdata"), payload...)
-	net.GeneralChannel.Publish("发送 getdata 命令", request, peerId)
+
+// SendGetData 向peerId节点请求区块或交易，多个ID合并在一条消息中，每条消息最多maxInvPerMsg个
+func (net *Network) SendGetData(peerId string, _type string, ids ...[]byte) {
+	for len(ids) > 0 {
+		n := len(ids)
+		if n > maxInvPerMsg {
+			n = maxInvPerMsg
+		}
+		net.markRequested(ids[:n]...)
+		payload := encodeMessage(&GetData{net.Host.ID().Pretty(), _type, ids[:n]})
+		request := append(CmdToBytes("getdata"), payload...)
+		net.send(net.GeneralChannel, "发送 getdata 命令", request, peerId)
+		ids = ids[n:]
+	}
+}
+
+// requestRecord 一次getdata请求的记录
+type requestRecord struct {
+	sent     time.Time //最近一次请求的时间
+	answered bool      //是否已经收到响应
 }
 
-func (net *Network) HandleGetData(content *ChannelContent) {
-	var buff bytes.Buffer
-	var payload GetData
+// 请求记录的状态，见takeRequested
+const (
+	requestUnknown  = iota //没有请求过，或者记录已经过期
+	requestExpected        //第一个响应
+	requestLate            //已经收到过响应：超时后改向其它节点请求时，原节点迟到的响应
+)
 
-	buff.Write(content.Payload[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
+// markRequested 记录向其它节点请求的区块或交易
+// 请求记录在超时之后再保留requestGrace，期间迟到或重复的响应直接丢弃，不计为不当行为；更早的记录在这里清除
+func (net *Network) markRequested(hashes ...[]byte) {
+	net.requestedMutex.Lock()
+	defer net.requestedMutex.Unlock()
 
-	if err != nil {
-		log.Panic(err)
+	now := time.Now()
+	for key, record := range net.requested {
+		if now.Sub(record.sent) > blockRequestTimeout+requestGrace {
+			delete(net.requested, key)
+		}
+	}
+	for _, hash := range hashes {
+		net.requested[hex.EncodeToString(hash)] = &requestRecord{sent: now}
+	}
+}
+
+// isRequested 是否在timeout之内请求过该区块或交易，并且还没有收到响应
+func (net *Network) isRequested(hash []byte, timeout time.Duration) bool {
+	net.requestedMutex.Lock()
+	defer net.requestedMutex.Unlock()
+
+	record, ok := net.requested[hex.EncodeToString(hash)]
+	return ok && !record.answered && time.Since(record.sent) < timeout
+}
+
+// takeRequested 区块或交易的响应是否是本节点请求过的，第一个响应将请求记为已响应
+func (net *Network) takeRequested(hash []byte) int {
+	net.requestedMutex.Lock()
+	defer net.requestedMutex.Unlock()
+
+	record, ok := net.requested[hex.EncodeToString(hash)]
+	if !ok {
+		return requestUnknown
+	}
+	if record.answered {
+		return requestLate
+	}
+	record.answered = true
+	return requestExpected
+}
+
+func (net *Network) HandleGetData(content *ChannelContent) error {
+	var payload GetData
+	if err := decodePayload(content, &payload); err != nil {
+		return err
+	}
+	if len(payload.Items) > maxInvPerMsg {
+		return misbehavior(scoreMalformed, fmt.Errorf("getdata 请求了 %d 项", len(payload.Items)))
 	}
+	peerId := net.replyTo(content, payload.SendFrom)
 
 	if payload.Type == "block" {
-		block, err := net.Blockchain.GetBlock([]byte(payload.ID))
-		if err != nil {
-			return
-		}
+		for _, hash := range payload.Items {
+			block, err := net.Blockchain.GetBlock(hash)
+			if err != nil {
+				continue
+			}
 
-		//将block发送给请求者（peerId）
-		net.SendBlock(payload.SendFrom, &block)
+			//将block发送给请求者（peerId）
+			net.SendBlock(peerId, &block)
+		}
 	}
 
 	if payload.Type == "tx" {
-		txID := hex.EncodeToString(payload.ID)
-		tx := memoryPool.Pending[txID]
-		if net.BelongsToMiningGroup(payload.SendFrom) {
-			memoryPool.Move(tx, "queued")
-			net.SendTxFromPool(payload.SendFrom, &tx)
-		} else {
-			net.SendTx(payload.SendFrom, &tx)
+		for _, txID := range payload.Items {
+			tx, ok := memoryPool.Find(hex.EncodeToString(txID))
+			if !ok {
+				continue
+			}
+			net.Relay.MarkKnown(content.ReceivedFrom, txID)
+			net.SendTx(peerId, &tx)
 		}
 	}
+	return nil
 }
 
 // SendInv 发送本地区块链拥有的交易或区块的清单（只有交易或区块的hash值），
@@ -185,239 +329,343 @@ func (net *Network) HandleGetData(content *ChannelContent) {
 // 一般情况下，在本地区块链的区块或交易发生新增后（特别是挖出新的区块后），发送Inv命令
 func (net *Network) SendInv(peerId string, _type string, items [][]byte) {
 	inventory := Inv{net.Host.ID().Pretty(), _type, items}
-	payload := GobEncode(inventory)
+	payload := encodeMessage(&inventory)
 	request := append(CmdToBytes("inv"), payload...)
-	net.GeneralChannel.Publish("发送 inv 命令", request, peerId)
+	net.send(net.GeneralChannel, "发送 inv 命令", request, peerId)
 }
 
-func (net *Network) HandleInv(content *ChannelContent) {
-	var buff bytes.Buffer
+func (net *Network) HandleInv(content *ChannelContent) error {
 	var payload Inv
-
-	buff.Write(content.Payload[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-
-	if err != nil {
-		log.Panic(err)
+	if err := decodePayload(content, &payload); err != nil {
+		return err
 	}
 	log.Infof("收到库存消息： %d %s \n", len(payload.Items), payload.Type)
 
 	if payload.Type == "block" {
-		if len(payload.Items) >= 1 {
-			//修复bug：应当请求 payload.Items 中所有的区块，而不是一个区块
-			for _, blockHash := range payload.Items {
-				net.SendGetData(payload.SendFrom, "block", blockHash) //请求一个完整区块
-				//检查下收到的block的hash是否存在于待交换列表blocksInTransit
-				for _, b := range blocksInTransit {
-					if !bytes.Equal(b, blockHash) {
-						blocksInTransit = append(blocksInTransit, b)
-					}
-				}
+		//同步中不单独请求区块，新的区块会由同步管理器下载
+		if net.Sync.Syncing() {
+			return nil
+		}
+		var missing [][]byte
+		for _, blockHash := range payload.Items {
+			if !net.Blockchain.HasBlock(blockHash) {
+				missing = append(missing, blockHash)
 			}
-		} else {
-			log.Info("区块哈希项为空")
 		}
+		net.SendGetData(net.replyTo(content, payload.SendFrom), "block", missing...) //请求完整区块
 	}
 
+	//只请求内存池中没有、最近没有验证失败、也没有正在向其它节点请求的交易
 	if payload.Type == "tx" {
-		if len(payload.Items) == 0 {
-			memoryPool.Wg.Done()
-		}
+		var wanted [][]byte
 		for _, txID := range payload.Items {
-			if memoryPool.Pending[hex.EncodeToString(txID)].ID == nil {
-				net.SendGetData(payload.SendFrom, "tx", txID)
+			net.Relay.MarkKnown(content.ReceivedFrom, txID)
+			if _, ok := memoryPool.Find(hex.EncodeToString(txID)); ok {
+				continue
+			}
+			if net.Relay.Rejected(txID) || net.isRequested(txID, txRequestTimeout) {
+				continue
 			}
+			wanted = append(wanted, txID)
 		}
+		net.SendGetData(net.replyTo(content, payload.SendFrom), "tx", wanted...)
 	}
+	return nil
 }
 
 func (net *Network) SendGetBlocks(peerId string, height int) {
-	payload := GobEncode(GetBlocks{net.Host.ID().Pretty(), height})
+	payload := encodeMessage(&GetBlocks{net.Host.ID().Pretty(), height})
 	request := append(CmdToBytes("getblocks"), payload...)
-	net.GeneralChannel.Publish("发送 getblocks 命令", request, peerId)
+	net.send(net.GeneralChannel, "发送 getblocks 命令", request, peerId)
 }
 
-func (net *Network) HandleGetBlocks(content *ChannelContent) {
-	var buff bytes.Buffer
+func (net *Network) HandleGetBlocks(content *ChannelContent) error {
 	var payload GetBlocks
-
-	buff.Write(content.Payload[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-
-	if err != nil {
-		log.Panic(err)
+	if err := decodePayload(content, &payload); err != nil {
+		return err
 	}
 
+	//按高度索引只读取请求高度之后的最多maxInvPerMsg个区块哈希，不从链尾遍历整条链
 	chain := net.Blockchain.ContinueBlockchain()
-	blockHashes := chain.GetBlockHashes(payload.Height)
+	blockHashes := chain.GetBlockHashesAfter(payload.Height, maxInvPerMsg)
 	log.Info("LENGTH:", len(blockHashes))
-	net.SendInv(payload.SendFrom, "block", blockHashes)
+	net.SendInv(net.replyTo(content, payload.SendFrom), "block", blockHashes)
+	return nil
 }
 
 func (net *Network) SendVersion(peer string) {
 	bestHeight := net.Blockchain.GetBestHeight()
-	payload := GobEncode(Version{
-		version,
+	payload := encodeMessage(&Version{
+		ProtocolVersion,
+		MinProtocolVersion,
+		net.NetworkID,
+		net.GenesisHash,
+		UserAgent,
+		net.Services,
 		bestHeight,
 		net.Host.ID().Pretty(),
 	})
 	request := append(CmdToBytes("version"), payload...)
-	net.GeneralChannel.Publish("发送 version 命令", request, peer)
+	net.send(net.GeneralChannel, "发送 version 命令", request, peer)
 }
 
-func (net *Network) HandleVersion(content *ChannelContent) {
-	var buff bytes.Buffer
+func (net *Network) HandleVersion(content *ChannelContent) error {
 	var payload Version
+	if err := decodePayload(content, &payload); err != nil {
+		return err
+	}
 
-	buff.Write(content.Payload[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
+	//version消息通过流直接发送，发送者必须是流的对端节点
+	if content.ReceivedFrom != "" && content.ReceivedFrom.Pretty() != payload.SendFrom {
+		return misbehavior(scoreMalformed, fmt.Errorf("version 消息的发送者 %s 与对端节点不符", payload.SendFrom))
+	}
 
+	negotiated, err := checkVersion(&payload, net.NetworkID, net.GenesisHash)
 	if err != nil {
-		log.Panic(err)
+		if id, e := peer.Decode(payload.SendFrom); e == nil {
+			net.disconnect(id, err)
+		}
+		return nil
+	}
+	isNew := net.Peers.Update(&PeerInfo{
+		PeerID:     payload.SendFrom,
+		Version:    negotiated,
+		UserAgent:  payload.UserAgent,
+		Services:   payload.Services,
+		BestHeight: payload.BestHeight,
+		Since:      time.Now(),
+	})
+	if isNew {
+		log.Infof("与节点 %s 握手成功: 协议版本 %d，%s，服务 %s",
+			payload.SendFrom, negotiated, payload.UserAgent, payload.Services)
+		//新节点通过交易清单得到内存池中已有的交易；连接管理器优先保留完成握手的节点
+		if id, err := peer.Decode(payload.SendFrom); err == nil {
+			net.Relay.QueueMempool(id)
+			net.Host.ConnManager().TagPeer(id, tagHandshake, handshakeTag)
+		}
 	}
 
 	bestHeight := net.Blockchain.GetBestHeight()
 	otherHeight := payload.BestHeight
 	log.Info("BEST HEIGHT: ", bestHeight, " OTHER HEIGHT:", otherHeight)
-	if bestHeight < otherHeight {
-		net.SendGetBlocks(payload.SendFrom, bestHeight)
-	} else if bestHeight > otherHeight {
+	//对方更高时由同步管理器开始区块头优先的同步
+	net.Sync.UpdatePeer(payload.SendFrom, otherHeight)
+	//新节点需要本节点的version完成握手；对方更低时告知本节点的高度
+	if isNew || bestHeight > otherHeight {
 		net.SendVersion(payload.SendFrom)
 	}
+	return nil
 }
 
-func (net *Network) SendTx(peerId string, transaction *blockchain.Transaction) {
-	memoryPool.Add(*transaction)
+// SendGetHeaders 向peerId节点请求区块定位器之后的区块头
+func (net *Network) SendGetHeaders(peerId string, locator [][]byte) {
+	payload := encodeMessage(&GetHeaders{net.Host.ID().Pretty(), locator})
+	request := append(CmdToBytes("getheaders"), payload...)
+	net.send(net.GeneralChannel, "发送 getheaders 命令", request, peerId)
+}
 
-	tnx := Tx{net.Host.ID().Pretty(), transaction.Serializer()}
-	payload := GobEncode(tnx)
-	request := append(CmdToBytes("tx"), payload...)
+func (net *Network) HandleGetHeaders(content *ChannelContent) error {
+	var payload GetHeaders
+	if err := decodePayload(content, &payload); err != nil {
+		return err
+	}
+	if len(payload.Locator) > maxLocatorHashes {
+		return misbehavior(scoreOversize, errors.New("getheaders 消息的定位器过长"))
+	}
 
-	// 给全节点通道发布此消息，全节点（FullNode）将进行处理
-	net.FullNodesChannel.Publish("发送 tx 命令", request, peerId)
+	headers := net.Blockchain.GetHeadersAfter(payload.Locator, maxHeadersPerMsg)
+	net.SendHeaders(net.replyTo(content, payload.SendFrom), headers)
+	return nil
 }
 
-func (net *Network) SendTxPoolInv(peerId string, _type string, items [][]byte) {
-	inventory := Inv{net.Host.ID().Pretty(), _type, items}
-	payload := GobEncode(inventory)
-	request := append(CmdToBytes("inv"), payload...)
-	// 给挖矿节点的通信通道发布此消息，挖矿节点将进行处理
-	net.MiningChannel.Publish("发送 tx 类型的 inv 命令", request, peerId)
+// SendHeaders 将区块头发送给peerId节点
+func (net *Network) SendHeaders(peerId string, headers []*blockchain.BlockHeader) {
+	data := Headers{SendFrom: net.Host.ID().Pretty()}
+	for _, header := range headers {
+		data.Headers = append(data.Headers, header.Serialize())
+	}
+	payload := encodeMessage(&data)
+	request := append(CmdToBytes("headers"), payload...)
+	net.send(net.GeneralChannel, "发送 headers 命令", request, peerId)
 }
 
-func (net *Network) SendTxFromPool(peerId string, transaction *blockchain.Transaction) {
+func (net *Network) HandleHeaders(content *ChannelContent) error {
+	var payload Headers
+	if err := decodePayload(content, &payload); err != nil {
+		return err
+	}
+	if len(payload.Headers) > maxHeadersPerMsg {
+		return misbehavior(scoreOversize, errors.New("headers 消息的区块头数量超出上限"))
+	}
 
+	var headers []*blockchain.BlockHeader
+	for _, data := range payload.Headers {
+		header, err := blockchain.DecodeHeader(data)
+		if err != nil {
+			return misbehavior(scoreMalformed, err)
+		}
+		headers = append(headers, header)
+	}
+
+	peerId := net.replyTo(content, payload.SendFrom)
+	if n := len(headers); n > 0 {
+		net.Peers.UpdateHeight(peerId, headers[n-1].Height)
+	}
+	if err := net.Sync.HandleHeaders(peerId, headers); err != nil {
+		if errors.Is(err, ErrUnexpectedHeaders) {
+			return misbehavior(scoreUnrequested, err)
+		}
+		if errors.Is(err, ErrHeightNotReached) {
+			return misbehavior(scoreFalseHeight, err)
+		}
+		return misbehavior(scoreInvalidHeaders, err)
+	}
+	return nil
+}
+
+// SendTx 将完整的交易发送给peerId节点（对getdata的响应），新交易通过TxRelay以inv清单通知其它节点
+func (net *Network) SendTx(peerId string, transaction *blockchain.Transaction) {
 	tnx := Tx{net.Host.ID().Pretty(), transaction.Serializer()}
-	payload := GobEncode(tnx)
+	payload := encodeMessage(&tnx)
 	request := append(CmdToBytes("tx"), payload...)
 
+	net.send(net.FullNodesChannel, "发送 tx 命令", request, peerId)
+}
+
+func (net *Network) SendTxPoolInv(peerId string, _type string, items [][]byte) {
+	inventory := Inv{net.Host.ID().Pretty(), _type, items}
+	payload := encodeMessage(&inventory)
+	request := append(CmdToBytes("inv"), payload...)
 	// 给挖矿节点的通信通道发布此消息，挖矿节点将进行处理
-	net.MiningChannel.Publish("发送 tx 命令", request, peerId)
+	net.send(net.MiningChannel, "发送 tx 类型的 inv 命令", request, peerId)
 }
 
-func (net *Network) HandleGetTxFromPool(content *ChannelContent) {
-	var buff bytes.Buffer
+func (net *Network) HandleGetTxFromPool(content *ChannelContent) error {
 	var payload TxFromPool
-
-	buff.Write(content.Payload[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-
-	if err != nil {
-		log.Panic(err)
+	if err := decodePayload(content, &payload); err != nil {
+		return err
 	}
 
-	if len(memoryPool.Pending) >= payload.Count { //如果挂起的交易数量达到指定的数量，交给挖矿节点挖矿
-		txs := memoryPool.GetTransactions(payload.Count)
-		net.SendTxPoolInv(payload.SendFrom, "tx", txs)
-	} else {
-		net.SendTxPoolInv(payload.SendFrom, "tx", [][]byte{})
+	//最多取出挂起交易队列中的 payload.Count 条交易，交给挖矿节点放入它的区块模板
+	//新版本的矿工通过交易清单得到交易，不再发送gettxfrompool，这里保留对旧版本矿工的支持
+	count := payload.Count
+	if count > maxTxsPerRequest {
+		count = maxTxsPerRequest
+	}
+	txs := memoryPool.GetTransactions(count)
+	if len(txs) > 0 {
+		net.SendTxPoolInv(net.replyTo(content, payload.SendFrom), "tx", txs)
 	}
+	return nil
 }
 
 // HandleTx 全节点和挖矿节点处理tx命令消息
-func (net *Network) HandleTx(content *ChannelContent) {
-	var buff bytes.Buffer
+func (net *Network) HandleTx(content *ChannelContent) error {
 	var payload Tx
+	if err := decodePayload(content, &payload); err != nil {
+		return err
+	}
 
-	buff.Write(content.Payload[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-
+	decoded, err := blockchain.DecodeTransaction(payload.Transaction)
 	if err != nil {
-		log.Panic(err)
+		return misbehavior(scoreMalformed, err)
+	}
+	tx := *decoded
+
+	//通过流收到的交易必须是本节点请求过的，迟到的响应直接丢弃
+	if content.Direct {
+		switch net.takeRequested(tx.ID) {
+		case requestUnknown:
+			return misbehavior(scoreUnrequested, fmt.Errorf("未请求的交易 %x", tx.ID))
+		case requestLate:
+			net.Relay.MarkKnown(content.ReceivedFrom, tx.ID)
+			return nil
+		}
+	}
+	net.Relay.MarkKnown(content.ReceivedFrom, tx.ID)
+	if _, ok := memoryPool.Find(hex.EncodeToString(tx.ID)); ok {
+		return nil
 	}
 
-	txData := payload.Transaction
-	tx := blockchain.DeserializeTransaction(txData)
+	//与链上状态无关的检查失败，说明交易是伪造的；引用的输出不存在等情况则可能只是本节点落后，不算不当行为
+	if err := tx.CheckSanity(); err != nil {
+		net.Relay.Reject(tx.ID)
+		return misbehavior(scoreInvalidTx, fmt.Errorf("交易 %x: %w", tx.ID, err))
+	}
+	if !tx.VerifySignatures() {
+		net.Relay.Reject(tx.ID)
+		return misbehavior(scoreInvalidTx, fmt.Errorf("交易 %x: %w", tx.ID, ErrInvalidSignature))
+	}
 
-	log.Infof("%s, %d", payload.SendFrom, len(memoryPool.Pending))
+	log.Infof("%s, %d", payload.SendFrom, memoryPool.PendingCount())
 	chain := net.Blockchain.ContinueBlockchain()
 
 	// 若是全节点，只负责验证交易，并将交易放到内存池中
-	// 若是挖矿节点负责挖矿
+	// 若是挖矿节点，将交易放入区块模板，由矿工事件循环统一打包挖矿
+	// 验证通过的交易以inv清单通知其它节点
+	//引用的输出不存在时交易可能只是在本节点之前，不记为非法交易，本节点追上后还可以再请求
 	if chain.VerifyTransaction(&tx) {
-		//如果tx来自本地节点，说明本地节点不是挖矿节点，也没有挖出它，就将它加入到Pending中，成为tx类型的inv，
-		//在其它节点请求tx时候，将本地tx发给对方处理
-		memoryPool.Add(tx)
-		if net.Miner { //当前节点为矿工节点
-			//将交易移到排队队列
-			memoryPool.Move(tx, "queued")
-			log.Info("MINING")
-			//立即挖出排队中的所有交易
-			net.MineTx(memoryPool.Queued)
-		}
+		net.acceptTx(&tx, content.ReceivedFrom)
+	} else {
+		log.Infof("交易 %x 未通过验证，暂不接受", tx.ID)
 	}
+	return nil
 }
-func (net *Network) MineTx(memopoolTxs map[string]blockchain.Transaction) {
+
+// MineTx 将区块模板中的交易打包挖出一个新区块
+func (net *Network) MineTx(templateTxs []*blockchain.Transaction) {
 	var txs []*blockchain.Transaction
-	log.Infof("挖矿的交易数: %d", len(memopoolTxs))
+	log.Infof("挖矿的交易数: %d", len(templateTxs))
 	chain := net.Blockchain.ContinueBlockchain()
 
-	for id := range memopoolTxs {
-		log.Infof("tx: %s \n", memopoolTxs[id].ID)
-		tx := memopoolTxs[id]
-
-		log.Info("tx校验: ", chain.VerifyTransaction(&tx))
-		if chain.VerifyTransaction(&tx) {
-			txs = append(txs, &tx)
+	var invalid [][]byte
+	for _, tx := range templateTxs {
+		if chain.VerifyTransaction(tx) {
+			txs = append(txs, tx)
+		} else {
+			log.Warnf("tx校验失败: %x", tx.ID)
+			invalid = append(invalid, tx.ID)
 		}
 	}
 
+	//验证失败的交易从模板和内存池中移除，否则模板一直处于可以打包的状态
+	if len(invalid) > 0 {
+		net.Template.Remove(invalid)
+		for _, id := range invalid {
+			memoryPool.RemoveFromAll(hex.EncodeToString(id))
+		}
+	}
 	if len(txs) == 0 {
 		log.Info("无合法的交易")
+		return
 	}
 
+	//挖矿交易必须是区块的第一笔交易
 	cbTx := blockchain.MinerTx(MinerAddress, "")
-	txs = append(txs, cbTx)
+	txs = append([]*blockchain.Transaction{cbTx}, txs...)
+	start := time.Now()
 	newBlock := chain.MineBlock(txs)
+	net.recordMined(newBlock, time.Since(start))
 	UTXOs := blockchain.UTXOSet{Blockchain: chain}
 	UTXOs.Compute()
 
-	log.Info("挖出新的区块")
+	log.Infof("挖出新的区块，包含 %d 笔交易", len(txs))
 
-	//peerId为空，SendInv发布给全网
-	net.SendInv("", "block", [][]byte{newBlock.Hash})
-	memoryPool.ClearAll() //清除内存池中的全部交易
-	memoryPool.Wg.Done()
-}
-
-func (net *Network) BelongsToMiningGroup(PeerId string) bool {
-	peers := net.MiningChannel.ListPeers()
-	for _, peer := range peers {
-		Id := peer.Pretty()
+	//将新区块以紧凑区块的形式通知相连的节点，各节点接受后继续转发
+	net.AnnounceBlock(newBlock, "")
 
-		if Id == PeerId {
-			return true
-		}
+	//只从内存池中清除已经打包的交易，模板以新区块为tip继续收集交易
+	for _, tx := range templateTxs {
+		memoryPool.RemoveFromAll(hex.EncodeToString(tx.ID))
 	}
+	net.Template.Refresh(newBlock)
+}
 
-	return false
+// BelongsToMiningGroup 节点是否是挖矿节点（根据节点握手时声明的服务）
+func (net *Network) BelongsToMiningGroup(PeerId string) bool {
+	return net.Peers.HasService(PeerId, SFMiner)
 }
-func (net *Network) MinersEventLoop(ui *CLIUI) {
+func (net *Network) MinersEventLoop(ctx context.Context) {
 	//秒定时器
 	poolCheckTicker := time.NewTicker(time.Second)
 	defer poolCheckTicker.Stop()
@@ -425,35 +673,47 @@ func (net *Network) MinersEventLoop(ui *CLIUI) {
 	for {
 		select {
 		case <-poolCheckTicker.C:
-			tnx := TxFromPool{net.Host.ID().Pretty(), 1} //每次取一条交易，可以优化为每次取多条交易
-			payload := GobEncode(tnx)
-			request := append(CmdToBytes("gettxfrompool"), payload...)
-			net.FullNodesChannel.Publish("内存池中交易 gettxfrompool 命令", request, "")
-			memoryPool.Wg.Add(1)
+			//新交易由其它节点以inv清单通知，收到后加入模板，不再轮询全节点的内存池
+			//模板中的交易已经稳定或模板已满，打包挖矿
+			if net.Template.Ready() && !net.MiningPaused() {
+				if !bytes.Equal(net.Template.PrevHash(), net.Blockchain.LastHash) {
+					//本地tip已变化（如通过rpc直接挖出了区块），先基于新的tip刷新模板
+					if tip, err := net.Blockchain.GetBlock(net.Blockchain.LastHash); err == nil {
+						net.Template.Refresh(&tip)
+					}
+				}
+				net.MineTx(net.Template.Transactions())
+			}
 
-		case <-ui.doneCh:
+		case <-ctx.Done():
 			return
 		}
 	}
 }
 
-// StartNode 启动一个节点
-func StartNode(chain *blockchain.Blockchain, listenPort, minerAddress string, miner, fullNode bool, callback func(*Network)) {
-	//Reader 是加密安全随机数生成器的全局共享实例
-	var r io.Reader = rand.Reader //没有指定seed，使用随机种子
-
-	MinerAddress = minerAddress
+// StartNode 启动一个节点，节点正常退出时返回nil
+func StartNode(chain *blockchain.Blockchain, cfg NodeConfig, callback func(*Network)) error {
+	MinerAddress = cfg.MinerAddress
+	networkId := cfg.NetworkID
+	if networkId == 0 {
+		networkId = DefaultNetworkID
+	}
+	listenPort, miner, fullNode := cfg.ListenPort, cfg.Miner, cfg.FullNode
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel() //释放相关资源
 
-	defer chain.Database.Close() //函数运行结束，关闭区块链数据库
-	go appUtils.CloseDB(chain)   //启动协程，遇到程序强行终止信号时关闭数据库，退出程序
-
-	// 为本主机（host）创建一对新的 RSA 密钥
-	// 一般情况下，是事先创建本机的密钥文件，然后调用LoadKeyFromFile来读取私钥
-	prvKey, _, err := crypto.GenerateKeyPairWithReader(crypto.RSA, 2048, r)
+	// 从密钥文件读取本主机（host）的私钥，文件不存在时生成新的密钥并保存，使节点重启后的peer ID不变
+	keyType, err := ParseKeyType(cfg.KeyType)
 	if err != nil {
-		panic(err)
+		log.Fatal(err)
+	}
+	nodeKey := cfg.NodeKey
+	if nodeKey == "" {
+		nodeKey = nodeKeyPath(chain.InstanceId)
+	}
+	prvKey, _, err := LoadKeyFromFile(nodeKey, keyType)
+	if err != nil {
+		log.Fatalf("读取节点密钥失败: %s", err)
 	}
 
 	//go-ws-transport：ws协议
@@ -466,9 +726,24 @@ func StartNode(chain *blockchain.Blockchain, listenPort, minerAddress string, mi
 	transports := libp2p.ChainOptions(
 		libp2p.Transport(tcp.NewTCPTransport), //支持TCP传输协议
 		libp2p.Transport(ws.New),              //支持websocket传输协议
-		libp2p.Transport(quic.NewTransport),   //支持quic传输协议
 	)
 
+	// 私有网络：所有连接在加密握手之前先用预共享密钥（PSK）加密，没有密钥的节点无法与本节点建立连接
+	// quic自带加密，不支持libp2p的私有网络，启用私有网络时不使用quic传输协议
+	privateNetwork := libp2p.ChainOptions()
+	if cfg.SwarmKey != "" {
+		psk, err := LoadSwarmKey(cfg.SwarmKey)
+		if err != nil {
+			log.Fatalf("读取私有网络密钥 %s 失败: %s", cfg.SwarmKey, err)
+		}
+		privateNetwork = libp2p.PrivateNetwork(psk)
+		log.Info("以私有网络方式运行")
+	} else {
+		transports = libp2p.ChainOptions(transports,
+			libp2p.Transport(quic.NewTransport), //支持quic传输协议
+		)
+	}
+
 	muxers := libp2p.ChainOptions(
 		libp2p.Muxer("/yamux/1.0.0", yamux.DefaultTransport), //支持"/yamux/1.0.0"流连接(基于可靠连接的多路I/O复用)
 		libp2p.Muxer("/mplex/6.7.0", mplex.DefaultTransport), //支持"/mplex/6.7.0"流连接（二进制流多路I/O复用），由LibP2P基于multiplex创建
@@ -495,6 +770,29 @@ func StartNode(chain *blockchain.Blockchain, listenPort, minerAddress string, mi
 	//-如果没有提供peer的identity，它产生一个随机RSA 2048键值对，并由它导出一个新的identity
 	//-如果没有提供peerstore，主机使用一个空的peerstore来进行初始化
 
+	// 被禁止的节点由连接拦截器（ConnectionGater）拒绝，禁止列表在重启后依然有效
+	// 启用白名单时，只有白名单中的节点可以连接
+	bans := NewBanManager(banListPath(chain.InstanceId), cfg.BanDuration)
+	allowlist, err := NewAllowlist(cfg.Allowlist)
+	if err != nil {
+		log.Fatalf("读取白名单 %s 失败: %s", cfg.Allowlist, err)
+	}
+
+	// 连接管理器将连接数保持在高低水位之间，资源管理器限制连接、流和内存
+	maxInbound := cfg.MaxInbound
+	if maxInbound <= 0 {
+		maxInbound = DefaultMaxInbound
+	}
+	connManager, err := newConnManager(cfg.LowPeers, cfg.HighPeers)
+	if err != nil {
+		log.Fatalf("创建连接管理器失败: %s", err)
+	}
+	resourceManager, err := newResourceManager(maxInbound, cfg.MaxStreams, cfg.MaxMemory)
+	if err != nil {
+		log.Fatalf("创建资源管理器失败: %s", err)
+	}
+	limits := &connLimits{maxInbound: maxInbound, maxPerGroup: maxPeersPerGroup}
+
 	host, err := libp2p.New(
 		//ctx,
 		transports,
@@ -503,10 +801,16 @@ func StartNode(chain *blockchain.Blockchain, listenPort, minerAddress string, mi
 		libp2p.Identity(prvKey),
 		libp2p.EnableNATService(),
 		libp2p.ForceReachabilityPublic(),
+		libp2p.ConnectionGater(&connectionGater{bans, allowlist, limits}),
+		libp2p.ConnectionManager(connManager),
+		libp2p.ResourceManager(resourceManager),
+		privateNetwork,
 	)
 	if err != nil {
 		panic(err)
 	}
+	bans.SetHost(host)
+	limits.host = host
 	for _, addr := range host.Addrs() {
 		fmt.Println("正在监听在", addr)
 	}
@@ -515,7 +819,12 @@ func StartNode(chain *blockchain.Blockchain, listenPort, minerAddress string, mi
 	// 2、使用GossipSub路由，创建一个新的基于Gossip 协议的 PubSub 服务系统
 	// 任何一个主机节点，都是一个订阅发布服务系统
 	// 这是整个区块链网络运行的关键所在
-	pubsub, err := pubsub.NewGossipSub(ctx, host)
+	// 启用节点评分，验证器拒绝的消息会降低发送者的分数，分数过低的节点被忽略
+	scoreParams, scoreThresholds := peerScoreParams(GeneralChannel, MiningChannel, FullNodesChannel)
+	pubsub, err := pubsub.NewGossipSub(ctx, host,
+		pubsub.WithMaxMessageSize(MaxMessageSize),
+		pubsub.WithPeerScore(scoreParams, scoreThresholds),
+	)
 	if err != nil {
 		panic(err)
 	}
@@ -528,31 +837,52 @@ func StartNode(chain *blockchain.Blockchain, listenPort, minerAddress string, mi
 	// 如果是全节点（fullNode==true），fullNodesChannel会接受到消息
 
 	//GeneralChannel 通道订阅消息
-	generalChannel, _ := JoinChannel(ctx, pubsub, host.ID(), GeneralChannel, true)
+	generalChannel, _ := JoinChannel(ctx, pubsub, host.ID(), GeneralChannel, true, chain)
 
 	//如果是挖矿节点， miningChannel 订阅消息，否则 miningChannel 不订阅消息
 	subscribe := false
 	if miner {
 		subscribe = true
 	}
-	miningChannel, _ := JoinChannel(ctx, pubsub, host.ID(), MiningChannel, subscribe)
+	miningChannel, _ := JoinChannel(ctx, pubsub, host.ID(), MiningChannel, subscribe, chain)
 
 	//如果是全节点， fullNodesChannel 订阅消息，否则 fullNodesChannel 不订阅消息
 	subscribe = false
 	if fullNode {
 		subscribe = true
 	}
-	fullNodesChannel, _ := JoinChannel(ctx, pubsub, host.ID(), FullNodesChannel, subscribe)
+	fullNodesChannel, _ := JoinChannel(ctx, pubsub, host.ID(), FullNodesChannel, subscribe, chain)
 
-	// 3、为各通信通道建立命令行界面对象，命令行监控来自三个通道的消息
-	ui := NewCLIUI(generalChannel, miningChannel, fullNodesChannel)
+	// 3、为各通信通道建立命令行界面对象，界面作为协议引擎的观察者显示通道中的文本消息
+	// 以后台服务方式运行时不使用文字界面
+	var ui *CLIUI
+	if !cfg.Headless {
+		ui = NewCLIUI(generalChannel, miningChannel, fullNodesChannel)
+	}
 
 	// 4、建立对等端（peer）发现机制（discovery），使得本节点可以被网络上的其它节点发现
 	// 同时将主机（host）连接到所有已经发现的对等端（peer）
-	var bootstraps []multiaddr.Multiaddr
-	err = SetupDiscovery(ctx, host, bootstraps)
-	if err != nil {
-		panic(err)
+	if cfg.NoDHT && !cfg.MDNS {
+		log.Warn("未启用任何节点发现方式，本节点只能等待其它节点连接")
+	}
+	// mDNS在后台发现局域网中的节点，先于DHT启动（DHT发现会阻塞到连接完引导节点和已发现的节点）
+	if cfg.MDNS {
+		mdnsService, err := SetupMDNS(ctx, host)
+		if err != nil {
+			log.Errorf("启动mDNS发现失败: %s", err)
+		} else {
+			defer mdnsService.Close()
+		}
+	}
+	if !cfg.NoDHT {
+		bootstraps, err := ParseBootNodes(cfg.BootNodes)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = SetupDiscovery(ctx, host, bootstraps, cfg.Rendezvous, cfg.PrivateDHT)
+		if err != nil {
+			panic(err)
+		}
 	}
 	network := &Network{
 		Host:             host,
@@ -560,36 +890,72 @@ func StartNode(chain *blockchain.Blockchain, listenPort, minerAddress string, mi
 		MiningChannel:    miningChannel,
 		FullNodesChannel: fullNodesChannel,
 		Blockchain:       chain,
+		Direct:           make(chan *ChannelContent, ChannelBufSize),
 		Blocks:           make(chan *blockchain.Block, 200),       //新Block数量不超过200个
 		Transactions:     make(chan *blockchain.Transaction, 200), //新Tansaction数量不超过200个
 		Miner:            miner,
+		Bans:             bans,
+		Allowlist:        allowlist,
+		Peers:            NewPeerRegistry(),
+		NetworkID:        networkId,
+		GenesisHash:      chain.GenesisHash(),
+		Services:         localServices(cfg),
+		requested:        map[string]*requestRecord{},
+		partials:         map[string]*partialBlock{},
+	}
+	network.Sync = NewSyncManager(network)
+	network.Relay = NewTxRelay(network)
+	network.Limiter = NewRateLimiter(network)
+	network.Engine = NewEngine(network)
+	StartMetrics(cfg.MetricsAddr)
+	host.Network().Notify(network.Peers.notifee())
+	if allowlist.Enabled() {
+		go network.reloadAllowlistOnHUP(ctx)
+	}
+	// 处理其它节点通过流直接发来的点对点消息
+	host.SetStreamHandler(SyncProtocol, network.handleStream)
+	if miner {
+		network.Template = NewBlockTemplate(maxTemplateWeight)
+		if tip, err := chain.GetBlock(chain.LastHash); err == nil {
+			network.Template.Refresh(&tip)
+		}
 	}
 
-	// 5、回调，将节点（network）实例传回
+	// 5、注册各子系统的生命周期回调（数据库、内存池、p2p网络、矿工），并回调，将节点（network）实例传回
+	// 回调中可以注册其它子系统（如RPC服务）
+	network.Lifecycle = lifecycle.New(lifecycle.DefaultTimeout)
+	network.registerHooks(cancel)
 	callback(network)
 
-	// 6、向全网请求区块信息，以补全本地区块链
-	// 每一个节点均有区块链的一个完整副本
-	err = RequestBlocks(network)
-
-	// 7、启用协程，处理网络节点事件
-	go HandleEvents(network)
-
-	// 8、如果是矿工节点，启用协程，不断发送ping命令给全节点
-	if miner {
-		// 矿工事件循环，以不断地发送一个 ping 给全节点，目的是得到新的交易，为新交易挖矿，并添加到区块链
-		go network.MinersEventLoop(ui)
+	// 6、按依赖顺序启动各子系统：恢复内存池，向全网请求区块信息，启用协程处理网络节点事件，运行协议引擎和区块同步管理器
+	// 如果是矿工节点，启用矿工事件循环，将区块模板中的交易打包挖矿
+	if err := network.Lifecycle.Start(ctx); err != nil {
+		return err
 	}
 
-	if err != nil {
-		panic(err)
+	// 7、运行UI界面，UI作为协议引擎的观察者，显示其它节点发来的文本消息
+	// 全网通道（generalChannel, miningChannel, fullNodesChannel）和点对点流的消息由协议引擎处理，不依赖UI
+	// 以后台服务方式运行时，阻塞到收到退出信号
+	if ui != nil {
+		go func() {
+			network.Lifecycle.Wait()
+			ui.Stop()
+		}()
+		if err = ui.Run(network); err != nil {
+			log.Errorf("运行文字UI发生错误: %s", err)
+		}
+	} else {
+		log.Info("节点以后台服务方式运行")
+		network.Lifecycle.Wait()
 	}
 
-	// 9、运行UI界面，将在Run函数体中启动协程，循环接收并处理全网通道publish的消息
-	//（包括generalChannel, miningChannel, fullNodesChannel通道）
-	if err = ui.Run(network); err != nil {
-		log.Error("运行文字UI发生错误: %s", err)
+	// 8、按与启动相反的顺序停止各子系统，最后关闭数据库
+	if err := network.Lifecycle.Stop(); err != nil {
+		log.Errorf("节点退出时发生错误: %s", err)
+		return err
 	}
+	log.Info("节点已退出")
+	return nil
 }
 
 // 这里只拦截处理Blocks和Transaction两个通道的消息，三个Channel通道消息这里不处理
@@ -600,32 +966,60 @@ func HandleEvents(net *Network) {
 	for {
 		select {
 		// mine := true
-		case block := <-net.Blocks: //如果 Blocks 队列新增数据（block数据），全网广播
-			net.SendBlock("", block)
+		case block := <-net.Blocks: //如果 Blocks 队列新增数据（block数据），以紧凑区块通知相连的节点
+			net.AnnounceBlock(block, "")
 		//mine := false
-		case tnx := <-net.Transactions: //如果 Transactions 队列新增数据（Transaction数据），全网广播
-			net.SendTx("", tnx)
+		case tnx := <-net.Transactions: //如果 Transactions 队列新增数据（Transaction数据），加入内存池并以inv清单通知其它节点
+			net.acceptTx(tnx, "")
+		case <-net.GeneralChannel.ctx.Done():
+			return
 		}
 	}
 }
 func RequestBlocks(net *Network) error {
 	// 列出 GerneralChannel 通道中已经连接的节点
 	peers := net.GeneralChannel.ListPeers()
-	// 发送 version 命令
-	if len(peers) > 0 {
-		net.SendVersion(peers[0].Pretty())
+	// 向所有节点发送 version 命令，同步管理器根据各节点的高度选择同步节点，并从多个节点下载区块
+	for _, peer := range peers {
+		net.SendVersion(peer.Pretty())
 	}
 	return nil
 }
 
+// ParseBootNodes 解析引导节点的multiaddr（必须包含/p2p/节点ID），同一节点的多个地址合并为一项
+func ParseBootNodes(addrs []string) ([]peer.AddrInfo, error) {
+	var maddrs []multiaddr.Multiaddr
+	for _, addr := range addrs {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		maddr, err := multiaddr.NewMultiaddr(addr)
+		if err != nil {
+			return nil, fmt.Errorf("非法的引导节点地址 %s: %w", addr, err)
+		}
+		maddrs = append(maddrs, maddr)
+	}
+	return peer.AddrInfosFromP2pAddrs(maddrs...)
+}
+
 // SetupDiscovery 建立发现机制，并将本地主机连接到所有已经发现的对等端（peer）
-func SetupDiscovery(ctx context.Context, host host.Host, bootstrapPeers []multiaddr.Multiaddr) error {
+// bootstrapPeers为空时，公共网络使用IPFS的公共引导节点，私有网络则不连接任何引导节点（本节点作为引导节点）；
+// private为true时使用私有的DHT协议（/linechain/kad/1.0.0），不会与IPFS的公共DHT互通，实验室中的离线节点也可以相互发现
+func SetupDiscovery(ctx context.Context, host host.Host, bootstrapPeers []peer.AddrInfo, rendezvous string, private bool) error {
+	if rendezvous == "" {
+		rendezvous = DefaultRendezvous
+	}
+
 	var options []dht.Option
 	//如果没有任何启动节点，本节点以server模式运行（作为启动节点）
 	if len(bootstrapPeers) == 0 {
 		//由于mode的值为int，因此缺省情况下为0，即节点运行模式为client
 		options = append(options, dht.Mode(dht.ModeServer))
 	}
+	if private {
+		options = append(options, dht.ProtocolPrefix(PrivateDHTPrefix), dht.BootstrapPeers(bootstrapPeers...))
+	}
 	// 开启一个DHT，用于对等端（peer）发现。
 	// DHT全称叫分布式哈希表(Distributed Hash Table)，是一种分布式存储方法。IpfsDHT是Kademlia算法的一个实现
 	// Kademlia算法是一种分布式存储及路由的算法
@@ -633,7 +1027,7 @@ func SetupDiscovery(ctx context.Context, host host.Host, bootstrapPeers []multia
 	// 以来，DHT的引导节点可以关闭，不会影响后续的对等端发现
 	kademliaDHT, err := dht.New(ctx, host, options...)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	//如果在startnode中创建本地缓存数据库，可以执行如下开启DHT的方式：
@@ -652,39 +1046,49 @@ func SetupDiscovery(ctx context.Context, host host.Host, bootstrapPeers []multia
 	// 引导DHT。在缺省设置下，这生成一个后台线程，每5分钟刷新对等端表格
 	log.Info("引导DHT")
 	if err = kademliaDHT.Bootstrap(ctx); err != nil {
-		panic(err)
+		return err
+	}
+
+	//未指定引导节点时，公共网络使用IPFS的公共引导节点
+	if len(bootstrapPeers) == 0 && !private {
+		for _, peerAddr := range dht.DefaultBootstrapPeers {
+			peerinfo, _ := peer.AddrInfoFromP2pAddr(peerAddr)
+			bootstrapPeers = append(bootstrapPeers, *peerinfo)
+		}
 	}
 
 	// 让我们首先连接到所有的引导节点（bootstrap nodes），它们会告诉我们网络中的其他节点
 	var wg sync.WaitGroup
-	for _, peerAddr := range dht.DefaultBootstrapPeers {
-		peerinfo, _ := peer.AddrInfoFromP2pAddr(peerAddr)
+	for _, peerinfo := range bootstrapPeers {
+		if peerinfo.ID == host.ID() {
+			continue
+		}
 		wg.Add(1)
 		//使用多个协程，加快连接处理
-		go func() {
+		go func(peerinfo peer.AddrInfo) {
 			defer wg.Done()
-			if err := host.Connect(ctx, *peerinfo); err != nil {
+			if err := host.Connect(ctx, peerinfo); err != nil {
 				log.Error(err)
 			} else {
-				log.Info("连接已建立，使用的引导节点是:", *peerinfo)
+				log.Info("连接已建立，使用的引导节点是:", peerinfo)
 			}
-		}()
+		}(peerinfo)
 	}
 	wg.Wait() //阻塞，确保所有的协程全部返回
 
-	// 我们使用一个会合点“wlsell.com”来宣布我们的位置
-	// 这就像告诉你的朋友在某个具体的地点会合
-	log.Info("宣布我们自己...")
+	// 我们使用一个会合点（缺省为“rendezvous:wlsell.com”）来宣布我们的位置
+	// 这就像告诉你的朋友在某个具体的地点会合，只有使用相同会合点的节点才能相互发现
+	log.Infof("在会合点 %s 宣布我们自己...", rendezvous)
 	routingDiscovery := discovery.NewRoutingDiscovery(kademliaDHT)
-	routingDiscovery.Advertise(ctx, "rendezvous:wlsell.com")
+	routingDiscovery.Advertise(ctx, rendezvous)
 	log.Info("成功宣布!")
 
 	// 现在，查找那些已经宣布的对等端
 	// 这就像你的朋友告诉你会合的地点
 	log.Info("搜索其它的对等端...")
-	peerChan, err := routingDiscovery.FindPeers(ctx, "rendezvous:wlsell.com")
+	peerChan, err := routingDiscovery.FindPeers(ctx, rendezvous)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	// 连接到所有新发现的对等端（peer）
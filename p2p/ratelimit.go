@@ -0,0 +1,170 @@
+package p2p
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	log "github.com/sirupsen/logrus"
+)
+
+// 按节点、按命令的消息速率限制
+// 每个节点的每种命令有一个令牌桶：令牌按rate每秒补充，最多积累burst个，每条消息消耗一个令牌，没有令牌的消息直接丢弃。
+// 回应本节点交易清单的getdata即使超出限制也会处理，不计为违规；
+// 超出限制的消息计入节点的违规次数（每分钟减半），违规次数达到violationsPerPenalty时，计入节点的不当行为分数，
+// 并降低连接管理器中该节点的标签分值，持续超出限制的节点最终会被断开或禁止
+const (
+	violationsPerPenalty = 20               //每多少次违规计一次不当行为分数
+	scoreRateLimit       = 10               //持续超出速率限制的不当行为分数
+	tagRateLimit         = "ratelimit"      //连接管理器中违规节点的标签
+	rateLimitTag         = -5               //每次计分时标签分值的变化
+	bucketIdleTimeout    = 10 * time.Minute //节点的令牌桶闲置该时间后被清除
+)
+
+// rateLimit 令牌桶的参数：每秒补充rate个令牌，最多积累burst个
+type rateLimit struct {
+	rate  float64
+	burst float64
+}
+
+// commandLimits 各命令的速率限制：遍历区块链或内存池的请求限制最严，区块和区块头的限制最宽松
+var commandLimits = map[string]rateLimit{
+	"getblocks":     {0.5, 5},
+	"getheaders":    {2, 10},
+	"getdata":       {10, 50},
+	"getblocktxn":   {5, 20},
+	"gettxfrompool": {0.5, 3},
+	"version":       {0.5, 5},
+	"inv":           {20, 100},
+	"tx":            {50, 200},
+	"block":         {20, 100},
+	"headers":       {5, 20},
+	"cmpctblock":    {5, 20},
+	"blocktxn":      {5, 20},
+}
+
+// defaultLimit 未列出的命令的速率限制
+var defaultLimit = rateLimit{1, 5}
+
+// tokenBucket 令牌桶
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take 按经过的时间补充令牌，再取出一个令牌，没有令牌时返回false
+func (b *tokenBucket) take(limit rateLimit, now time.Time) bool {
+	b.tokens += now.Sub(b.last).Seconds() * limit.rate
+	if b.tokens > limit.burst {
+		b.tokens = limit.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// peerBuckets 一个节点的令牌桶和违规次数
+type peerBuckets struct {
+	buckets    map[string]*tokenBucket
+	violations int
+	last       time.Time
+}
+
+// RateLimiter 按节点、按命令限制消息速率
+type RateLimiter struct {
+	mutex sync.Mutex
+	net   *Network
+	peers map[peer.ID]*peerBuckets
+}
+
+// NewRateLimiter 创建RateLimiter
+func NewRateLimiter(net *Network) *RateLimiter {
+	return &RateLimiter{
+		net:   net,
+		peers: map[peer.ID]*peerBuckets{},
+	}
+}
+
+// Allow 节点id的command消息是否在速率限制之内，超出限制时记录违规
+func (rl *RateLimiter) Allow(id peer.ID, command string) bool {
+	limit, ok := commandLimits[command]
+	if !ok {
+		limit = defaultLimit
+	}
+	now := time.Now()
+
+	rl.mutex.Lock()
+	pb, ok := rl.peers[id]
+	if !ok {
+		pb = &peerBuckets{buckets: map[string]*tokenBucket{}}
+		rl.peers[id] = pb
+	}
+	pb.last = now
+	bucket, ok := pb.buckets[command]
+	if !ok {
+		bucket = &tokenBucket{tokens: limit.burst, last: now}
+		pb.buckets[command] = bucket
+	}
+	if bucket.take(limit, now) {
+		rl.mutex.Unlock()
+		return true
+	}
+	rl.mutex.Unlock()
+
+	//回应本节点发出的交易清单的getdata不计为违规
+	if command == "getdata" && rl.net.Relay != nil && rl.net.Relay.TakeAnswer(id) {
+		return true
+	}
+
+	rl.mutex.Lock()
+	pb.violations++
+	penalty := pb.violations >= violationsPerPenalty
+	if penalty {
+		pb.violations = 0
+	}
+	rl.mutex.Unlock()
+
+	rateLimitedMessages.WithLabelValues(command).Inc()
+	log.Debugf("节点 %s 的 %s 消息超出速率限制", ShortID(id), command)
+	if penalty {
+		rateLimitPenalties.Inc()
+		rl.net.Host.ConnManager().UpsertTag(id, tagRateLimit, func(v int) int { return v + rateLimitTag })
+		if rl.net.Bans != nil {
+			rl.net.Bans.Misbehaving(id, scoreRateLimit, fmt.Sprintf("持续超出 %s 消息的速率限制", command))
+		}
+	}
+	return false
+}
+
+// prune 违规次数减半，并清除闲置节点的令牌桶
+func (rl *RateLimiter) prune() {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	for id, pb := range rl.peers {
+		pb.violations /= 2
+		if time.Since(pb.last) > bucketIdleTimeout {
+			delete(rl.peers, id)
+		}
+	}
+	rateLimiterPeers.Set(float64(len(rl.peers)))
+}
+
+// Run 每分钟衰减违规次数、清除闲置节点的令牌桶，直到节点退出
+func (rl *RateLimiter) Run() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			rl.prune()
+		case <-rl.net.GeneralChannel.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package p2p
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	log "github.com/sirupsen/logrus"
+)
+
+// SyncProtocol 点对点消息的libp2p流协议
+// 发给指定节点的请求和响应（getdata、block、getblocks、getheaders、headers、version、inv等）通过该协议直接发给对方，
+// 只有新区块、新交易这样需要全网广播的消息才通过pubsub的通道发布
+const SyncProtocol = protocol.ID("/linechain/sync/1.0.0")
+
+const (
+	streamTimeout = 30 * time.Second //打开流、读写一条消息的超时时间
+	frameHeader   = 4                //帧长度前缀的字节数
+)
+
+var ErrFrameTooLarge = errors.New("消息帧超出大小上限")
+
+// maxFrameSize 一条流消息（命令+payload）的大小上限，即所有命令中最大的payload上限（区块）
+func maxFrameSize() int {
+	return maxPayloadSize("block")
+}
+
+// 每条消息使用一个新的流，流中只有一个帧：4字节大端长度前缀 + 消息（命令+payload，与通道消息的Payload相同）
+func writeFrame(w io.Writer, data []byte) error {
+	var header [frameHeader]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(data)))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func readFrame(r io.Reader, maxSize int) ([]byte, error) {
+	var header [frameHeader]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	size := int(binary.BigEndian.Uint32(header[:]))
+	if size > maxSize {
+		return nil, fmt.Errorf("%w: %d 字节", ErrFrameTooLarge, size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// send 发送消息：peerId为空时发布到通道（全网广播），否则通过流直接发给peerId节点
+func (net *Network) send(channel *Channel, message string, request []byte, peerId string) {
+	if peerId == "" {
+		if err := channel.Publish(message, request, ""); err != nil {
+			log.Errorf("发布消息失败: %s", err)
+		}
+		return
+	}
+	net.SendDirect(peerId, message, request)
+}
+
+// SendDirect 通过流将消息直接发给peerId节点
+// 打开流需要时间，这里在协程中发送，不阻塞调用者
+func (net *Network) SendDirect(peerId string, message string, request []byte) {
+	id, err := peer.Decode(peerId)
+	if err != nil {
+		log.Warnf("%s: 非法的节点ID %s", message, peerId)
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), streamTimeout)
+		defer cancel()
+
+		s, err := net.Host.NewStream(ctx, id, SyncProtocol)
+		if err != nil {
+			log.Warnf("%s: 无法打开到 %s 的流: %s", message, ShortID(id), err)
+			return
+		}
+		defer s.Close()
+
+		s.SetWriteDeadline(time.Now().Add(streamTimeout))
+		if err := writeFrame(s, request); err != nil {
+			log.Warnf("%s: 发送到 %s 失败: %s", message, ShortID(id), err)
+			s.Reset()
+		}
+	}()
+}
+
+// handleStream 处理其它节点打开的流：读取一条消息，放入Direct消息队列，由事件循环统一处理
+// 消息的SendFrom为流的对端节点ID（完整的peerId），而不是消息中自称的发送者
+func (net *Network) handleStream(s network.Stream) {
+	defer s.Close()
+
+	s.SetReadDeadline(time.Now().Add(streamTimeout))
+	data, err := readFrame(s, maxFrameSize())
+	if err != nil {
+		log.Warnf("读取来自 %s 的流消息失败: %s", ShortID(s.Conn().RemotePeer()), err)
+		s.Reset()
+		if errors.Is(err, ErrFrameTooLarge) && net.Bans != nil {
+			net.Bans.Misbehaving(s.Conn().RemotePeer(), scoreOversize, err.Error())
+		}
+		return
+	}
+
+	content := &ChannelContent{
+		Message:      "stream",
+		SendFrom:     s.Conn().RemotePeer().Pretty(),
+		SendTo:       net.Host.ID().Pretty(),
+		Payload:      data,
+		ReceivedFrom: s.Conn().RemotePeer(),
+		Origin:       s.Conn().RemotePeer(),
+		Direct:       true,
+	}
+	select {
+	case net.Direct <- content:
+	case <-time.After(streamTimeout):
+		log.Warnf("消息队列已满，丢弃来自 %s 的流消息", ShortID(s.Conn().RemotePeer()))
+	}
+}
@@ -0,0 +1,591 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	blockchain "linechain/core"
+)
+
+const (
+	maxHeadersPerMsg         = 2000             //一条headers消息中区块头数量的上限
+	maxLocatorHashes         = 101              //区块定位器中哈希数量的上限
+	maxHeaderSize            = 256              //单个区块头在headers消息中的大小上限：线格式编码约105字节，加上4字节长度前缀，留有余量
+	maxBlocksInFlightPerPeer = 16               //每个节点同时请求中的区块数量上限
+	blockDownloadWindow      = 128              //下载窗口：只请求下一个待写入区块之后这么多个区块，限制缓存的区块数量
+	blockRequestTimeout      = 20 * time.Second //区块请求超时时间，超时后改为向其它节点请求
+	requestGrace             = 2 * time.Minute  //请求超时后请求记录保留的时间，期间迟到的响应不计为不当行为
+	headersRequestTimeout    = 30 * time.Second //区块头请求超时时间，超时后更换同步节点
+	maxBlockRetries          = 5                //单个区块的最大重试次数，超过后放弃本次同步，稍后重新开始
+	syncTickInterval         = time.Second
+	progressInterval         = 10 * time.Second //同步进度日志的输出间隔
+	versionInterval          = 30 * time.Second //空闲时重新向各节点发送version的间隔，以发现更高的链
+)
+
+var (
+	ErrUnexpectedHeaders = errors.New("收到的区块头不是来自当前的同步节点")
+	ErrHeadersNotConnect = errors.New("区块头无法连接到本地的区块头链")
+	ErrHeightNotReached  = errors.New("节点发送的区块头没有达到它声明的高度")
+)
+
+// blockRequest 一个正在请求中的区块
+type blockRequest struct {
+	peer     string
+	deadline time.Time
+}
+
+// SyncProgress 区块同步的进度
+type SyncProgress struct {
+	Syncing      bool    //是否正在同步
+	Height       int     //本地区块链的高度
+	HeaderHeight int     //已经验证的区块头链的高度
+	TargetHeight int     //已知节点中最高的区块高度
+	InFlight     int     //请求中的区块数量
+	Peers        int     //已知高度的节点数量
+	Percent      float64 //区块下载的完成百分比
+	ETA          int64   //按已同步区块的速度估算的剩余秒数，未同步或无法估算时为0
+}
+
+// SyncManager 区块头优先（headers-first）的初始区块下载
+//
+// 同步分两个阶段同时进行：
+//  1. 从一个同步节点（高度最高的节点）用区块定位器批量获取区块头（getheaders/headers），
+//     每个区块头都必须连接到前一个区块头并且POW合法，由此先得到一条验证过的区块头链；
+//  2. 按区块头链的顺序，从多个节点并行下载区块体（getdata/block），每个节点同时最多请求
+//     maxBlocksInFlightPerPeer个区块，请求超时后改为向其它节点请求；收到的区块缓存起来，按高度顺序写入区块链。
+//
+// 同步节点不响应时更换同步节点；单个区块重试过多时放弃本次同步，稍后从头开始。
+// 网络发送、写入区块链等I/O都在释放mutex之后进行：持有锁时产生的发送放入outbox，由unlock执行；
+// 按顺序就绪的区块放入ready，由一个协程在锁外依次写入区块链
+type SyncManager struct {
+	mutex sync.Mutex
+	net   *Network
+
+	peerHeights map[string]int //各节点（peerId）通过version或headers告知的最高区块高度
+
+	syncPeer         string //提供区块头的同步节点，为空表示没有在同步
+	headersRequested time.Time
+	headersDone      bool //同步节点已经发送完全部区块头
+	lastHeader       int  //同步节点本次发送的最高区块头的高度
+
+	//区块头请求尚未完成时被放弃的同步节点及放弃的时间，它迟到的headers直接丢弃，不计为不当行为
+	abandonedPeer string
+	abandonedAt   time.Time
+
+	headers  []*blockchain.BlockHeader //已经验证、区块体尚未写入区块链的区块头（按高度从低到高）
+	hashes   [][]byte                  //与headers一一对应的区块哈希
+	expected map[string]bool           //headers中的区块哈希
+
+	inFlight     map[string]*blockRequest     //请求中的区块
+	peerInFlight map[string]int               //各节点请求中的区块数量
+	retries      map[string]int               //各区块的重试次数
+	failedPeer   map[string]string            //各区块最近一次请求失败的节点，重试时避开该节点
+	received     map[string]*blockchain.Block //已经收到、尚未写入区块链的区块
+	ready        []*blockchain.Block          //按高度顺序就绪、等待写入区块链的区块
+	applying     bool                         //是否有协程正在写入ready中的区块
+
+	outbox []func() //持有锁期间产生的网络发送和其它I/O，释放锁之后执行
+
+	startTime    time.Time
+	startHeight  int
+	lastProgress time.Time
+	lastVersion  time.Time
+}
+
+// NewSyncManager 创建区块同步管理器
+func NewSyncManager(net *Network) *SyncManager {
+	s := &SyncManager{
+		net:         net,
+		peerHeights: map[string]int{},
+		lastVersion: time.Now(),
+	}
+	s.reset()
+	return s
+}
+
+// reset 清空本次同步的状态（保留已知的节点高度），并取消对同步节点连接的保护
+func (s *SyncManager) reset() {
+	if s.syncPeer != "" {
+		s.net.unprotectPeer(s.syncPeer, protectSync)
+		if !s.headersDone {
+			s.abandonedPeer, s.abandonedAt = s.syncPeer, time.Now()
+		}
+	}
+	s.syncPeer = ""
+	s.headersDone = false
+	s.lastHeader = 0
+	s.headers = nil
+	s.hashes = nil
+	s.expected = map[string]bool{}
+	s.inFlight = map[string]*blockRequest{}
+	s.peerInFlight = map[string]int{}
+	s.retries = map[string]int{}
+	s.failedPeer = map[string]string{}
+	s.received = map[string]*blockchain.Block{}
+	s.ready = nil
+}
+
+// later 持有锁时调用，fn在释放锁之后执行
+func (s *SyncManager) later(fn func()) {
+	s.outbox = append(s.outbox, fn)
+}
+
+// unlock 释放锁，然后执行持有锁期间产生的网络发送和其它I/O
+func (s *SyncManager) unlock() {
+	outbox := s.outbox
+	s.outbox = nil
+	s.mutex.Unlock()
+
+	for _, fn := range outbox {
+		fn()
+	}
+}
+
+// Syncing 是否正在同步
+func (s *SyncManager) Syncing() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.syncPeer != ""
+}
+
+// UpdatePeer 记录节点的最高区块高度，高于本地时开始同步
+func (s *SyncManager) UpdatePeer(peerId string, height int) {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	if height > s.peerHeights[peerId] {
+		s.peerHeights[peerId] = height
+	}
+	if s.syncPeer == "" && height > s.net.Blockchain.GetBestHeight() {
+		s.start(peerId)
+	}
+}
+
+// start 以peerId为同步节点开始同步，同步期间连接管理器不会断开与同步节点的连接
+func (s *SyncManager) start(peerId string) {
+	s.syncPeer = peerId
+	s.net.protectPeer(peerId, protectSync)
+	s.startTime = time.Now()
+	s.startHeight = s.net.Blockchain.GetBestHeight()
+	s.lastProgress = time.Now()
+	log.Infof("开始从 %s 同步区块，本地高度 %d，对方高度 %d", peerId, s.startHeight, s.peerHeights[peerId])
+	s.requestHeaders()
+}
+
+// requestHeaders 向同步节点请求区块头
+// 已经有待下载的区块头时，定位器以最后一个区块头开始，对方从它之后继续发送
+func (s *SyncManager) requestHeaders() {
+	locator := s.net.Blockchain.BlockLocator()
+	if len(s.hashes) > 0 {
+		locator = append([][]byte{s.hashes[len(s.hashes)-1]}, locator...)
+	}
+	if len(locator) > maxLocatorHashes {
+		locator = append(locator[:maxLocatorHashes-1], locator[len(locator)-1])
+	}
+	s.headersRequested = time.Now()
+	syncPeer := s.syncPeer
+	s.later(func() { s.net.SendGetHeaders(syncPeer, locator) })
+}
+
+// HandleHeaders 处理同步节点发来的区块头
+// 每个区块头都必须连接到前一个区块头（或本地已有的区块头）并且POW合法，否则丢弃整批区块头并更换同步节点；
+// 区块头发送完毕时，节点的高度以它实际发送的区块头为准，没有达到声明的高度时返回ErrHeightNotReached；
+// 请求超时等原因被放弃的同步节点迟到的区块头直接丢弃
+func (s *SyncManager) HandleHeaders(peerId string, headers []*blockchain.BlockHeader) error {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	if peerId != s.syncPeer {
+		if peerId == s.abandonedPeer && time.Since(s.abandonedAt) < requestGrace {
+			log.Infof("丢弃已放弃的同步节点 %s 迟到的区块头", peerId)
+			return nil
+		}
+		return ErrUnexpectedHeaders
+	}
+
+	for _, header := range headers {
+		prev, err := s.prevHeader(header)
+		if err != nil {
+			s.dropSyncPeer()
+			return err
+		}
+		if err := header.CheckConnects(prev); err != nil {
+			s.dropSyncPeer()
+			return fmt.Errorf("区块头 %d: %w", header.Height, err)
+		}
+		hash := header.Hash()
+		s.headers = append(s.headers, header)
+		s.hashes = append(s.hashes, hash)
+		s.expected[hex.EncodeToString(hash)] = true
+		s.lastHeader = header.Height
+	}
+
+	if n := len(s.headers); n > 0 && s.headers[n-1].Height > s.peerHeights[peerId] {
+		s.peerHeights[peerId] = s.headers[n-1].Height
+	}
+
+	var err error
+	if len(headers) == maxHeadersPerMsg {
+		s.requestHeaders()
+	} else {
+		s.headersDone = true
+		log.Infof("区块头同步完成，区块头链高度 %d", s.headerHeight())
+		delivered := s.lastHeader
+		if best := s.net.Blockchain.GetBestHeight(); delivered < best {
+			delivered = best
+		}
+		if claimed := s.peerHeights[peerId]; claimed > delivered {
+			//高度降为实际发送的区块头的高度，否则tick会不断地重新开始同步
+			s.peerHeights[peerId] = delivered
+			err = fmt.Errorf("%w: 声明 %d，实际 %d", ErrHeightNotReached, claimed, delivered)
+		}
+	}
+
+	s.schedule()
+	s.finishIfDone()
+	return err
+}
+
+// prevHeader 找到区块头的前一个区块头：待下载的最后一个区块头，或本地区块链中的区块头
+func (s *SyncManager) prevHeader(header *blockchain.BlockHeader) (*blockchain.BlockHeader, error) {
+	if n := len(s.headers); n > 0 {
+		if !bytes.Equal(header.PrevHash, s.hashes[n-1]) {
+			return nil, ErrHeadersNotConnect
+		}
+		return s.headers[n-1], nil
+	}
+	prev, err := s.net.Blockchain.GetHeader(header.PrevHash)
+	if err != nil {
+		return nil, ErrHeadersNotConnect
+	}
+	return prev, nil
+}
+
+// dropSyncPeer 同步节点发送了非法的区块头或不再响应，放弃本次同步，由下一次tick选择其它节点重新开始
+func (s *SyncManager) dropSyncPeer() {
+	log.Warnf("放弃同步节点 %s", s.syncPeer)
+	delete(s.peerHeights, s.syncPeer)
+	s.reset()
+}
+
+// HandleBlock 处理收到的区块
+// 区块是本次同步请求的区块时返回true，此时由同步管理器负责按顺序写入区块链；否则返回false
+func (s *SyncManager) HandleBlock(peerId string, block *blockchain.Block) bool {
+	s.mutex.Lock()
+
+	key := hex.EncodeToString(block.Hash)
+	if !s.expected[key] {
+		s.unlock()
+		return false
+	}
+	if req, ok := s.inFlight[key]; ok {
+		s.peerInFlight[req.peer]--
+		delete(s.inFlight, key)
+	}
+	s.received[key] = block
+
+	s.collectBlocks()
+	s.schedule()
+	s.unlock()
+
+	s.applyReady()
+	return true
+}
+
+// collectBlocks 将已经收到的区块按高度顺序移入ready，等待写入区块链
+func (s *SyncManager) collectBlocks() {
+	applied := 0
+	for applied < len(s.hashes) {
+		key := hex.EncodeToString(s.hashes[applied])
+		block, ok := s.received[key]
+		if !ok {
+			break
+		}
+		delete(s.received, key)
+
+		//区块哈希与区块头一致，区块头已经验证过，这里只需要检查区块体
+		if err := checkBlockBody(block); err != nil {
+			log.Warnf("节点发来的区块 %x 不合法: %s，重新请求", block.Hash, err)
+			s.retries[key]++
+			if s.retries[key] > maxBlockRetries {
+				log.Warnf("区块 %s 重试次数过多，放弃本次同步", key)
+				s.reset()
+				return
+			}
+			break
+		}
+
+		s.ready = append(s.ready, block)
+		delete(s.expected, key)
+		delete(s.retries, key)
+		delete(s.failedPeer, key)
+		applied++
+	}
+
+	s.headers = s.headers[applied:]
+	s.hashes = s.hashes[applied:]
+}
+
+// applyReady 在锁外将ready中的区块依次写入区块链
+// 同一时刻只有一个协程写入，其它协程就绪的区块由它继续写入，从而保证按高度顺序写入
+func (s *SyncManager) applyReady() {
+	s.mutex.Lock()
+	if s.applying {
+		s.unlock()
+		return
+	}
+	s.applying = true
+	for len(s.ready) > 0 {
+		ready := s.ready
+		s.ready = nil
+		s.unlock()
+
+		err := s.writeBlocks(ready)
+
+		s.mutex.Lock()
+		if err != nil {
+			//区块哈希由区块头确定，向其它节点重新请求也只能得到同样的区块，放弃本次同步
+			log.Warnf("同步的区块不合法: %s，放弃本次同步", err)
+			s.reset()
+		}
+	}
+	s.applying = false
+	s.finishIfDone()
+	s.unlock()
+}
+
+// writeBlocks 检查区块中交易引用的输出（沿区块自己的祖先查找，侧链上的区块同样检查），然后写入区块链并更新UTXO集合
+// UTXO集合随每个写入的区块更新，同步中途放弃或重新开始时，UTXO集合仍与区块链的最新区块一致
+func (s *SyncManager) writeBlocks(blocks []*blockchain.Block) error {
+	for _, block := range blocks {
+		if err := s.net.Blockchain.VerifyBlockTransactions(block); err != nil {
+			return fmt.Errorf("区块 %x: %w", block.Hash, err)
+		}
+		oldHead := s.net.Blockchain.LastHash
+		s.net.Blockchain.AddBlock(block)
+		s.net.updateUTXO(oldHead, block)
+		for _, tx := range block.Transactions {
+			memoryPool.RemoveFromAll(hex.EncodeToString(tx.ID))
+		}
+	}
+	return nil
+}
+
+// checkBlockBody 检查区块体满足共识规则中的大小限制，与区块头中的MerkleRoot一致，并且交易的签名合法
+func checkBlockBody(block *blockchain.Block) error {
+	if err := block.CheckSanity(); err != nil {
+		return err
+	}
+	if !bytes.Equal(block.MerkleRoot, block.HashTransactions()) {
+		return blockchain.ErrBadMerkleRoot
+	}
+	return verifyBlockSignatures(block)
+}
+
+// schedule 在下载窗口内，把尚未请求的区块分配给请求数量最少的节点
+func (s *SyncManager) schedule() {
+	for i := 0; i < len(s.hashes) && i < blockDownloadWindow; i++ {
+		key := hex.EncodeToString(s.hashes[i])
+		if _, ok := s.received[key]; ok {
+			continue
+		}
+		if _, ok := s.inFlight[key]; ok {
+			continue
+		}
+
+		peerId := s.pickPeer(s.headers[i].Height, s.failedPeer[key])
+		if peerId == "" {
+			return
+		}
+		s.inFlight[key] = &blockRequest{peerId, time.Now().Add(blockRequestTimeout)}
+		s.peerInFlight[peerId]++
+		hash := s.hashes[i]
+		s.later(func() { s.net.SendGetData(peerId, "block", hash) })
+	}
+}
+
+// pickPeer 选择一个拥有该高度区块、请求数量未满且最少的节点，尽量避开最近失败的节点
+func (s *SyncManager) pickPeer(height int, avoid string) string {
+	best := ""
+	for peerId, peerHeight := range s.peerHeights {
+		if peerHeight < height || s.peerInFlight[peerId] >= maxBlocksInFlightPerPeer {
+			continue
+		}
+		if peerId == avoid && len(s.peerHeights) > 1 {
+			continue
+		}
+		if best == "" || s.peerInFlight[peerId] < s.peerInFlight[best] {
+			best = peerId
+		}
+	}
+	return best
+}
+
+// finishIfDone 全部区块头已经收到并且全部区块已经写入区块链时，结束本次同步
+// 区块模板的刷新在释放锁之后进行
+func (s *SyncManager) finishIfDone() {
+	if s.syncPeer == "" || !s.headersDone || len(s.hashes) > 0 || len(s.ready) > 0 || s.applying {
+		return
+	}
+
+	height := s.net.Blockchain.GetBestHeight()
+	log.Infof("区块同步完成，高度 %d，同步了 %d 个区块，用时 %s",
+		height, height-s.startHeight, time.Since(s.startTime).Round(time.Second))
+	s.reset()
+
+	if s.net.Miner {
+		s.later(func() {
+			if tip, err := s.net.Blockchain.GetBlock(s.net.Blockchain.LastHash); err == nil {
+				s.net.Template.Refresh(&tip)
+			}
+		})
+	}
+}
+
+// tick 定期检查请求超时，重新分配区块请求并输出同步进度
+func (s *SyncManager) tick() {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	s.prunePeers()
+
+	if s.syncPeer == "" {
+		//没有在同步：有更高的节点则开始同步，否则定期询问各节点的高度
+		best := s.net.Blockchain.GetBestHeight()
+		for peerId, height := range s.peerHeights {
+			if height > best {
+				s.start(peerId)
+				return
+			}
+		}
+		if time.Since(s.lastVersion) >= versionInterval {
+			s.lastVersion = time.Now()
+			for _, peer := range s.net.GeneralChannel.ListPeers() {
+				peerId := peer.Pretty()
+				s.later(func() { s.net.SendVersion(peerId) })
+			}
+		}
+		return
+	}
+
+	if !s.headersDone && time.Since(s.headersRequested) >= headersRequestTimeout {
+		log.Warnf("同步节点 %s 的区块头请求超时", s.syncPeer)
+		s.dropSyncPeer()
+		return
+	}
+
+	now := time.Now()
+	for key, req := range s.inFlight {
+		if now.Before(req.deadline) {
+			continue
+		}
+		s.peerInFlight[req.peer]--
+		delete(s.inFlight, key)
+		s.failedPeer[key] = req.peer
+		s.retries[key]++
+		if s.retries[key] > maxBlockRetries {
+			log.Warnf("区块 %s 重试次数过多，放弃本次同步", key)
+			s.reset()
+			return
+		}
+		log.Infof("向 %s 请求区块 %s 超时，改为向其它节点请求", req.peer, key)
+	}
+	s.schedule()
+
+	if time.Since(s.lastProgress) >= progressInterval {
+		s.lastProgress = time.Now()
+		p := s.progress()
+		log.Infof("同步进度 %.1f%%: 高度 %d/%d，区块头高度 %d，请求中的区块 %d，节点 %d",
+			p.Percent, p.Height, p.TargetHeight, p.HeaderHeight, p.InFlight, p.Peers)
+	}
+}
+
+// prunePeers 移除已经断开连接的节点，它们请求中的区块由schedule重新分配
+func (s *SyncManager) prunePeers() {
+	connected := map[string]bool{}
+	for _, peer := range s.net.GeneralChannel.ListPeers() {
+		connected[peer.Pretty()] = true
+	}
+
+	for peerId := range s.peerHeights {
+		if connected[peerId] {
+			continue
+		}
+		delete(s.peerHeights, peerId)
+		for key, req := range s.inFlight {
+			if req.peer == peerId {
+				delete(s.inFlight, key)
+			}
+		}
+		delete(s.peerInFlight, peerId)
+		if peerId == s.syncPeer && !s.headersDone {
+			log.Warnf("同步节点 %s 已经断开连接", peerId)
+			s.reset()
+		}
+	}
+}
+
+func (s *SyncManager) headerHeight() int {
+	if n := len(s.headers); n > 0 {
+		return s.headers[n-1].Height
+	}
+	return s.net.Blockchain.GetBestHeight()
+}
+
+// Progress 返回区块同步的进度
+func (s *SyncManager) Progress() SyncProgress {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.progress()
+}
+
+func (s *SyncManager) progress() SyncProgress {
+	p := SyncProgress{
+		Syncing:      s.syncPeer != "",
+		Height:       s.net.Blockchain.GetBestHeight(),
+		HeaderHeight: s.headerHeight(),
+		InFlight:     len(s.inFlight),
+		Peers:        len(s.peerHeights),
+	}
+	for _, height := range s.peerHeights {
+		if height > p.TargetHeight {
+			p.TargetHeight = height
+		}
+	}
+	if p.TargetHeight < p.Height {
+		p.TargetHeight = p.Height
+	}
+
+	p.Percent = 100
+	if total := p.TargetHeight - s.startHeight; p.Syncing && total > 0 {
+		p.Percent = float64(p.Height-s.startHeight) * 100 / float64(total)
+	}
+	if done := p.Height - s.startHeight; p.Syncing && done > 0 && p.TargetHeight > p.Height {
+		perBlock := time.Since(s.startTime) / time.Duration(done)
+		p.ETA = int64((perBlock * time.Duration(p.TargetHeight-p.Height)).Seconds())
+	}
+	return p
+}
+
+// Run 同步管理器的事件循环
+func (s *SyncManager) Run() {
+	ticker := time.NewTicker(syncTickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.tick()
+		case <-s.net.GeneralChannel.ctx.Done():
+			return
+		}
+	}
+}
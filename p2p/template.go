@@ -0,0 +1,202 @@
+package p2p
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	blockchain "linechain/core"
+)
+
+const (
+	blockReservedWeight = 16 * 1024                                     //为区块头、挖矿交易和编码开销预留的权重
+	maxTemplateWeight   = blockchain.MaxBlockSize - blockReservedWeight //区块模板的权重上限（模板中交易序列化后的字节数之和）
+	maxTemplateTxs      = blockchain.MaxBlockTxs - 1                    //区块模板中交易数量的上限（为挖矿交易预留一个位置）
+	templateSettle      = 2 * time.Second                               //模板在该时长内没有新交易加入，即认为已经稳定，可以打包挖矿
+	maxTxsPerRequest    = 500                                           //每次响应gettxfrompool的内存池交易数量上限
+)
+
+// BlockTemplate 矿工本地维护的区块模板
+// 矿工不断地从内存池收集交易放入模板，直到达到区块权重上限，然后一次性打包模板中的全部交易挖矿，
+// 而不是每收到一笔交易就执行一轮POW。
+// 收到新交易时模板增长，收到新的链尾区块（tip）时，模板剔除已经上链或与之冲突的交易
+type BlockTemplate struct {
+	mutex sync.Mutex
+
+	prevHash  []byte //模板所基于的链尾区块哈希
+	height    int    //模板挖出区块后的高度
+	txs       []*blockchain.Transaction
+	txIndex   map[string]bool //模板中交易的ID
+	spent     map[string]bool //模板中交易已经引用的输出（txid:out），防止模板内部双花
+	weight    int
+	maxWeight int
+	updated   time.Time //最近一次加入交易的时间
+}
+
+// NewBlockTemplate 创建一个空的区块模板
+func NewBlockTemplate(maxWeight int) *BlockTemplate {
+	return &BlockTemplate{
+		txIndex:   map[string]bool{},
+		spent:     map[string]bool{},
+		maxWeight: maxWeight,
+	}
+}
+
+// txWeight 交易的权重，这里使用交易序列化后的字节数
+func txWeight(tx *blockchain.Transaction) int {
+	return len(tx.Serializer())
+}
+
+// outpoint 交易输入引用的输出的唯一标识
+func outpoint(in blockchain.TxInput) string {
+	return fmt.Sprintf("%x:%d", in.ID, in.Out)
+}
+
+// Add 将交易加入模板
+// 交易已经在模板中、与模板中的交易花费了同一个输出，或者加入后超出区块的权重或交易数量上限时，返回false
+func (t *BlockTemplate) Add(tx *blockchain.Transaction) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	txID := hex.EncodeToString(tx.ID)
+	if t.txIndex[txID] || len(t.txs) >= maxTemplateTxs {
+		return false
+	}
+	for _, in := range tx.Inputs {
+		if t.spent[outpoint(in)] {
+			return false
+		}
+	}
+	weight := txWeight(tx)
+	if t.weight+weight > t.maxWeight {
+		return false
+	}
+
+	for _, in := range tx.Inputs {
+		t.spent[outpoint(in)] = true
+	}
+	t.txIndex[txID] = true
+	t.txs = append(t.txs, tx)
+	t.weight += weight
+	t.updated = time.Now()
+
+	return true
+}
+
+// Refresh 新的tip到达后刷新模板
+// 更新模板所基于的区块，并剔除已经包含在tip中，或与tip中交易花费了同一个输出的交易
+func (t *BlockTemplate) Refresh(tip *blockchain.Block) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.prevHash = tip.Hash
+	t.height = tip.Height + 1
+
+	included := map[string]bool{}
+	spent := map[string]bool{}
+	for _, tx := range tip.Transactions {
+		included[hex.EncodeToString(tx.ID)] = true
+		if !tx.IsMinerTx() {
+			for _, in := range tx.Inputs {
+				spent[outpoint(in)] = true
+			}
+		}
+	}
+
+	txs := t.txs
+	t.txs = nil
+	t.txIndex = map[string]bool{}
+	t.spent = map[string]bool{}
+	t.weight = 0
+
+Txs:
+	for _, tx := range txs {
+		if included[hex.EncodeToString(tx.ID)] {
+			continue
+		}
+		for _, in := range tx.Inputs {
+			if spent[outpoint(in)] {
+				continue Txs
+			}
+		}
+		for _, in := range tx.Inputs {
+			t.spent[outpoint(in)] = true
+		}
+		t.txIndex[hex.EncodeToString(tx.ID)] = true
+		t.txs = append(t.txs, tx)
+		t.weight += txWeight(tx)
+	}
+}
+
+// Remove 从模板中移除指定的交易（如挖矿前验证失败的交易）
+func (t *BlockTemplate) Remove(ids [][]byte) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	removed := map[string]bool{}
+	for _, id := range ids {
+		removed[hex.EncodeToString(id)] = true
+	}
+
+	txs := t.txs
+	t.txs = nil
+	for _, tx := range txs {
+		txID := hex.EncodeToString(tx.ID)
+		if !removed[txID] {
+			t.txs = append(t.txs, tx)
+			continue
+		}
+		delete(t.txIndex, txID)
+		for _, in := range tx.Inputs {
+			delete(t.spent, outpoint(in))
+		}
+		t.weight -= txWeight(tx)
+	}
+}
+
+// Transactions 返回模板中全部交易（按加入模板的顺序）
+func (t *BlockTemplate) Transactions() []*blockchain.Transaction {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	txs := make([]*blockchain.Transaction, len(t.txs))
+	copy(txs, t.txs)
+	return txs
+}
+
+// PrevHash 返回模板所基于的链尾区块哈希
+func (t *BlockTemplate) PrevHash() []byte {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.prevHash
+}
+
+// Len 模板中的交易数量
+func (t *BlockTemplate) Len() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return len(t.txs)
+}
+
+// Full 模板是否已经达到权重或交易数量上限
+func (t *BlockTemplate) Full() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.weight >= t.maxWeight || len(t.txs) >= maxTemplateTxs
+}
+
+// Ready 模板是否可以打包挖矿：模板中有交易，并且已满或在templateSettle时间内没有新交易加入
+func (t *BlockTemplate) Ready() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if len(t.txs) == 0 {
+		return false
+	}
+	full := t.weight >= t.maxWeight || len(t.txs) >= maxTemplateTxs
+	return full || time.Since(t.updated) >= templateSettle
+}
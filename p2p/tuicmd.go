@@ -0,0 +1,291 @@
+package p2p
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	blockchain "linechain/core"
+	"linechain/wallet"
+)
+
+// 文字界面中的斜杠命令：运维人员在输入框中输入 /命令 查看和操作节点，结果显示在命令面板中，不需要另开终端使用RPC
+// 不以 / 开头的输入仍作为文本消息发布到 general 通道
+
+var (
+	ErrUnknownTUICommand = errors.New("未知命令，输入 /help 查看全部命令")
+	ErrNotMiner          = errors.New("本节点不是挖矿节点（启动时未指定 --miner）")
+)
+
+// tuiCommand 一个斜杠命令
+type tuiCommand struct {
+	name  string
+	usage string
+	help  string
+	run   func(net *Network, args []string) (string, error)
+}
+
+// tuiCommands 全部斜杠命令，/help按该顺序列出
+func tuiCommands() []tuiCommand {
+	return []tuiCommand{
+		{"peers", "/peers", "列出握手成功的节点", tuiPeers},
+		{"height", "/height", "显示本地区块链的高度和最新区块哈希", tuiHeight},
+		{"block", "/block <高度>", "显示指定高度的区块", tuiBlock},
+		{"tx", "/tx <交易ID>", "在内存池和区块链中查找交易", tuiTx},
+		{"mempool", "/mempool", "显示内存池中的交易", tuiMempool},
+		{"balance", "/balance <地址>", "查询钱包地址的余额", tuiBalance},
+		{"send", "/send <发送地址> <接收地址> <数量> [mine]", "从本地钱包发送代币，指定mine时立即挖矿", tuiSend},
+		{"mine", "/mine on|off", "恢复或暂停挖矿（仅挖矿节点）", tuiMine},
+		{"ban", "/ban <节点ID> [时长]", "禁止节点，时长为Go的时长格式，缺省使用 --banduration", tuiBan},
+		{"help", "/help", "列出全部命令", nil},
+		{"quit", "/quit", "退出节点", nil},
+	}
+}
+
+// runTUICommand 执行一行斜杠命令，返回要显示在命令面板中的结果
+func (net *Network) runTUICommand(line string) (string, error) {
+	fields := strings.Fields(strings.TrimPrefix(line, "/"))
+	if len(fields) == 0 {
+		return "", ErrUnknownTUICommand
+	}
+	name, args := strings.ToLower(fields[0]), fields[1:]
+	commands := tuiCommands()
+	if name == "help" {
+		var lines []string
+		for _, cmd := range commands {
+			lines = append(lines, fmt.Sprintf("%-44s %s", cmd.usage, cmd.help))
+		}
+		return strings.Join(lines, "\n"), nil
+	}
+	for _, cmd := range commands {
+		if cmd.name == name && cmd.run != nil {
+			return cmd.run(net, args)
+		}
+	}
+	return "", ErrUnknownTUICommand
+}
+
+// usageError 参数不正确时返回命令的用法
+func usageError(name string) error {
+	for _, cmd := range tuiCommands() {
+		if cmd.name == name {
+			return fmt.Errorf("用法: %s", cmd.usage)
+		}
+	}
+	return ErrUnknownTUICommand
+}
+
+func tuiPeers(net *Network, args []string) (string, error) {
+	peers := net.Peers.List()
+	if len(peers) == 0 {
+		return "没有握手成功的节点", nil
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].PeerID < peers[j].PeerID
+	})
+	lines := []string{fmt.Sprintf("%d 个节点:", len(peers))}
+	for _, p := range peers {
+		lines = append(lines, fmt.Sprintf("%s  v%d  %s  高度 %d  服务 %s  连接 %s",
+			p.PeerID, p.Version, p.UserAgent, p.BestHeight, p.Services, time.Since(p.Since).Round(time.Second)))
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+func tuiHeight(net *Network, args []string) (string, error) {
+	chain := net.Blockchain.ContinueBlockchain()
+	return fmt.Sprintf("高度 %d  最新区块 %x", chain.GetBestHeight(), chain.LastHash), nil
+}
+
+func tuiBlock(net *Network, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", usageError("block")
+	}
+	height, err := strconv.Atoi(args[0])
+	if err != nil || height < 0 {
+		return "", usageError("block")
+	}
+	block, err := net.blockAtHeight(height)
+	if err != nil {
+		return "", err
+	}
+	lines := []string{
+		fmt.Sprintf("区块 %d: %x", block.Height, block.Hash),
+		fmt.Sprintf("  PrevHash:   %x", block.PrevHash),
+		fmt.Sprintf("  MerkleRoot: %x", block.MerkleRoot),
+		fmt.Sprintf("  时间 %s  难度 %d  Nonce %d", time.Unix(block.Timestamp, 0).Format(time.RFC3339), block.Bits, block.Nonce),
+		fmt.Sprintf("  %d 笔交易:", len(block.Transactions)),
+	}
+	for _, tx := range block.Transactions {
+		lines = append(lines, fmt.Sprintf("    %x", tx.ID))
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// blockAtHeight 本地主链上指定高度的区块
+func (net *Network) blockAtHeight(height int) (*blockchain.Block, error) {
+	chain := net.Blockchain.ContinueBlockchain()
+	if height > chain.GetBestHeight() {
+		return nil, fmt.Errorf("高度 %d 超出本地区块链的高度 %d", height, chain.GetBestHeight())
+	}
+	//高于height-1的第一个区块哈希即为height高度的区块
+	hashes := chain.GetBlockHashesAfter(height-1, 1)
+	if len(hashes) == 0 {
+		return nil, fmt.Errorf("没有高度为 %d 的区块", height)
+	}
+	block, err := chain.GetBlock(hashes[0])
+	if err != nil {
+		return nil, err
+	}
+	return &block, nil
+}
+
+func tuiTx(net *Network, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", usageError("tx")
+	}
+	id, err := hex.DecodeString(args[0])
+	if err != nil {
+		return "", errors.New("交易ID非法")
+	}
+	if tx, ok := memoryPool.Find(args[0]); ok {
+		return "内存池中的交易（未确认）\n" + tx.String(), nil
+	}
+	chain := net.Blockchain.ContinueBlockchain()
+	block, err := chain.FindTransactionBlock(id)
+	if err != nil {
+		return "", fmt.Errorf("找不到交易 %s", args[0])
+	}
+	for _, tx := range block.Transactions {
+		if hex.EncodeToString(tx.ID) == args[0] {
+			return fmt.Sprintf("区块 %d（%x）中的交易\n%s", block.Height, block.Hash, tx.String()), nil
+		}
+	}
+	return "", fmt.Errorf("找不到交易 %s", args[0])
+}
+
+func tuiMempool(net *Network, args []string) (string, error) {
+	txs := memoryPool.Transactions()
+	lines := []string{fmt.Sprintf("内存池中有 %d 笔交易（挂起 %d）", len(txs), memoryPool.PendingCount())}
+	for _, tx := range txs {
+		total := float64(0)
+		for _, out := range tx.Outputs {
+			total += out.Value
+		}
+		lines = append(lines, fmt.Sprintf("  %x  输入 %d  输出 %d  金额 %f", tx.ID, len(tx.Inputs), len(tx.Outputs), total))
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+func tuiBalance(net *Network, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", usageError("balance")
+	}
+	address := args[0]
+	if !wallet.ValidateAddress(address) {
+		return "", errors.New("非法地址")
+	}
+	publicKeyHash := wallet.Base58Decode([]byte(address))
+	publicKeyHash = publicKeyHash[1 : len(publicKeyHash)-4]
+	utxos := blockchain.UTXOSet{Blockchain: net.Blockchain.ContinueBlockchain()}
+
+	balance := float64(0)
+	for _, out := range utxos.FindUnSpentTransactions(publicKeyHash) {
+		balance += out.Value
+	}
+	return fmt.Sprintf("%s 的余额是 %f", address, balance), nil
+}
+
+func tuiSend(net *Network, args []string) (string, error) {
+	if len(args) < 3 || len(args) > 4 || (len(args) == 4 && args[3] != "mine") {
+		return "", usageError("send")
+	}
+	from, to := args[0], args[1]
+	amount, err := strconv.ParseFloat(args[2], 64)
+	if err != nil || amount <= 0 {
+		return "", errors.New("数量非法")
+	}
+	if !wallet.ValidateAddress(from) || !wallet.ValidateAddress(to) {
+		return "", errors.New("地址非法")
+	}
+
+	chain := net.Blockchain.ContinueBlockchain()
+	utxos := blockchain.UTXOSet{Blockchain: chain}
+	wallets, err := wallet.InitializeWallets(false, chain.InstanceId)
+	if err != nil {
+		return "", err
+	}
+	w, err := wallets.GetWallet(from)
+	if err != nil {
+		return "", errors.New("请导入sendfrom的钱包到此节点")
+	}
+	tx, err := blockchain.NewTransaction(&w, to, amount, &utxos)
+	if err != nil {
+		return "", err
+	}
+
+	if len(args) == 4 {
+		//立即挖矿：自己作为矿工挖出包含该交易的区块，并通知其它节点
+		block := chain.MineBlock([]*blockchain.Transaction{blockchain.MinerTx(from, ""), tx})
+		utxos.Update(block)
+		net.Blocks <- block
+		return fmt.Sprintf("交易 %x 已打包进区块 %d", tx.ID, block.Height), nil
+	}
+	net.Transactions <- tx
+	return fmt.Sprintf("交易 %x 已送到内存池", tx.ID), nil
+}
+
+func tuiMine(net *Network, args []string) (string, error) {
+	if len(args) != 1 || (args[0] != "on" && args[0] != "off") {
+		return "", usageError("mine")
+	}
+	if !net.Miner {
+		return "", ErrNotMiner
+	}
+	if args[0] == "off" {
+		net.PauseMining(true)
+		return "挖矿已暂停", nil
+	}
+	net.PauseMining(false)
+	return "挖矿已恢复", nil
+}
+
+func tuiBan(net *Network, args []string) (string, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return "", usageError("ban")
+	}
+	id, err := peer.Decode(args[0])
+	if err != nil {
+		return "", errors.New("节点ID非法")
+	}
+	var duration time.Duration
+	if len(args) == 2 {
+		if duration, err = time.ParseDuration(args[1]); err != nil {
+			return "", errors.New("时长非法")
+		}
+	}
+	if err := net.Bans.Ban(id, duration, "文字界面中手动禁止"); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("已禁止节点 %s", ShortID(id)), nil
+}
+
+// PauseMining 暂停或恢复挖矿：暂停期间矿工事件循环不打包区块模板
+func (net *Network) PauseMining(paused bool) {
+	var v int32
+	if paused {
+		v = 1
+	}
+	atomic.StoreInt32(&net.miningPaused, v)
+}
+
+// MiningPaused 挖矿是否已暂停
+func (net *Network) MiningPaused() bool {
+	return atomic.LoadInt32(&net.miningPaused) == 1
+}
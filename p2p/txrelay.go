@@ -0,0 +1,282 @@
+package p2p
+
+import (
+	"encoding/hex"
+	mrand "math/rand"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	log "github.com/sirupsen/logrus"
+
+	blockchain "linechain/core"
+)
+
+// 交易清单转发
+// 新交易不再整笔广播，而是以inv清单的形式通知相连的节点，对方只用getdata请求自己没有的交易，
+// 因此每笔交易在每条连接上最多传输一次。每个节点记录对方已知的交易（对方发来或本节点发过的清单），不会重复通知；
+// 通知按节点排队，每隔一个随机的间隔（平均trickleInterval）批量发送，既减少消息数量，也使他人难以根据通知的先后推断交易的来源
+
+const (
+	maxKnownInventory = 5000                   //每个节点记录的已知交易数量上限
+	maxRejectedTxs    = 10000                  //记录的非法交易数量上限
+	maxInvPerMsg      = 1000                   //每条inv消息的交易数量上限
+	trickleInterval   = 500 * time.Millisecond //向每个节点批量发送交易清单的平均间隔
+	relayTickInterval = 100 * time.Millisecond
+	txRequestTimeout  = 20 * time.Second //请求的交易超过该时间未收到，可以向其它节点请求
+	maxUnanswered     = 100              //每个节点记录的未回应清单数量上限
+)
+
+// inventorySet 有上限的交易ID集合，超过上限时移除最早加入的ID
+type inventorySet struct {
+	max   int
+	set   map[string]struct{}
+	order []string
+}
+
+func newInventorySet(max int) *inventorySet {
+	return &inventorySet{max: max, set: map[string]struct{}{}}
+}
+
+func (s *inventorySet) Add(key string) {
+	if _, ok := s.set[key]; ok {
+		return
+	}
+	if len(s.order) >= s.max {
+		delete(s.set, s.order[0])
+		s.order = s.order[1:]
+	}
+	s.set[key] = struct{}{}
+	s.order = append(s.order, key)
+}
+
+func (s *inventorySet) Has(key string) bool {
+	_, ok := s.set[key]
+	return ok
+}
+
+// TxRelay 交易清单的转发：各节点的已知交易、待发送的通知队列，以及最近的非法交易
+type TxRelay struct {
+	mutex sync.Mutex
+	net   *Network
+
+	known      map[peer.ID]*inventorySet //各节点已知的交易
+	queue      map[peer.ID][]string      //各节点待通知的交易
+	nextSend   map[peer.ID]time.Time     //各节点下一次发送通知的时间
+	unanswered map[peer.ID]int           //发给各节点、对方尚未用getdata回应的清单数量
+	rejected   *inventorySet             //最近验证失败的交易，不再请求
+}
+
+func NewTxRelay(net *Network) *TxRelay {
+	return &TxRelay{
+		net:        net,
+		known:      map[peer.ID]*inventorySet{},
+		queue:      map[peer.ID][]string{},
+		nextSend:   map[peer.ID]time.Time{},
+		unanswered: map[peer.ID]int{},
+		rejected:   newInventorySet(maxRejectedTxs),
+	}
+}
+
+func (r *TxRelay) knownSet(id peer.ID) *inventorySet {
+	known, ok := r.known[id]
+	if !ok {
+		known = newInventorySet(maxKnownInventory)
+		r.known[id] = known
+	}
+	return known
+}
+
+// MarkKnown 记录节点已经知道交易
+func (r *TxRelay) MarkKnown(id peer.ID, txID []byte) {
+	if id == "" {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.knownSet(id).Add(hex.EncodeToString(txID))
+}
+
+// Reject 记录验证失败的交易，其它节点再通知时不再请求
+func (r *TxRelay) Reject(txID []byte) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.rejected.Add(hex.EncodeToString(txID))
+}
+
+// Rejected 交易最近是否验证失败
+func (r *TxRelay) Rejected(txID []byte) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.rejected.Has(hex.EncodeToString(txID))
+}
+
+// TakeAnswer 节点是否还有未回应的清单，有则记为已回应
+// 回应本节点清单的getdata不受速率限制，避免诚实的节点因为请求本节点通知的交易而被计为违规
+func (r *TxRelay) TakeAnswer(id peer.ID) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.unanswered[id] == 0 {
+		return false
+	}
+	r.unanswered[id]--
+	return true
+}
+
+// Queue 将交易加入握手成功的各节点（except除外）的通知队列
+func (r *TxRelay) Queue(txID []byte, except peer.ID) {
+	key := hex.EncodeToString(txID)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, info := range r.net.Peers.List() {
+		id, err := peer.Decode(info.PeerID)
+		if err != nil || id == except {
+			continue
+		}
+		if r.knownSet(id).Has(key) {
+			continue
+		}
+		r.enqueue(id, key)
+	}
+}
+
+// QueueMempool 将内存池中的全部交易加入节点的通知队列（新节点握手成功后调用）
+func (r *TxRelay) QueueMempool(id peer.ID) {
+	txs := memoryPool.Transactions()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, tx := range txs {
+		key := hex.EncodeToString(tx.ID)
+		if !r.knownSet(id).Has(key) {
+			r.enqueue(id, key)
+		}
+	}
+}
+
+// enqueue 将交易加入节点的通知队列，队列最多maxKnownInventory笔交易，超过时丢弃最早的交易
+func (r *TxRelay) enqueue(id peer.ID, key string) {
+	if _, ok := r.nextSend[id]; !ok {
+		r.nextSend[id] = time.Now().Add(trickleDelay())
+	}
+	queue := r.queue[id]
+	if len(queue) >= maxKnownInventory {
+		queue = queue[len(queue)-maxKnownInventory+1:]
+	}
+	r.queue[id] = append(queue, key)
+}
+
+// trickleDelay 随机的发送间隔（指数分布，平均trickleInterval）
+func trickleDelay() time.Duration {
+	return time.Duration(mrand.ExpFloat64() * float64(trickleInterval))
+}
+
+// flush 向到达发送时间的节点批量发送交易清单，已不在内存池中或对方已知的交易不再通知
+func (r *TxRelay) flush() {
+	type announcement struct {
+		peerId string
+		items  [][]byte
+	}
+	var out []announcement
+
+	r.mutex.Lock()
+	now := time.Now()
+	for id, keys := range r.queue {
+		if now.Before(r.nextSend[id]) {
+			continue
+		}
+		known := r.knownSet(id)
+		var items [][]byte
+		sent := 0
+		for _, key := range keys {
+			if len(items) >= maxInvPerMsg {
+				break
+			}
+			sent++
+			if known.Has(key) {
+				continue
+			}
+			if _, ok := memoryPool.Find(key); !ok {
+				continue
+			}
+			txID, _ := hex.DecodeString(key)
+			known.Add(key)
+			items = append(items, txID)
+		}
+		if sent < len(keys) {
+			r.queue[id] = keys[sent:]
+			r.nextSend[id] = now.Add(trickleDelay())
+		} else {
+			delete(r.queue, id)
+			delete(r.nextSend, id)
+		}
+		if len(items) > 0 {
+			out = append(out, announcement{id.Pretty(), items})
+			if r.unanswered[id] < maxUnanswered {
+				r.unanswered[id]++
+			}
+		}
+	}
+	r.mutex.Unlock()
+
+	for _, a := range out {
+		r.net.SendInv(a.peerId, "tx", a.items)
+	}
+}
+
+// prune 移除已经断开连接的节点
+func (r *TxRelay) prune() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for id := range r.known {
+		if _, ok := r.net.Peers.Get(id.Pretty()); !ok {
+			delete(r.known, id)
+			delete(r.queue, id)
+			delete(r.nextSend, id)
+			delete(r.unanswered, id)
+		}
+	}
+}
+
+// Run 定期发送交易清单，直到节点退出
+func (r *TxRelay) Run() {
+	ticker := time.NewTicker(relayTickInterval)
+	defer ticker.Stop()
+
+	lastPrune := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+			r.flush()
+			if time.Since(lastPrune) >= time.Minute {
+				lastPrune = time.Now()
+				r.prune()
+			}
+		case <-r.net.GeneralChannel.ctx.Done():
+			return
+		}
+	}
+}
+
+// acceptTx 将验证通过的交易加入内存池（挖矿节点同时加入区块模板），并通知除来源节点外的其它节点
+func (net *Network) acceptTx(tx *blockchain.Transaction, from peer.ID) {
+	memoryPool.Add(*tx)
+	if net.Miner {
+		//将交易移到排队队列，并加入区块模板
+		memoryPool.Move(*tx, "queued")
+		if !net.Template.Add(tx) {
+			//模板已满或与模板中的交易冲突，交易留在挂起队列中
+			log.Infof("交易 %x 未能加入区块模板", tx.ID)
+			memoryPool.Move(*tx, "pending")
+		}
+	}
+	net.Relay.Queue(tx.ID, from)
+}
@@ -1,7 +1,11 @@
 package p2p
 
 import (
+	"sync"
+	"time"
+
 	blockchain "linechain/core"
+	"linechain/util/lifecycle"
 
 	"github.com/libp2p/go-libp2p/core/host"
 )
@@ -14,6 +18,9 @@ type Network struct {
 	FullNodesChannel *Channel  //全节点
 	Blockchain       *blockchain.Blockchain
 
+	//其它节点通过流（SyncProtocol）直接发来的消息队列（带缓冲的通道，缓冲数量为 ChannelBufSize）
+	Direct chan *ChannelContent
+
 	//Blocks和Transactions消息队列，用于存储新产生的Block或Transaction
 	//一般而言，我们在主程序执行send交易过程中，根据send参数mineNow决定是否立即挖矿，mineNow为true则存储Block消息队列（立即挖矿）
 	//mineNow为false则存储Transaction消息队列（不立即挖矿）。两个消息由节点在startNode后启动消息处理协程进行处理
@@ -24,16 +31,113 @@ type Network struct {
 
 	//是否是挖矿节点
 	Miner bool
+	//挖矿是否已暂停（1为暂停），由文字界面的 /mine 命令设置
+	miningPaused int32
+	//挖矿统计（仅挖矿节点使用），显示在文字界面的仪表盘中
+	statsMutex sync.Mutex
+	mining     MiningStats
+	//矿工的区块模板（仅挖矿节点使用）
+	Template *BlockTemplate
+	//区块同步管理器
+	Sync *SyncManager
+	//节点不当行为的记录和禁止列表
+	Bans *BanManager
+	//允许连接的节点白名单
+	Allowlist *Allowlist
+	//握手成功的节点注册表
+	Peers *PeerRegistry
+	//交易清单的转发
+	Relay *TxRelay
+	//按节点、按命令的消息速率限制
+	Limiter *RateLimiter
+	//协议引擎，按命令分派处理收到的消息
+	Engine *Engine
+	//节点各子系统的生命周期管理
+	Lifecycle *lifecycle.Manager
+	//p2p网络的事件循环，退出时等待它们结束
+	loops sync.WaitGroup
+
+	NetworkID   uint32      //网络ID
+	GenesisHash []byte      //创始区块哈希
+	Services    ServiceFlag //本节点提供的服务
+
+	//本节点通过getdata请求过的区块和交易（哈希 -> 请求记录），用于识别未请求的区块和交易
+	requestedMutex sync.Mutex
+	requested      map[string]*requestRecord
+
+	//正在用内存池重建、等待缺失交易的紧凑区块（区块哈希 -> 区块）
+	compactMutex sync.Mutex
+	partials     map[string]*partialBlock
+}
+
+// NodeConfig 启动节点的配置
+type NodeConfig struct {
+	ListenPort   string        //监听端口
+	MinerAddress string        //矿工钱包地址
+	Miner        bool          //是否是挖矿节点
+	FullNode     bool          //是否是全节点
+	BanDuration  time.Duration //不当行为分数达到上限的节点被禁止的时长
+	NodeKey      string        //节点密钥文件，为空时使用实例目录下的缺省文件
+	KeyType      string        //密钥文件不存在时生成的密钥类型：rsa或ed25519
+	BootNodes    []string      //引导节点的multiaddr，为空时公共网络使用IPFS的公共引导节点
+	Rendezvous   string        //节点发现的会合点，为空时使用DefaultRendezvous
+	PrivateDHT   bool          //是否使用私有DHT，不连接IPFS的公共DHT
+	NoDHT        bool          //不使用DHT发现节点（只使用mDNS时设置）
+	MDNS         bool          //是否启用局域网mDNS发现
+	SwarmKey     string        //私有网络的预共享密钥文件，为空时不启用私有网络
+	Allowlist    string        //允许连接的节点白名单文件，为空时允许所有节点
+	NetworkID    uint32        //网络ID，为0时使用DefaultNetworkID
+	LowPeers     int           //连接数的低水位，为0时使用DefaultLowPeers
+	HighPeers    int           //连接数的高水位，超过时连接管理器断开连接直到低水位，为0时使用DefaultHighPeers
+	MaxInbound   int           //入站连接数的上限，为0时使用DefaultMaxInbound
+	MaxStreams   int           //流数量的上限，为0时按资源自动计算
+	MaxMemory    int64         //libp2p可以使用的内存（MB），为0时按系统内存自动计算
+	MetricsAddr  string        //Prometheus指标的HTTP监听地址，为空时不导出指标
+	Headless     bool          //以后台服务方式运行：不使用文字界面，收到SIGINT或SIGTERM时有序退出
 }
 
 //以下请求命令结构中均有一个成员SendFrom，为发送命令着的peerId，
 //网络上节点接收到命令后，将回复消息发给peerId节点
 
-// Version 命令结构
+// CmpctBlock 紧凑区块命令结构：区块头、除挖矿交易外每笔交易的短ID，以及随区块发送的交易
+type CmpctBlock struct {
+	SendFrom  string
+	Header    []byte        //区块头（线格式）
+	Nonce     uint64        //计算短ID的随机数
+	ShortIDs  []uint64      //按区块中的顺序，未随区块发送的交易的短ID（6个字节）
+	Prefilled []PrefilledTx //随区块发送的交易（挖矿交易），按位置递增
+}
+
+// PrefilledTx 随紧凑区块发送的交易，Index为交易在区块中的位置
+type PrefilledTx struct {
+	Index int
+	Tx    []byte
+}
+
+// GetBlockTxn 命令结构，请求区块中指定位置的交易
+type GetBlockTxn struct {
+	SendFrom  string
+	BlockHash []byte
+	Indexes   []int
+}
+
+// BlockTxn 命令结构，按请求的顺序返回区块中的交易
+type BlockTxn struct {
+	SendFrom  string
+	BlockHash []byte
+	Txs       [][]byte
+}
+
+// Version 命令结构，节点连接后的握手消息
 type Version struct {
-	Version    int
-	BestHeight int
-	SendFrom   string //peerId
+	Version     int         //支持的最高协议版本
+	MinVersion  int         //支持的最低协议版本
+	NetworkID   uint32      //网络ID，不同网络的节点不能互通
+	GenesisHash []byte      //创始区块哈希
+	UserAgent   string      //客户端标识
+	Services    ServiceFlag //提供的服务
+	BestHeight  int
+	SendFrom    string //peerId
 }
 
 // GetBlocks 命令结构
@@ -42,6 +146,18 @@ type GetBlocks struct {
 	Height   int
 }
 
+// GetHeaders 命令结构
+type GetHeaders struct {
+	SendFrom string   //节点的peerId
+	Locator  [][]byte //区块定位器
+}
+
+// Headers 命令结构
+type Headers struct {
+	SendFrom string   //节点的peerId
+	Headers  [][]byte //按线格式编码的区块头（按高度从低到高）
+}
+
 // Tx 命令结构
 type Tx struct {
 	SendFrom    string //节点的peerId
@@ -64,7 +180,7 @@ type TxFromPool struct {
 type GetData struct {
 	SendFrom string //节点的peerId
 	Type     string
-	ID       []byte
+	Items    [][]byte //请求的区块哈希或交易ID，一次最多maxInvPerMsg个
 }
 
 // Inv 命令结构
@@ -2,7 +2,6 @@ package p2p
 
 import (
 	"bytes"
-	"encoding/gob"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -10,11 +9,14 @@ import (
 	"unsafe"
 
 	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
+	"strings"
 	"sync"
 
 	p2p_crypto "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/pnet"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -30,7 +32,7 @@ func CmdToBytes(cmd string) []byte {
 	var bytes [commandLength]byte //bytes是一个数组，声明数组时所有的元素都会被自动初始化为默认值 0
 
 	//使用ruin类型（用它来区分字符值和整数值），go用于处理字符串的便捷方法
-	//注意这里不能直接将cmd转为[]byte（使用GobEncode），
+	//注意这里不能直接将cmd按消息的线格式编码为[]byte，
 	//因为首先cmd有严格的长度要求，另外cmd在对方接收到后需要能解析出来（实际的命令内容是cmd+payload）
 	for i, c := range cmd { //每一个ruin代表一个完整的字符（不管是中文字符还是英文字符）
 		bytes[i] = byte(c)
@@ -50,19 +52,6 @@ func BytesToCmd(bytes []byte) string {
 	return *(*string)(unsafe.Pointer(&cmd))
 }
 
-// GobEncode 将任何类型的数据转为[]byte
-func GobEncode(data interface{}) []byte {
-	var buff bytes.Buffer
-
-	enc := gob.NewEncoder(&buff)
-	err := enc.Encode(data)
-	if err != nil {
-		log.Panic(err)
-	}
-
-	return buff.Bytes()
-}
-
 // GenKeyP2PRand generates a pair of RSA keys used in libp2p host, using random seed
 func GenKeyP2PRand() (p2p_crypto.PrivKey, p2p_crypto.PubKey, error) {
 	return p2p_crypto.GenerateKeyPair(p2p_crypto.RSA, 2048)
@@ -121,9 +110,7 @@ func Load(path string, v interface{}) error {
 	defer lock.Unlock()
 	f, err := os.Open(path)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return err
-		}
+		return err
 	}
 	defer f.Close()
 	return Unmarshal(f, v)
@@ -137,8 +124,23 @@ func SaveKeyToFile(keyfile string, key p2p_crypto.PrivKey) (err error) {
 	}
 
 	keyStruct := PrivKeyStore{Key: str}
+	r, err := Marshal(&keyStruct)
+	if err != nil {
+		return
+	}
 
-	err = Save(keyfile, &keyStruct)
+	lock.Lock()
+	defer lock.Unlock()
+	// 私钥文件只允许本用户读写：创建时即为0600，已存在的文件在写入私钥之前修改权限
+	f, err := os.OpenFile(keyfile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	if err = f.Chmod(0600); err != nil {
+		return
+	}
+	_, err = io.Copy(f, r)
 	return
 }
 
@@ -173,31 +175,64 @@ func LoadPrivateKey(key string) (p2p_crypto.PrivKey, p2p_crypto.PubKey, error) {
 }
 
 // LoadKeyFromFile load private key from keyfile
-// If the private key is not loadable or no file, it will generate
-// a new random private key
-func LoadKeyFromFile(keyfile string) (key p2p_crypto.PrivKey, pk p2p_crypto.PubKey, err error) {
+// If there is no keyfile, it will generate a new random private key of keyType
+// (p2p_crypto.RSA or p2p_crypto.Ed25519) and save it to keyfile, so that the
+// peer ID stays the same across restarts. A keyfile that exists but cannot be
+// parsed is an error and is never overwritten.
+func LoadKeyFromFile(keyfile string, keyType int) (key p2p_crypto.PrivKey, pk p2p_crypto.PubKey, err error) {
 	var keyStruct PrivKeyStore
 	err = Load(keyfile, &keyStruct)
+	if err == nil {
+		return LoadPrivateKey(keyStruct.Key)
+	}
+	if !os.IsNotExist(err) {
+		return nil, nil, fmt.Errorf("failed to load key from %s: %v", keyfile, err)
+	}
+
+	log.Infof("节点密钥文件 %s 不存在，生成新的密钥", keyfile)
+	key, pk, err = p2p_crypto.GenerateKeyPair(keyType, 2048) //bits只对RSA有效
 	if err != nil {
-		Logger().Info().
-			Str("keyfile", keyfile).
-			Msg("No private key can be loaded from file")
-		Logger().Info().Msg("Using random private key")
-		key, pk, err = GenKeyP2PRand()
-		if err != nil {
-			Logger().Error().
-				AnErr("GenKeyP2PRand Error", err).
-				Msg("LoadedKeyFromFile")
-			panic(err)
-		}
-		err = SaveKeyToFile(keyfile, key)
-		if err != nil {
-			Logger().Error().
-				AnErr("keyfile", err).
-				Msg("failed to save key to keyfile")
-		}
-		return key, pk, nil
+		return nil, nil, err
+	}
+	if err = os.MkdirAll(filepath.Dir(keyfile), 0755); err != nil {
+		return nil, nil, err
+	}
+	if err = SaveKeyToFile(keyfile, key); err != nil {
+		return nil, nil, fmt.Errorf("failed to save key to %s: %v", keyfile, err)
+	}
+	return key, pk, nil
+}
+
+// LoadSwarmKey 读取私有网络的预共享密钥（PSK）文件，文件格式与IPFS的swarm.key相同：
+//
+//	/key/swarm/psk/1.0.0/
+//	/base16/
+//	<64个十六进制字符>
+func LoadSwarmKey(path string) (pnet.PSK, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return pnet.DecodeV1PSK(f)
+}
+
+// ParseKeyType 将密钥类型名称（rsa、ed25519）转换为libp2p的密钥类型
+func ParseKeyType(name string) (int, error) {
+	switch strings.ToLower(name) {
+	case "rsa":
+		return p2p_crypto.RSA, nil
+	case "ed25519":
+		return p2p_crypto.Ed25519, nil
+	default:
+		return 0, fmt.Errorf("不支持的密钥类型: %s", name)
+	}
+}
+
+// nodeKeyPath 实例的缺省节点密钥文件
+func nodeKeyPath(instanceId string) string {
+	if instanceId != "" {
+		return filepath.Join(Root, "tmp", fmt.Sprintf("nodekey_%s.json", instanceId))
 	}
-	key, pk, err = LoadPrivateKey(keyStruct.Key)
-	return key, pk, err
+	return filepath.Join(Root, "tmp", "nodekey.json")
 }
@@ -0,0 +1,238 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/peer"
+	log "github.com/sirupsen/logrus"
+
+	blockchain "linechain/core"
+)
+
+// 通道消息的验证
+// gossipsub在转发消息之前调用验证器：验证器只做廉价的检查（大小、解码、POW、签名，以及区块能否连接在本地已知的前一个区块之后），
+// 非法消息返回ValidationReject，不再继续传播，并且由gossipsub的节点评分惩罚发送者；
+// 不应该出现在通道中、但也不算恶意的消息（如定向消息、未知命令）返回ValidationIgnore，只是不转发；
+// 前一个区块未知的区块无法验证，同样返回ValidationIgnore，由同步补全
+
+var (
+	ErrInvalidSignature  = errors.New("交易签名不合法")
+	ErrUnexpectedMinerTx = errors.New("挖矿交易不能单独广播")
+	ErrBadInventory      = errors.New("inv清单不合法")
+	ErrFakeGenesis       = errors.New("没有前一个区块哈希，但不是本网络的创始区块")
+	errUnknownPrev       = errors.New("前一个区块未知")
+)
+
+// 节点评分参数：只使用非法消息的惩罚（P4），每条非法消息的惩罚为（非法消息数的平方 x 权重），约10分钟衰减到零
+const (
+	invalidMessageWeight = -10
+	invalidMessageDecay  = 10 * time.Minute
+	gossipThreshold      = -10  //低于该分数，不再与节点交换gossip
+	publishThreshold     = -50  //低于该分数，不再将自己发布的消息发给节点
+	graylistThreshold    = -80  //低于该分数，忽略节点发来的全部消息
+	hashLength           = 32   //区块哈希和交易ID的长度
+	maxChatMessageLength = 1024 //无payload的文本消息的长度上限
+)
+
+// peerScoreParams 各通道的节点评分参数
+func peerScoreParams(channelNames ...string) (*pubsub.PeerScoreParams, *pubsub.PeerScoreThresholds) {
+	topics := map[string]*pubsub.TopicScoreParams{}
+	for _, name := range channelNames {
+		topics[topicName(name)] = &pubsub.TopicScoreParams{
+			TopicWeight:                    1,
+			TimeInMeshQuantum:              time.Second,
+			InvalidMessageDeliveriesWeight: invalidMessageWeight,
+			InvalidMessageDeliveriesDecay:  pubsub.ScoreParameterDecay(invalidMessageDecay),
+		}
+	}
+
+	params := &pubsub.PeerScoreParams{
+		Topics:           topics,
+		AppSpecificScore: func(peer.ID) float64 { return 0 },
+		DecayInterval:    pubsub.DefaultDecayInterval,
+		DecayToZero:      pubsub.DefaultDecayToZero,
+		RetainScore:      time.Hour,
+	}
+	thresholds := &pubsub.PeerScoreThresholds{
+		GossipThreshold:   gossipThreshold,
+		PublishThreshold:  publishThreshold,
+		GraylistThreshold: graylistThreshold,
+	}
+	return params, thresholds
+}
+
+// messageValidator 通道消息的验证器，区块按本地区块链（创始区块和已知的区块头）验证
+func messageValidator(chain *blockchain.Blockchain) func(context.Context, peer.ID, *pubsub.Message) pubsub.ValidationResult {
+	genesis := chain.GenesisHash()
+	return func(ctx context.Context, from peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
+		return validateMessage(chain, genesis, from, msg)
+	}
+}
+
+// validateMessage 验证一条通道消息
+func validateMessage(chain *blockchain.Blockchain, genesis []byte, from peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
+	if len(msg.Data) > MaxMessageSize {
+		log.Warnf("拒绝来自 %s 的超大消息: %d 字节", ShortID(from), len(msg.Data))
+		return pubsub.ValidationReject
+	}
+
+	var content ChannelContent
+	if err := json.Unmarshal(msg.Data, &content); err != nil {
+		log.Warnf("拒绝来自 %s 的消息: %s", ShortID(from), err)
+		return pubsub.ValidationReject
+	}
+
+	//点对点消息通过流发送，通道中只转发广播消息
+	if content.SendTo != "" {
+		return pubsub.ValidationIgnore
+	}
+	//文本消息（来自UI的输入）没有payload
+	if content.Payload == nil {
+		if len(content.Message) > maxChatMessageLength {
+			return pubsub.ValidationReject
+		}
+		return pubsub.ValidationAccept
+	}
+
+	if len(content.Payload) < commandLength {
+		log.Warnf("拒绝来自 %s 的消息: 长度不足，无法解析命令", ShortID(from))
+		return pubsub.ValidationReject
+	}
+	command := BytesToCmd(content.Payload[:commandLength])
+	if len(content.Payload) > maxPayloadSize(command) {
+		log.Warnf("拒绝来自 %s 的超大 %s 消息: %d 字节", ShortID(from), command, len(content.Payload))
+		return pubsub.ValidationReject
+	}
+
+	var err error
+	payload := content.Payload[commandLength:]
+	switch command {
+	case "block":
+		err = validateBlockPayload(payload, genesis, chain)
+	case "tx":
+		err = validateTxPayload(payload)
+	case "inv":
+		err = validateInvPayload(payload)
+	case "gettxfrompool":
+		var data TxFromPool
+		err = decodeMessage(payload, &data)
+	default:
+		//其它命令是点对点消息，不应该在通道中广播
+		return pubsub.ValidationIgnore
+	}
+
+	if errors.Is(err, errUnknownPrev) {
+		return pubsub.ValidationIgnore
+	}
+	if err != nil {
+		log.Warnf("拒绝来自 %s 的 %s 消息: %s", ShortID(from), command, err)
+		return pubsub.ValidationReject
+	}
+	return pubsub.ValidationAccept
+}
+
+// validateBlockPayload 检查区块的大小限制、创始区块、POW、MerkleRoot、每一笔交易的签名，以及区块能否连接在前一个区块之后
+func validateBlockPayload(payload []byte, genesis []byte, chain *blockchain.Blockchain) error {
+	var data Block
+	if err := decodeMessage(payload, &data); err != nil {
+		return err
+	}
+	block, err := blockchain.DecodeBlock(data.Block)
+	if err != nil {
+		return err
+	}
+	if err := block.CheckSanity(); err != nil {
+		return err
+	}
+	if err := checkGenesis(block, genesis); err != nil {
+		return err
+	}
+	if err := block.CheckProofOfWork(); err != nil {
+		return err
+	}
+	if !bytes.Equal(block.MerkleRoot, block.HashTransactions()) {
+		return blockchain.ErrBadMerkleRoot
+	}
+	if err := verifyBlockSignatures(block); err != nil {
+		return err
+	}
+	return checkConnects(chain, block)
+}
+
+// checkConnects 区块必须连接在本地已知的前一个区块之后（高度连续）；
+// 前一个区块未知时返回errUnknownPrev，区块不再转发，否则无法连接的区块会传遍网络
+func checkConnects(chain *blockchain.Blockchain, block *blockchain.Block) error {
+	if block.IsGenesis() {
+		return nil
+	}
+	prev, err := chain.GetHeader(block.PrevHash)
+	if err != nil {
+		return errUnknownPrev
+	}
+	return block.CheckConnects(prev)
+}
+
+// verifyBlockSignatures 检查区块中每一笔交易的签名，与链上状态无关
+// 通道、流、致密区块和同步收到的区块都要经过这一检查
+func verifyBlockSignatures(block *blockchain.Block) error {
+	for _, tx := range block.Transactions {
+		if !tx.VerifySignatures() {
+			return fmt.Errorf("交易 %x: %w", tx.ID, ErrInvalidSignature)
+		}
+	}
+	return nil
+}
+
+// checkGenesis 没有前一个区块哈希的区块必须是本网络的创始区块，
+// 否则解码后IsGenesis()为真，会绕过与前一个区块的链接检查
+func checkGenesis(block *blockchain.Block, genesis []byte) error {
+	if len(block.PrevHash) == 0 && !bytes.Equal(block.Hash, genesis) {
+		return fmt.Errorf("区块 %x: %w", block.Hash, ErrFakeGenesis)
+	}
+	return nil
+}
+
+// validateTxPayload 检查交易的大小限制和签名
+func validateTxPayload(payload []byte) error {
+	var data Tx
+	if err := decodeMessage(payload, &data); err != nil {
+		return err
+	}
+	tx, err := blockchain.DecodeTransaction(data.Transaction)
+	if err != nil {
+		return err
+	}
+	if err := tx.CheckSanity(); err != nil {
+		return err
+	}
+	if tx.IsMinerTx() {
+		return ErrUnexpectedMinerTx
+	}
+	if !tx.VerifySignatures() {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// validateInvPayload 检查inv清单的类型和其中的哈希
+func validateInvPayload(payload []byte) error {
+	var data Inv
+	if err := decodeMessage(payload, &data); err != nil {
+		return err
+	}
+	if data.Type != "block" && data.Type != "tx" {
+		return ErrBadInventory
+	}
+	for _, item := range data.Items {
+		if len(item) != hashLength {
+			return ErrBadInventory
+		}
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package p2p
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	log "github.com/sirupsen/logrus"
+)
+
+// 节点握手
+// 节点连接后互相发送version消息，其中包含双方支持的协议版本范围、网络ID、创始区块哈希、客户端标识和服务标志。
+// 协议版本范围没有交集、网络ID或创始区块不同的节点无法互通，直接断开连接；
+// 握手成功的节点记录在节点注册表中，交易转发等路由决策根据节点声明的服务进行
+
+const (
+	ProtocolVersion    = 3                   //本节点支持的最高协议版本（版本3支持紧凑区块）
+	MinProtocolVersion = 2                   //本节点支持的最低协议版本（版本1的version消息没有握手信息）
+	DefaultNetworkID   = 1                   //缺省的网络ID
+	UserAgent          = "/linechain:0.2.0/" //客户端标识
+)
+
+// ServiceFlag 节点提供的服务
+type ServiceFlag uint64
+
+const (
+	SFFullNode ServiceFlag = 1 << iota //全节点：保存完整区块链，维护交易池
+	SFMiner                            //挖矿节点
+	SFPruned                           //只保存最近区块的节点
+	SFIndexer                          //提供交易索引查询的节点
+)
+
+var serviceNames = []struct {
+	flag ServiceFlag
+	name string
+}{
+	{SFFullNode, "full"},
+	{SFMiner, "miner"},
+	{SFPruned, "pruned"},
+	{SFIndexer, "indexer"},
+}
+
+// Has 是否提供服务flag
+func (f ServiceFlag) Has(flag ServiceFlag) bool {
+	return f&flag == flag
+}
+
+func (f ServiceFlag) String() string {
+	var names []string
+	for _, s := range serviceNames {
+		if f.Has(s.flag) {
+			names = append(names, s.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, "|")
+}
+
+func (f ServiceFlag) MarshalText() ([]byte, error) {
+	return []byte(f.String()), nil
+}
+
+var (
+	ErrIncompatibleVersion = errors.New("协议版本不兼容")
+	ErrWrongNetwork        = errors.New("网络ID不同")
+	ErrWrongGenesis        = errors.New("创始区块不同")
+)
+
+// checkVersion 检查对方的version消息是否与本节点兼容，返回双方使用的协议版本（双方都支持的最高版本）
+func checkVersion(v *Version, networkId uint32, genesis []byte) (int, error) {
+	if v.NetworkID != networkId {
+		return 0, fmt.Errorf("%w: 对方 %d，本节点 %d", ErrWrongNetwork, v.NetworkID, networkId)
+	}
+	if !bytes.Equal(v.GenesisHash, genesis) {
+		return 0, fmt.Errorf("%w: 对方 %x", ErrWrongGenesis, v.GenesisHash)
+	}
+
+	negotiated := v.Version
+	if negotiated > ProtocolVersion {
+		negotiated = ProtocolVersion
+	}
+	if negotiated < MinProtocolVersion || negotiated < v.MinVersion {
+		return 0, fmt.Errorf("%w: 对方 %d-%d，本节点 %d-%d",
+			ErrIncompatibleVersion, v.MinVersion, v.Version, MinProtocolVersion, ProtocolVersion)
+	}
+	return negotiated, nil
+}
+
+// PeerInfo 握手成功的节点信息
+type PeerInfo struct {
+	PeerID     string
+	Version    int //双方使用的协议版本
+	UserAgent  string
+	Services   ServiceFlag
+	BestHeight int       //最高区块高度：握手时由version告知，之后随节点发来的区块、紧凑区块和区块头更新
+	Since      time.Time //握手完成的时间
+}
+
+// PeerRegistry 握手成功的节点注册表
+type PeerRegistry struct {
+	mutex sync.RWMutex
+	peers map[string]*PeerInfo
+}
+
+func NewPeerRegistry() *PeerRegistry {
+	return &PeerRegistry{peers: map[string]*PeerInfo{}}
+}
+
+// Update 记录握手成功的节点，返回该节点是否是新的节点
+func (r *PeerRegistry) Update(info *PeerInfo) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	old, ok := r.peers[info.PeerID]
+	if ok {
+		info.Since = old.Since
+	}
+	r.peers[info.PeerID] = info
+	return !ok
+}
+
+// UpdateHeight 节点发来更高的区块、紧凑区块或区块头时更新它的最高区块高度（version只在握手和定期询问时发送）
+func (r *PeerRegistry) UpdateHeight(peerId string, height int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if info, ok := r.peers[peerId]; ok && height > info.BestHeight {
+		info.BestHeight = height
+	}
+}
+
+// Get 得到节点信息，节点未完成握手时返回false
+func (r *PeerRegistry) Get(peerId string) (PeerInfo, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	info, ok := r.peers[peerId]
+	if !ok {
+		return PeerInfo{}, false
+	}
+	return *info, true
+}
+
+// Remove 移除断开连接的节点
+func (r *PeerRegistry) Remove(peerId string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	delete(r.peers, peerId)
+}
+
+// HasService 节点是否声明提供服务flag
+func (r *PeerRegistry) HasService(peerId string, flag ServiceFlag) bool {
+	info, ok := r.Get(peerId)
+	return ok && info.Services.Has(flag)
+}
+
+// List 返回所有握手成功的节点（按握手时间排序）
+func (r *PeerRegistry) List() []PeerInfo {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	peers := []PeerInfo{}
+	for _, info := range r.peers {
+		peers = append(peers, *info)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Since.Before(peers[j].Since)
+	})
+	return peers
+}
+
+// notifee 节点断开全部连接时从注册表中移除
+func (r *PeerRegistry) notifee() *network.NotifyBundle {
+	return &network.NotifyBundle{
+		DisconnectedF: func(n network.Network, c network.Conn) {
+			if n.Connectedness(c.RemotePeer()) != network.Connected {
+				r.Remove(c.RemotePeer().Pretty())
+			}
+		},
+	}
+}
+
+// localServices 本节点提供的服务
+func localServices(cfg NodeConfig) ServiceFlag {
+	var services ServiceFlag
+	if cfg.FullNode {
+		services |= SFFullNode
+	}
+	if cfg.Miner {
+		services |= SFMiner
+	}
+	return services
+}
+
+// disconnect 断开与不兼容节点的连接
+func (net *Network) disconnect(id peer.ID, err error) {
+	log.Warnf("断开与节点 %s 的连接: %s", ShortID(id), err)
+	net.Peers.Remove(id.Pretty())
+	net.Host.Network().ClosePeer(id)
+}
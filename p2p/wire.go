@@ -0,0 +1,221 @@
+package p2p
+
+import (
+	blockchain "linechain/core"
+)
+
+// 网络消息的编码
+//
+// 命令之后的payload与区块、交易使用同一种带版本号的确定性编码（见core/encoding.go），
+// 不再使用encoding/gob：其它语言的节点可以据此实现协议，解码时也不会为恶意数据分配超大内存。
+// 每条消息以一个字节的编码版本号开头，随后按命令结构中的字段顺序写入：
+//   string/bytes  uint32长度前缀 + 内容
+//   int           int64；列表中的位置（Indexes、Index）为int32
+//   [][]byte      uint32个数，随后每个元素为bytes
+//
+// 例如 inv：version uint8, sendFrom string, type string, items [][]byte
+
+// wireMessage 命令结构按线格式编码和解码
+type wireMessage interface {
+	encode(e *blockchain.Encoder)
+	decode(d *blockchain.Decoder)
+}
+
+// encodeMessage 按线格式编码命令结构
+func encodeMessage(m wireMessage) []byte {
+	e := &blockchain.Encoder{}
+	e.WriteUint8(blockchain.EncodingVersion)
+	m.encode(e)
+	return e.Bytes()
+}
+
+// decodeMessage 按线格式解码命令结构，数据必须恰好是一条完整的消息
+func decodeMessage(data []byte, m wireMessage) error {
+	d := blockchain.NewDecoder(data)
+	d.ReadVersion()
+	m.decode(d)
+	return d.Finish()
+}
+
+func writeItems(e *blockchain.Encoder, items [][]byte) {
+	e.WriteUint32(uint32(len(items)))
+	for _, item := range items {
+		e.WriteBytes(item)
+	}
+}
+
+func readItems(d *blockchain.Decoder) [][]byte {
+	var items [][]byte
+	//每个元素至少包含一个长度前缀
+	count := d.ReadCount(4)
+	for i := 0; i < count; i++ {
+		items = append(items, d.ReadBytes())
+	}
+	return items
+}
+
+func (m *CmpctBlock) encode(e *blockchain.Encoder) {
+	e.WriteString(m.SendFrom)
+	e.WriteBytes(m.Header)
+	e.WriteInt64(int64(m.Nonce))
+	e.WriteUint32(uint32(len(m.ShortIDs)))
+	for _, id := range m.ShortIDs {
+		e.WriteInt64(int64(id))
+	}
+	e.WriteUint32(uint32(len(m.Prefilled)))
+	for _, p := range m.Prefilled {
+		e.WriteInt32(int32(p.Index))
+		e.WriteBytes(p.Tx)
+	}
+}
+
+func (m *CmpctBlock) decode(d *blockchain.Decoder) {
+	m.SendFrom = d.ReadString()
+	m.Header = d.ReadBytes()
+	m.Nonce = uint64(d.ReadInt64())
+	count := d.ReadCount(8)
+	for i := 0; i < count; i++ {
+		m.ShortIDs = append(m.ShortIDs, uint64(d.ReadInt64()))
+	}
+	//随区块发送的交易至少包含位置和一个长度前缀
+	count = d.ReadCount(8)
+	for i := 0; i < count; i++ {
+		m.Prefilled = append(m.Prefilled, PrefilledTx{int(d.ReadInt32()), d.ReadBytes()})
+	}
+}
+
+func (m *GetBlockTxn) encode(e *blockchain.Encoder) {
+	e.WriteString(m.SendFrom)
+	e.WriteBytes(m.BlockHash)
+	e.WriteUint32(uint32(len(m.Indexes)))
+	for _, i := range m.Indexes {
+		e.WriteInt32(int32(i))
+	}
+}
+
+func (m *GetBlockTxn) decode(d *blockchain.Decoder) {
+	m.SendFrom = d.ReadString()
+	m.BlockHash = d.ReadBytes()
+	count := d.ReadCount(4)
+	for i := 0; i < count; i++ {
+		m.Indexes = append(m.Indexes, int(d.ReadInt32()))
+	}
+}
+
+func (m *BlockTxn) encode(e *blockchain.Encoder) {
+	e.WriteString(m.SendFrom)
+	e.WriteBytes(m.BlockHash)
+	writeItems(e, m.Txs)
+}
+
+func (m *BlockTxn) decode(d *blockchain.Decoder) {
+	m.SendFrom = d.ReadString()
+	m.BlockHash = d.ReadBytes()
+	m.Txs = readItems(d)
+}
+
+func (m *Version) encode(e *blockchain.Encoder) {
+	e.WriteInt64(int64(m.Version))
+	e.WriteInt64(int64(m.MinVersion))
+	e.WriteUint32(m.NetworkID)
+	e.WriteBytes(m.GenesisHash)
+	e.WriteString(m.UserAgent)
+	e.WriteInt64(int64(m.Services))
+	e.WriteInt64(int64(m.BestHeight))
+	e.WriteString(m.SendFrom)
+}
+
+func (m *Version) decode(d *blockchain.Decoder) {
+	m.Version = int(d.ReadInt64())
+	m.MinVersion = int(d.ReadInt64())
+	m.NetworkID = d.ReadUint32()
+	m.GenesisHash = d.ReadBytes()
+	m.UserAgent = d.ReadString()
+	m.Services = ServiceFlag(d.ReadInt64())
+	m.BestHeight = int(d.ReadInt64())
+	m.SendFrom = d.ReadString()
+}
+
+func (m *GetBlocks) encode(e *blockchain.Encoder) {
+	e.WriteString(m.SendFrom)
+	e.WriteInt64(int64(m.Height))
+}
+
+func (m *GetBlocks) decode(d *blockchain.Decoder) {
+	m.SendFrom = d.ReadString()
+	m.Height = int(d.ReadInt64())
+}
+
+func (m *GetHeaders) encode(e *blockchain.Encoder) {
+	e.WriteString(m.SendFrom)
+	writeItems(e, m.Locator)
+}
+
+func (m *GetHeaders) decode(d *blockchain.Decoder) {
+	m.SendFrom = d.ReadString()
+	m.Locator = readItems(d)
+}
+
+func (m *Headers) encode(e *blockchain.Encoder) {
+	e.WriteString(m.SendFrom)
+	writeItems(e, m.Headers)
+}
+
+func (m *Headers) decode(d *blockchain.Decoder) {
+	m.SendFrom = d.ReadString()
+	m.Headers = readItems(d)
+}
+
+func (m *Tx) encode(e *blockchain.Encoder) {
+	e.WriteString(m.SendFrom)
+	e.WriteBytes(m.Transaction)
+}
+
+func (m *Tx) decode(d *blockchain.Decoder) {
+	m.SendFrom = d.ReadString()
+	m.Transaction = d.ReadBytes()
+}
+
+func (m *Block) encode(e *blockchain.Encoder) {
+	e.WriteString(m.SendFrom)
+	e.WriteBytes(m.Block)
+}
+
+func (m *Block) decode(d *blockchain.Decoder) {
+	m.SendFrom = d.ReadString()
+	m.Block = d.ReadBytes()
+}
+
+func (m *TxFromPool) encode(e *blockchain.Encoder) {
+	e.WriteString(m.SendFrom)
+	e.WriteInt64(int64(m.Count))
+}
+
+func (m *TxFromPool) decode(d *blockchain.Decoder) {
+	m.SendFrom = d.ReadString()
+	m.Count = int(d.ReadInt64())
+}
+
+func (m *GetData) encode(e *blockchain.Encoder) {
+	e.WriteString(m.SendFrom)
+	e.WriteString(m.Type)
+	writeItems(e, m.Items)
+}
+
+func (m *GetData) decode(d *blockchain.Decoder) {
+	m.SendFrom = d.ReadString()
+	m.Type = d.ReadString()
+	m.Items = readItems(d)
+}
+
+func (m *Inv) encode(e *blockchain.Encoder) {
+	e.WriteString(m.SendFrom)
+	e.WriteString(m.Type)
+	writeItems(e, m.Items)
+}
+
+func (m *Inv) decode(d *blockchain.Decoder) {
+	m.SendFrom = d.ReadString()
+	m.Type = d.ReadString()
+	m.Items = readItems(d)
+}
@@ -0,0 +1,85 @@
+package event
+
+import (
+	"errors"
+	"sync"
+)
+
+// 事件的发布和订阅：区块链、内存池等发布事件，RPC服务的WebSocket订阅等订阅事件
+// 发布不阻塞发布者：订阅者的缓冲区满时，该订阅被关闭并标记为溢出，订阅者据此知道丢失了事件
+
+var ErrOverflow = errors.New("订阅者处理事件太慢，事件缓冲区溢出")
+
+// Feed 事件源，零值可以直接使用
+type Feed struct {
+	mutex sync.Mutex
+	subs  map[*Subscription]struct{}
+}
+
+// Subscription 一个订阅，从C()接收事件，通道关闭表示订阅结束
+type Subscription struct {
+	feed *Feed
+	ch   chan interface{}
+	err  error
+	once sync.Once
+}
+
+// Subscribe 订阅事件，buffer为事件缓冲区的大小
+func (f *Feed) Subscribe(buffer int) *Subscription {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.subs == nil {
+		f.subs = map[*Subscription]struct{}{}
+	}
+	sub := &Subscription{feed: f, ch: make(chan interface{}, buffer)}
+	f.subs[sub] = struct{}{}
+	return sub
+}
+
+// Send 发布事件，返回收到事件的订阅者数量
+func (f *Feed) Send(value interface{}) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	sent := 0
+	for sub := range f.subs {
+		select {
+		case sub.ch <- value:
+			sent++
+		default:
+			sub.close(ErrOverflow)
+		}
+	}
+	return sent
+}
+
+// close 在持有feed锁时关闭订阅
+func (s *Subscription) close(err error) {
+	s.once.Do(func() {
+		s.err = err
+		delete(s.feed.subs, s)
+		close(s.ch)
+	})
+}
+
+// C 接收事件的通道
+func (s *Subscription) C() <-chan interface{} {
+	return s.ch
+}
+
+// Err 订阅结束的原因，订阅因缓冲区溢出而关闭时为ErrOverflow
+func (s *Subscription) Err() error {
+	s.feed.mutex.Lock()
+	defer s.feed.mutex.Unlock()
+
+	return s.err
+}
+
+// Unsubscribe 取消订阅，可以重复调用
+func (s *Subscription) Unsubscribe() {
+	s.feed.mutex.Lock()
+	defer s.feed.mutex.Unlock()
+
+	s.close(nil)
+}
@@ -0,0 +1,84 @@
+package event
+
+import "testing"
+
+// drain 读出订阅中缓冲的全部事件，返回事件和通道是否已关闭
+func drain(sub *Subscription) (values []interface{}, closed bool) {
+	for {
+		select {
+		case v, ok := <-sub.C():
+			if !ok {
+				return values, true
+			}
+			values = append(values, v)
+		default:
+			return values, false
+		}
+	}
+}
+
+func TestFeedOverflow(t *testing.T) {
+	tests := []struct {
+		name      string
+		buffer    int
+		sends     int
+		wantSent  []int //每次Send返回的收到事件的订阅者数量（另有一个不会溢出的订阅者）
+		wantRecv  int
+		wantClose bool
+		wantErr   error
+	}{
+		{"缓冲区未满", 3, 2, []int{2, 2}, 2, false, nil},
+		{"缓冲区恰好满", 2, 2, []int{2, 2}, 2, false, nil},
+		{"缓冲区溢出", 2, 4, []int{2, 2, 1, 1}, 2, true, ErrOverflow},
+		{"无缓冲", 0, 1, []int{1}, 0, true, ErrOverflow},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var feed Feed
+			sub := feed.Subscribe(tt.buffer)
+			other := feed.Subscribe(len(tt.wantSent))
+
+			for i := 0; i < tt.sends; i++ {
+				if sent := feed.Send(i); sent != tt.wantSent[i] {
+					t.Errorf("第 %d 次Send: 收到的订阅者数量为 %d, 期望 %d", i, sent, tt.wantSent[i])
+				}
+			}
+
+			values, closed := drain(sub)
+			if len(values) != tt.wantRecv || closed != tt.wantClose {
+				t.Errorf("收到 %d 个事件, 通道关闭 %v; 期望 %d 个事件, 通道关闭 %v", len(values), closed, tt.wantRecv, tt.wantClose)
+			}
+			for i, v := range values {
+				if v != i {
+					t.Errorf("第 %d 个事件为 %v, 事件应按发布顺序到达", i, v)
+				}
+			}
+			if err := sub.Err(); err != tt.wantErr {
+				t.Errorf("Err() = %v, 期望 %v", err, tt.wantErr)
+			}
+
+			//一个订阅者溢出不影响其它订阅者
+			if values, closed := drain(other); len(values) != tt.sends || closed {
+				t.Errorf("其它订阅者收到 %d 个事件, 通道关闭 %v", len(values), closed)
+			}
+		})
+	}
+}
+
+func TestFeedUnsubscribe(t *testing.T) {
+	var feed Feed
+	sub := feed.Subscribe(1)
+	sub.Unsubscribe()
+	sub.Unsubscribe()
+
+	if sent := feed.Send("event"); sent != 0 {
+		t.Errorf("取消订阅后仍有 %d 个订阅者收到事件", sent)
+	}
+	if _, closed := drain(sub); !closed {
+		t.Error("取消订阅后通道没有关闭")
+	}
+	if err := sub.Err(); err != nil {
+		t.Errorf("取消订阅后 Err() = %v, 期望 nil", err)
+	}
+}
@@ -0,0 +1,251 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// 进程的生命周期管理
+// 各子系统（数据库、p2p网络、内存池、矿工、RPC服务等）注册启动和停止的回调（Hook），并声明依赖的子系统：
+// 启动时被依赖的子系统先启动，停止时按相反的顺序停止（如RPC服务先于p2p网络停止，数据库最后关闭），
+// 每个子系统的停止都有超时时间；某个子系统停止失败或超时时，它依赖的子系统不再停止（如p2p网络的事件循环仍在写入时不关闭数据库），
+// Stop返回错误，由调用者以非0退出码结束进程
+
+const DefaultTimeout = 30 * time.Second //缺省的子系统停止超时时间
+
+var (
+	ErrDuplicateHook  = errors.New("子系统已注册")
+	ErrUnknownDepend  = errors.New("依赖的子系统未注册")
+	ErrDependCycle    = errors.New("子系统之间存在循环依赖")
+	ErrStopTimeout    = errors.New("子系统停止超时")
+	ErrDependentAlive = errors.New("依赖它的子系统未能停止")
+	ErrAlreadyStarted = errors.New("生命周期管理器已经启动")
+)
+
+// Hook 一个子系统的启动和停止回调，Start和Stop都可以为nil
+type Hook struct {
+	Name      string                          //子系统名称
+	DependsOn []string                        //依赖的子系统：先于本子系统启动，晚于本子系统停止
+	Start     func(ctx context.Context) error //启动子系统，不应阻塞（长期运行的任务在协程中运行）
+	Stop      func(ctx context.Context) error //停止子系统，ctx到期时应尽快返回
+}
+
+// Manager 生命周期管理器
+type Manager struct {
+	mutex   sync.Mutex
+	timeout time.Duration
+	hooks   []Hook
+	started []Hook //已经启动的子系统（按启动顺序）
+	running bool
+
+	stopOnce sync.Once
+	stopCh   chan struct{} //请求退出
+}
+
+// New 创建生命周期管理器，timeout为每个子系统停止的超时时间，为0时使用DefaultTimeout
+func New(timeout time.Duration) *Manager {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return &Manager{
+		timeout: timeout,
+		stopCh:  make(chan struct{}),
+	}
+}
+
+// Register 注册子系统，必须在Start之前调用
+func (m *Manager) Register(hook Hook) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.running {
+		return ErrAlreadyStarted
+	}
+	for _, h := range m.hooks {
+		if h.Name == hook.Name {
+			return fmt.Errorf("%w: %s", ErrDuplicateHook, hook.Name)
+		}
+	}
+	m.hooks = append(m.hooks, hook)
+	return nil
+}
+
+// order 按依赖关系排序子系统：被依赖的在前，没有依赖关系的保持注册顺序
+func (m *Manager) order() ([]Hook, error) {
+	index := map[string]int{}
+	for i, h := range m.hooks {
+		index[h.Name] = i
+	}
+	for _, h := range m.hooks {
+		for _, dep := range h.DependsOn {
+			if _, ok := index[dep]; !ok {
+				return nil, fmt.Errorf("%w: %s 依赖 %s", ErrUnknownDepend, h.Name, dep)
+			}
+		}
+	}
+
+	ordered := make([]Hook, 0, len(m.hooks))
+	done := map[string]bool{}
+	for len(ordered) < len(m.hooks) {
+		progress := false
+		for _, h := range m.hooks {
+			if done[h.Name] {
+				continue
+			}
+			ready := true
+			for _, dep := range h.DependsOn {
+				if !done[dep] {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				ordered = append(ordered, h)
+				done[h.Name] = true
+				progress = true
+			}
+		}
+		if !progress {
+			return nil, ErrDependCycle
+		}
+	}
+	return ordered, nil
+}
+
+// Start 按依赖顺序启动全部子系统；某个子系统启动失败时，停止已经启动的子系统并返回错误
+func (m *Manager) Start(ctx context.Context) error {
+	m.mutex.Lock()
+	if m.running {
+		m.mutex.Unlock()
+		return ErrAlreadyStarted
+	}
+	hooks, err := m.order()
+	if err != nil {
+		m.mutex.Unlock()
+		return err
+	}
+	m.running = true
+	m.mutex.Unlock()
+
+	for _, h := range hooks {
+		if h.Start != nil {
+			if err := h.Start(ctx); err != nil {
+				log.Errorf("启动 %s 失败: %s", h.Name, err)
+				m.Stop()
+				return fmt.Errorf("启动 %s 失败: %w", h.Name, err)
+			}
+		}
+		m.mutex.Lock()
+		m.started = append(m.started, h)
+		m.mutex.Unlock()
+		log.Debugf("%s 已启动", h.Name)
+	}
+	return nil
+}
+
+// Stop 按与启动相反的顺序停止已经启动的子系统，返回第一个错误；重复调用时只停止尚未停止的子系统
+// 停止失败或超时的子系统可能仍在使用它依赖的子系统，这些被依赖的子系统（直接或间接）不再停止
+func (m *Manager) Stop() error {
+	m.RequestStop()
+
+	m.mutex.Lock()
+	started := m.started
+	m.started = nil
+	m.mutex.Unlock()
+
+	var first error
+	failed := map[string]bool{}
+	for i := len(started) - 1; i >= 0; i-- {
+		h := started[i]
+		if dependent := failedDependent(started, failed, h.Name); dependent != "" {
+			failed[h.Name] = true
+			log.Errorf("%s 没有停止，不停止它依赖的 %s", dependent, h.Name)
+			if first == nil {
+				first = fmt.Errorf("停止 %s 失败: %w", h.Name, ErrDependentAlive)
+			}
+			continue
+		}
+		if h.Stop == nil {
+			continue
+		}
+		if err := m.stopHook(h); err != nil {
+			failed[h.Name] = true
+			log.Errorf("停止 %s 失败: %s", h.Name, err)
+			if first == nil {
+				first = fmt.Errorf("停止 %s 失败: %w", h.Name, err)
+			}
+			continue
+		}
+		log.Infof("%s 已停止", h.Name)
+	}
+	return first
+}
+
+// failedDependent 返回依赖name、并且未能停止的子系统名称，没有时返回空字符串
+func failedDependent(hooks []Hook, failed map[string]bool, name string) string {
+	for _, h := range hooks {
+		if !failed[h.Name] {
+			continue
+		}
+		for _, dep := range h.DependsOn {
+			if dep == name {
+				return h.Name
+			}
+		}
+	}
+	return ""
+}
+
+// stopHook 在超时时间内停止一个子系统
+func (m *Manager) stopHook(h Hook) error {
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- h.Stop(ctx)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ErrStopTimeout
+	}
+}
+
+// RequestStop 请求退出，Wait随即返回（如用户退出文字界面）
+func (m *Manager) RequestStop() {
+	m.stopOnce.Do(func() {
+		close(m.stopCh)
+	})
+}
+
+// Wait 阻塞，直到收到SIGINT、SIGTERM或者有子系统请求退出
+func (m *Manager) Wait() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	select {
+	case sig := <-signals:
+		log.Infof("收到退出信号 %s，正在退出", sig)
+	case <-m.stopCh:
+	}
+}
+
+// Run 启动全部子系统，阻塞到收到退出信号，然后停止全部子系统
+func (m *Manager) Run(ctx context.Context) error {
+	if err := m.Start(ctx); err != nil {
+		return err
+	}
+	m.Wait()
+	return m.Stop()
+}
@@ -2,6 +2,7 @@ package utils
 
 import (
 	"fmt"
+	"os"
 	"time"
 
 	"github.com/mattn/go-colorable"
@@ -41,3 +42,11 @@ func SetLog(instanceId string) {
 	})
 	log.AddHook(rotateFileHook)
 }
+
+// SetJSONLog 标准输出也使用JSON格式（后台服务方式运行时，便于日志收集系统解析）
+func SetJSONLog() {
+	log.SetOutput(os.Stdout)
+	log.SetFormatter(&log.JSONFormatter{
+		TimestampFormat: time.RFC3339,
+	})
+}
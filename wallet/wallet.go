@@ -56,6 +56,13 @@ func (w *Wallet) Address() []byte {
 	return address
 }
 
+// AddressFromPubKeyHash 由公钥哈希得到钱包地址（如从交易输出得到接收者的地址）
+func AddressFromPubKeyHash(pubKeyHash []byte) string {
+	versionedHash := append([]byte{version}, pubKeyHash...)
+	fullHash := append(versionedHash, CheckSum(versionedHash)...)
+	return string(Base58Encode(fullHash))
+}
+
 // 使用ecdsa生成新的公私钥对
 func NewKeyPair() (ecdsa.PrivateKey, []byte) {
 	curve := elliptic.P256()//ECDSA基于椭圆曲线，所以我们需要一个椭圆曲线